@@ -2,9 +2,14 @@ package client
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"os"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
@@ -12,27 +17,23 @@ import (
 
 	pb "github.com/rickcollette/primodb/primodb/primodproto"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
 )
 
-const doPanic = true
-
-func check(err error, methodSign string) {
-	if !doPanic {
-		return
-	}
-	if err != nil {
-		log.Fatalf("CLIENT: method %s, Error %v", methodSign, err)
-	}
-}
-
 type PrimoDBClient struct {
     config            *clientconfig.ClientConfig
     dbClient          pb.PrimoDBClient          
     authServiceClient pb.PrimoDBServiceClient   
     conn              *grpc.ClientConn
+    // database is the database every key operation is sent to.
+    database          string
     ClientID          string
     Timeout           time.Duration
     Token             string
+    // TokenExpiresAt is when Token expires; RefreshToken replaces both.
+    TokenExpiresAt    time.Time
+    tokenMu           sync.RWMutex
 }
 
 // ServerAddress returns the address of mdb server.
@@ -41,9 +42,94 @@ func (c *PrimoDBClient) ServerAddress() string {
 	return fmt.Sprintf("%s:%d", serverConfig.Host, serverConfig.Port)
 }
 
+// withToken adds the client's token, once it has one, to an outgoing call.
+func (c *PrimoDBClient) withToken(ctx context.Context) context.Context {
+	c.tokenMu.RLock()
+	token := c.Token
+	c.tokenMu.RUnlock()
+	if token == "" {
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token)
+}
+
+func (c *PrimoDBClient) setToken(resp *pb.AuthResponse) {
+	c.tokenMu.Lock()
+	defer c.tokenMu.Unlock()
+	c.Token = resp.GetToken()
+	c.TokenExpiresAt = time.Unix(resp.GetExpiresAt(), 0)
+}
+
+// RefreshToken swaps the client's token, before it expires, for a new one
+// carrying the user's current roles and signed with the server's current
+// key.
+func (c *PrimoDBClient) RefreshToken() error {
+	ctx, cancel := context.WithTimeout(
+		context.Background(), c.config.Server.Timeout*time.Second)
+	defer cancel()
+	r, err := c.authServiceClient.RefreshToken(ctx, &pb.RefreshTokenRequest{})
+	if err != nil {
+		return err
+	}
+	c.setToken(r)
+	return nil
+}
+
+func (c *PrimoDBClient) unaryToken(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	return invoker(c.withToken(ctx), method, req, reply, cc, opts...)
+}
+
+func (c *PrimoDBClient) streamToken(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	return streamer(c.withToken(ctx), desc, cc, method, opts...)
+}
+
+// dialOptions sets up the connection so every call carries the token, over
+// TLS if the config asks for it.
+func (c *PrimoDBClient) dialOptions() ([]grpc.DialOption, error) {
+	transport := grpc.WithInsecure()
+	if cfg := c.config.TLS; cfg.Enabled || cfg.CAFile != "" || cfg.CertFile != "" {
+		tlsConfig, err := clientTLSConfig(cfg)
+		if err != nil {
+			return nil, err
+		}
+		transport = grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig))
+	}
+	return []grpc.DialOption{
+		transport,
+		grpc.WithChainUnaryInterceptor(c.unaryToken),
+		grpc.WithChainStreamInterceptor(c.streamToken),
+	}, nil
+}
+
+func clientTLSConfig(cfg clientconfig.TLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12, ServerName: cfg.ServerName}
+	if cfg.CAFile != "" {
+		data, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("%s: no PEM certificates", cfg.CAFile)
+		}
+	}
+	if cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
 func (c *PrimoDBClient) setupClient() {
 	// Set up a connection to the server.
-	conn, err := grpc.Dial(c.ServerAddress(), grpc.WithInsecure())
+	opts, err := c.dialOptions()
+	if err != nil {
+		log.Fatalf("did not connect: %v", err)
+	}
+	conn, err := grpc.Dial(c.ServerAddress(), opts...)
 	if err != nil {
 		log.Fatalf("did not connect: %v", err)
 	}
@@ -60,9 +146,18 @@ func (c *PrimoDBClient) Read(key string) (string, error) {
 	ctx, cancel := context.WithTimeout(
 		context.Background(), c.config.Server.Timeout*time.Second)
 	defer cancel()
-	r, err := c.dbClient.Read(ctx, &pb.ReadRequest{Key: key, ClientId: c.ClientID})
-	check(err, "Read")
-	return r.Value, err
+	r, err := c.dbClient.Read(ctx, &pb.ReadRequest{Key: key, Database: c.database, ClientId: c.ClientID})
+	return r.GetValue(), err
+}
+
+// ReadWithVersion returns the value of key along with its version, for use
+// with CompareAndSwap
+func (c *PrimoDBClient) ReadWithVersion(key string) (string, int64, error) {
+	ctx, cancel := context.WithTimeout(
+		context.Background(), c.config.Server.Timeout*time.Second)
+	defer cancel()
+	r, err := c.dbClient.Read(ctx, &pb.ReadRequest{Key: key, Database: c.database, ClientId: c.ClientID})
+	return r.GetValue(), r.GetVersion(), err
 }
 
 // Set grpc client
@@ -70,27 +165,264 @@ func (c *PrimoDBClient) Create(key, value string) (string, error) {
 	ctx, cancel := context.WithTimeout(
 		context.Background(), c.config.Server.Timeout*time.Second)
 	defer cancel()
-	r, err := c.dbClient.Create(ctx, &pb.CreateRequest{Key: key, Value: value, ClientId: c.ClientID})
-	check(err, "Create")
-	return r.Message, err
+	r, err := c.dbClient.Create(ctx, &pb.CreateRequest{Key: key, Value: value, Database: c.database, ClientId: c.ClientID})
+	return r.GetMessage(), err
+}
+
+// CreateWithTTL sets a key that the server expires once ttl has elapsed.
+// The ttl is rounded down to whole seconds.
+func (c *PrimoDBClient) CreateWithTTL(key, value string, ttl time.Duration) (string, error) {
+	ctx, cancel := context.WithTimeout(
+		context.Background(), c.config.Server.Timeout*time.Second)
+	defer cancel()
+	r, err := c.dbClient.Create(ctx, &pb.CreateRequest{Key: key, Value: value, Database: c.database, ClientId: c.ClientID, TtlSeconds: int64(ttl / time.Second)})
+	return r.GetMessage(), err
 }
 
 func (c *PrimoDBClient) Update(key, value string) (string, error) {
 	ctx, cancel := context.WithTimeout(
 		context.Background(), c.config.Server.Timeout*time.Second)
 	defer cancel()
-	r, err := c.dbClient.Update(ctx, &pb.UpdateRequest{Key: key, Value: value, ClientId: c.ClientID})
-	check(err, "Update")
-	return r.Message, err
+	r, err := c.dbClient.Update(ctx, &pb.UpdateRequest{Key: key, Value: value, Database: c.database, ClientId: c.ClientID})
+	return r.GetMessage(), err
+}
+
+// UpdateWithTTL updates a key and sets it to expire once ttl has elapsed.
+// The ttl is rounded down to whole seconds.
+func (c *PrimoDBClient) UpdateWithTTL(key, value string, ttl time.Duration) (string, error) {
+	ctx, cancel := context.WithTimeout(
+		context.Background(), c.config.Server.Timeout*time.Second)
+	defer cancel()
+	r, err := c.dbClient.Update(ctx, &pb.UpdateRequest{Key: key, Value: value, Database: c.database, ClientId: c.ClientID, TtlSeconds: int64(ttl / time.Second)})
+	return r.GetMessage(), err
+}
+// CompareAndSwap sets key to value only if its version is still
+// expectedVersion, 0 meaning the key must not exist yet. It returns whether
+// the swap happened and the new version.
+func (c *PrimoDBClient) CompareAndSwap(key string, expectedVersion int64, value string) (bool, int64, error) {
+	ctx, cancel := context.WithTimeout(
+		context.Background(), c.config.Server.Timeout*time.Second)
+	defer cancel()
+	r, err := c.dbClient.CompareAndSwap(ctx, &pb.CompareAndSwapRequest{Key: key, ExpectedVersion: expectedVersion, Value: value, Database: c.database, ClientId: c.ClientID})
+	return r.GetSwapped(), r.GetVersion(), err
+}
+
+// Txn applies ops in order if every condition holds, and nothing otherwise.
+// The response reports whether it applied and the new version per op.
+func (c *PrimoDBClient) Txn(conditions []*pb.TxnCondition, ops []*pb.TxnOp) (*pb.TxnResponse, error) {
+	ctx, cancel := context.WithTimeout(
+		context.Background(), c.config.Server.Timeout*time.Second)
+	defer cancel()
+	r, err := c.dbClient.Txn(ctx, &pb.TxnRequest{Conditions: conditions, Ops: ops, Database: c.database, ClientId: c.ClientID})
+	return r, err
+}
+
+// Checkpoint asks the server to write a snapshot now and returns the WAL
+// sequence it covers.
+func (c *PrimoDBClient) Checkpoint() (int64, error) {
+	ctx, cancel := context.WithTimeout(
+		context.Background(), c.config.Server.Timeout*time.Second)
+	defer cancel()
+	r, err := c.dbClient.Checkpoint(ctx, &pb.CheckpointRequest{ClientId: c.ClientID})
+	return r.GetSeq(), err
+}
+
+// CreateUser adds a user to the server.
+func (c *PrimoDBClient) CreateUser(username, password string) (string, error) {
+	ctx, cancel := context.WithTimeout(
+		context.Background(), c.config.Server.Timeout*time.Second)
+	defer cancel()
+	r, err := c.authServiceClient.CreateUser(ctx, &pb.CreateUserRequest{Username: username, Password: password})
+	return r.GetMessage(), err
+}
+
+// DeleteUser removes a user from the server.
+func (c *PrimoDBClient) DeleteUser(username string) (string, error) {
+	ctx, cancel := context.WithTimeout(
+		context.Background(), c.config.Server.Timeout*time.Second)
+	defer cancel()
+	r, err := c.authServiceClient.DeleteUser(ctx, &pb.DeleteUserRequest{Username: username})
+	return r.GetMessage(), err
 }
+
+// ChangePassword replaces a user's password, given the current one.
+func (c *PrimoDBClient) ChangePassword(username, oldPassword, newPassword string) (string, error) {
+	ctx, cancel := context.WithTimeout(
+		context.Background(), c.config.Server.Timeout*time.Second)
+	defer cancel()
+	r, err := c.authServiceClient.ChangePassword(ctx, &pb.ChangePasswordRequest{
+		Username: username, OldPassword: oldPassword, NewPassword: newPassword})
+	return r.GetMessage(), err
+}
+
+// ListUsers returns the server's users with their roles.
+func (c *PrimoDBClient) ListUsers() ([]*pb.UserInfo, error) {
+	ctx, cancel := context.WithTimeout(
+		context.Background(), c.config.Server.Timeout*time.Second)
+	defer cancel()
+	r, err := c.authServiceClient.ListUsers(ctx, &pb.ListUsersRequest{})
+	return r.GetUsers(), err
+}
+
+// GrantRole gives a user a role on a database, or on every database with
+// "*". The user gets it on its next login.
+func (c *PrimoDBClient) GrantRole(username, database, role string) (string, error) {
+	ctx, cancel := context.WithTimeout(
+		context.Background(), c.config.Server.Timeout*time.Second)
+	defer cancel()
+	r, err := c.authServiceClient.GrantRole(ctx, &pb.GrantRoleRequest{Username: username, Database: database, Role: role})
+	return r.GetMessage(), err
+}
+
+// RevokeRole takes away the role a user has on a database.
+func (c *PrimoDBClient) RevokeRole(username, database string) (string, error) {
+	ctx, cancel := context.WithTimeout(
+		context.Background(), c.config.Server.Timeout*time.Second)
+	defer cancel()
+	r, err := c.authServiceClient.RevokeRole(ctx, &pb.RevokeRoleRequest{Username: username, Database: database})
+	return r.GetMessage(), err
+}
+
 // Del grpc client
 func (c *PrimoDBClient) Delete(key string) (string, error) {
 	ctx, cancel := context.WithTimeout(
 		context.Background(), c.config.Server.Timeout*time.Second)
 	defer cancel()
-	r, err := c.dbClient.Delete(ctx, &pb.DeleteRequest{Key: key, ClientId: c.ClientID})
-	check(err, "Delete")
-	return r.Message, err
+	r, err := c.dbClient.Delete(ctx, &pb.DeleteRequest{Key: key, Database: c.database, ClientId: c.ClientID})
+	return r.GetMessage(), err
+}
+
+// ScanIterator walks the rows streamed back by Scan. Call Next before each
+// row and Close when done to release the stream.
+type ScanIterator struct {
+	stream pb.PrimoDB_ScanClient
+	cancel context.CancelFunc
+	row    *pb.ScanResponse
+	err    error
+}
+
+// Next advances to the next row. It returns false when the scan is
+// exhausted or failed; check Err to tell the two apart.
+func (it *ScanIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	row, err := it.stream.Recv()
+	if err != nil {
+		if err != io.EOF {
+			it.err = err
+		}
+		it.row = nil
+		return false
+	}
+	it.row = row
+	return true
+}
+
+// Key returns the key of the current row
+func (it *ScanIterator) Key() string {
+	return it.row.GetKey()
+}
+
+// Value returns the value of the current row, empty for keys-only scans
+func (it *ScanIterator) Value() string {
+	return it.row.GetValue()
+}
+
+// Err returns the error that stopped the scan, if any
+func (it *ScanIterator) Err() error {
+	return it.err
+}
+
+// Close cancels the underlying stream
+func (it *ScanIterator) Close() {
+	it.cancel()
+}
+
+// Scan streams keys with start <= key < end, narrowed to prefix when set,
+// in lexical order. An empty end and a limit of 0 are unbounded.
+func (c *PrimoDBClient) Scan(start, end, prefix string, limit int, keysOnly bool) (*ScanIterator, error) {
+	// No per-call timeout: a scan may page through millions of keys.
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := c.dbClient.Scan(ctx, &pb.ScanRequest{
+		StartKey: start,
+		EndKey:   end,
+		Prefix:   prefix,
+		Limit:    int32(limit),
+		KeysOnly: keysOnly,
+		Database: c.database,
+		ClientId: c.ClientID,
+	})
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &ScanIterator{stream: stream, cancel: cancel}, nil
+}
+
+// WatchStream delivers the events of a Watch call. Call Next before each
+// event and Close when done.
+type WatchStream struct {
+	stream pb.PrimoDB_WatchClient
+	cancel context.CancelFunc
+	event  *pb.WatchEvent
+	err    error
+}
+
+// Next blocks until the next event arrives. It returns false once the watch
+// ends; Err reports why.
+func (ws *WatchStream) Next() bool {
+	if ws.err != nil {
+		return false
+	}
+	event, err := ws.stream.Recv()
+	if err != nil {
+		ws.err = err
+		ws.event = nil
+		return false
+	}
+	ws.event = event
+	return true
+}
+
+// Event returns the current event. To resume the watch after a reconnect,
+// pass the Seq of the last event handled and skip the events with that Seq
+// already handled: the events of a transaction share one Seq, and are sent
+// again in the same order.
+func (ws *WatchStream) Event() *pb.WatchEvent {
+	return ws.event
+}
+
+// Err returns the error that ended the watch, if any
+func (ws *WatchStream) Err() error {
+	if ws.err == io.EOF {
+		return nil
+	}
+	return ws.err
+}
+
+// Close cancels the watch
+func (ws *WatchStream) Close() {
+	ws.cancel()
+}
+
+// Watch subscribes to changes of key, or of every key starting with prefix
+// when key is empty. A startSeq > 0 first replays retained events from that
+// WAL sequence on.
+func (c *PrimoDBClient) Watch(key, prefix string, startSeq int64) (*WatchStream, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := c.dbClient.Watch(ctx, &pb.WatchRequest{
+		Key:      key,
+		Prefix:   prefix,
+		StartSeq: startSeq,
+		Database: c.database,
+		ClientId: c.ClientID,
+	})
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &WatchStream{stream: stream, cancel: cancel}, nil
 }
 
 // GetID returns the client id
@@ -107,23 +439,31 @@ func (c *PrimoDBClient) Version() (string, error) {
 	}
 	return c.config.Version, nil
 }
+// NewClient connects to the server and logs in. Key operations go to the
+// database dbname, "" being the default one. With a client certificate in
+// the TLS config, an empty password logs in as the user the certificate
+// names.
 func NewClient(host string, port int, dbname string, timeout time.Duration, clientConfig *clientconfig.ClientConfig, username, password string) (*PrimoDBClient, error) {
     fmt.Printf("Debug - ClientConfig in NewClient: %+v\n", clientConfig)
 
-    address := fmt.Sprintf("%s:%d", host, port)
-    conn, err := grpc.Dial(address, grpc.WithInsecure())
-    if err != nil {
-        return nil, fmt.Errorf("did not connect: %v", err)
-    }
-
     client := PrimoDBClient{
-        dbClient: pb.NewPrimoDBClient(conn),
-        authServiceClient: pb.NewPrimoDBServiceClient(conn), // Create the authentication client
-        conn:     conn,
         ClientID: uuid.New().String(),
         Timeout:  timeout,
         config:   clientConfig,
+        database: dbname,
+    }
+    address := fmt.Sprintf("%s:%d", host, port)
+    opts, err := client.dialOptions()
+    if err != nil {
+        return nil, fmt.Errorf("did not connect: %v", err)
+    }
+    conn, err := grpc.Dial(address, opts...)
+    if err != nil {
+        return nil, fmt.Errorf("did not connect: %v", err)
     }
+    client.conn = conn
+    client.dbClient = pb.NewPrimoDBClient(conn)
+    client.authServiceClient = pb.NewPrimoDBServiceClient(conn) // Create the authentication client
 
     // Authenticate the user using the authServiceClient
     ctx, cancel := context.WithTimeout(context.Background(), client.Timeout)
@@ -138,7 +478,7 @@ func NewClient(host string, port int, dbname string, timeout time.Duration, clie
     }
 
     // Store the token in client for future requests
-    client.Token = authResp.GetToken()
+    client.setToken(authResp)
 
     version, err := client.Version()
     if err != nil {
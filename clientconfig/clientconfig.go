@@ -23,11 +23,29 @@ type ClientConfig struct {
 		Port    int           `yaml:"port"`
 		Timeout time.Duration `yaml:"timeout"`
 	} `yaml:"server"`
+	TLS TLSConfig `yaml:"tls"`
 	Wal struct {
 		Datadir string `yaml:"datadir"`
 	} `yaml:"wal"`
 }
 
+// TLSConfig holds the settings for connecting to a server over TLS
+type TLSConfig struct {
+	// Enabled turns on TLS; setting any of the files does as well.
+	Enabled bool `yaml:"enabled"`
+	// CAFile holds the CAs the server certificate is verified against, the
+	// system's if empty.
+	CAFile string `yaml:"caFile"`
+	// CertFile and KeyFile hold a client certificate for mutual TLS. With
+	// one, logging in needs no password: the server takes the username from
+	// the certificate's common name.
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+	// ServerName is checked against the server certificate instead of the
+	// host connected to.
+	ServerName string `yaml:"serverName"`
+}
+
 func check(err error, methodSign string) {
 	msg := fmt.Sprintf("Failed while running method %s, Error %v", methodSign, err)
 	if !doPanic {
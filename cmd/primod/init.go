@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	server "github.com/rickcollette/primodb/primodb"
+	"github.com/rickcollette/primodb/serverconfig"
+)
+
+// runInit implements `primod init`, which makes a user, created if needed,
+// the first admin of a server so someone can log in and manage it. An
+// existing user has to give its own password. It needs the server to be
+// stopped.
+func runInit(args []string) int {
+	flags := flag.NewFlagSet("primod init", flag.ExitOnError)
+	adminUser := flags.String("admin-user", "", "user to make an admin, created if it doesn't exist")
+	passwordFile := flags.String("admin-password-file", "", "read the admin password from this file instead of stdin")
+	flags.Parse(args)
+	if *adminUser == "" {
+		fmt.Fprintln(os.Stderr, "primod init needs --admin-user")
+		return 2
+	}
+
+	password, err := readAdminPassword(*passwordFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	cfg := serverconfig.Config("server").(*serverconfig.ServerConfig)
+	if err := server.InitAdmin(cfg.Wal, *adminUser, password); err != nil {
+		switch err {
+		case server.ErrAdminExists:
+			err = fmt.Errorf("the server has an admin already, log in as one to manage users")
+		case server.ErrWrongPassword:
+			err = fmt.Errorf("%s exists and that isn't its password", *adminUser)
+		}
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("%s is an admin of all databases\n", *adminUser)
+	return 0
+}
+
+// readAdminPassword reads the password from path, or the first line of stdin
+// without a path.
+func readAdminPassword(path string) (string, error) {
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+	fmt.Fprint(os.Stderr, "Admin password: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("reading the admin password: %w", err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -1,9 +1,39 @@
 package main
 
 import (
+	"flag"
+	"fmt"
+	"os"
+
 	server "github.com/rickcollette/primodb/primodb"
 )
 
 func main() {
-	server.Run()
+	args := os.Args[1:]
+	if len(args) > 0 && args[0] == "wal" {
+		os.Exit(runWal(args[1:]))
+	}
+	if len(args) > 0 && args[0] == "init" {
+		os.Exit(runInit(args[1:]))
+	}
+	restore := len(args) > 0 && args[0] == "restore"
+	if restore {
+		args = args[1:]
+	}
+
+	flags := flag.NewFlagSet("primod", flag.ExitOnError)
+	untilSeq := flags.Int64("until-seq", 0, "recover up to and including this WAL sequence, discarding later records")
+	untilTime := flags.String("until-time", "", "recover the records logged up to this RFC 3339 time, discarding later records")
+	flags.Parse(args)
+
+	target, err := server.ParseRecoveryTarget(*untilSeq, *untilTime)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if restore {
+		server.RunRestore(target)
+		return
+	}
+	server.Run(target)
 }
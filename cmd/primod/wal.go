@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	server "github.com/rickcollette/primodb/primodb"
+	"github.com/rickcollette/primodb/primodb/primodproto"
+	"github.com/rickcollette/primodb/serverconfig"
+	"github.com/rickcollette/primodb/wal"
+	"google.golang.org/protobuf/proto"
+)
+
+const walUsage = `usage: primod wal <command> [flags]
+
+commands:
+  list                      show every segment with its format and sequence range
+  dump [--from-seq N]       print the records as JSON, one per line
+       [--policy P]         recovery policy for corrupted records (default strict)
+  verify                    check every record's checksum and sequence
+  truncate --after-seq N    set aside the records and snapshots after N
+  convert                   rewrite gob segments in the binary segment format`
+
+// runWal implements the `primod wal` subcommands, which work on the WAL in
+// the configured data directory while the server isn't running. The ones
+// that change the WAL take the data directory lock first.
+func runWal(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, walUsage)
+		return 2
+	}
+	cfg := serverconfig.Config("server").(*serverconfig.ServerConfig)
+	dir := cfg.Wal.Datadir
+
+	var err error
+	switch args[0] {
+	case "list":
+		err = walList(dir)
+	case "dump":
+		err = walDump(cfg.Wal, args[1:])
+	case "verify":
+		err = walVerify(cfg.Wal)
+	case "truncate":
+		err = walTruncate(cfg.Wal, args[1:])
+	case "convert":
+		err = walConvert(dir)
+	default:
+		fmt.Fprintln(os.Stderr, walUsage)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func walList(dir string) error {
+	infos, err := wal.Inspect(dir)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SEGMENT\tVERSION\tCOMPRESSION\tENCRYPTED\tSIZE\tRECORDS\tFIRST\tLAST\tSTATUS")
+	for _, info := range infos {
+		status := "ok"
+		if info.Err != nil {
+			status = info.Err.Error()
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%t\t%d\t%d\t%d\t%d\t%s\n", info.Name, info.Version, info.Compression,
+			info.Encrypted, info.Size, info.Records, info.FirstSeq, info.LastSeq, status)
+	}
+	return tw.Flush()
+}
+
+// dumpedRecord is the JSON form of a record printed by `primod wal dump`.
+type dumpedRecord struct {
+	Seq       int64          `json:"seq,omitempty"`
+	Cmd       string         `json:"cmd"`
+	Database  string         `json:"database"`
+	Key       string         `json:"key"`
+	Value     string         `json:"value,omitempty"`
+	Version   int64          `json:"version,omitempty"`
+	ExpiresAt string         `json:"expiresAt,omitempty"`
+	Timestamp string         `json:"timestamp,omitempty"`
+	Ops       []dumpedRecord `json:"ops,omitempty"`
+}
+
+func newDumpedRecord(seq int64, rec *primodproto.Record) dumpedRecord {
+	d := dumpedRecord{
+		Seq:       seq,
+		Cmd:       rec.GetCmd(),
+		Database:  rec.GetDatabase(),
+		Key:       rec.GetKey(),
+		Value:     rec.GetValue(),
+		Version:   rec.GetVersion(),
+		ExpiresAt: formatUnixNano(rec.GetExpiresAt()),
+		Timestamp: formatUnixNano(rec.GetTimestamp()),
+	}
+	for _, op := range rec.GetOps() {
+		d.Ops = append(d.Ops, newDumpedRecord(0, op))
+	}
+	return d
+}
+
+func formatUnixNano(ns int64) string {
+	if ns == 0 {
+		return ""
+	}
+	return time.Unix(0, ns).UTC().Format(time.RFC3339Nano)
+}
+
+func walDump(walConfig serverconfig.WalConfig, args []string) error {
+	flags := flag.NewFlagSet("primod wal dump", flag.ExitOnError)
+	fromSeq := flags.Int64("from-seq", 0, "skip the records before this sequence")
+	policyName := flags.String("policy", string(wal.Strict), "strict, truncate-tail or skip-corrupt; truncate-tail cuts the log")
+	flags.Parse(args)
+
+	policy, err := wal.ParseRecoveryPolicy(*policyName)
+	if err != nil {
+		return err
+	}
+	if policy == wal.TruncateTail {
+		lock, err := wal.LockDir(walConfig.Datadir)
+		if err != nil {
+			return err
+		}
+		defer lock.Unlock()
+	}
+	key, err := server.LoadEncryptionKey(walConfig)
+	if err != nil {
+		return err
+	}
+	w, err := wal.Open(walConfig.Datadir, policy, key)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	enc := json.NewEncoder(os.Stdout)
+	damage, err := w.Read(func(record *wal.Record) error {
+		if record.Seq < *fromSeq {
+			return nil
+		}
+		rec := &primodproto.Record{}
+		if err := proto.Unmarshal(record.Data, rec); err != nil {
+			return fmt.Errorf("seq %d: %w", record.Seq, err)
+		}
+		return enc.Encode(newDumpedRecord(record.Seq, rec))
+	})
+	for _, d := range damage {
+		fmt.Fprintf(os.Stderr, "damaged: %s\n", d)
+	}
+	return err
+}
+
+func walVerify(walConfig serverconfig.WalConfig) error {
+	key, err := server.LoadEncryptionKey(walConfig)
+	if err != nil {
+		return err
+	}
+	w, err := wal.Open(walConfig.Datadir, wal.Strict, key)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	if err := w.Verify(); err != nil {
+		return err
+	}
+	fmt.Printf("WAL ok, last seq %d\n", w.LastSeq())
+	return nil
+}
+
+func walTruncate(walConfig serverconfig.WalConfig, args []string) error {
+	flags := flag.NewFlagSet("primod wal truncate", flag.ExitOnError)
+	afterSeq := flags.Int64("after-seq", -1, "keep the records up to and including this sequence")
+	flags.Parse(args)
+	if *afterSeq < 0 {
+		return fmt.Errorf("primod wal truncate needs --after-seq")
+	}
+	lock, err := wal.LockDir(walConfig.Datadir)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	return server.TruncateAfter(walConfig, *afterSeq)
+}
+
+func walConvert(dir string) error {
+	lock, err := wal.LockDir(dir)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	converted, err := wal.Convert(dir)
+	for _, name := range converted {
+		fmt.Printf("converted %s\n", name)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d segments converted\n", len(converted))
+	return nil
+}
@@ -0,0 +1,61 @@
+package memtable
+
+import "container/heap"
+
+// expiryQueueSlack is how many stale entries an expiryQueue may hold beyond
+// twice the rows of its store before it is rebuilt.
+const expiryQueueSlack = 64
+
+// expiryEntry queues a row version with a TTL.
+type expiryEntry struct {
+	key       string
+	version   int64
+	expiresAt int64
+}
+
+// expiryQueue is a min-heap of the rows with a TTL, soonest expiry first, so
+// finding the expired rows doesn't scan the whole store. Entries stay queued
+// when their row is rewritten or removed and are dropped once they reach the
+// front. It isn't safe for concurrent use; KVStore guards it with its own
+// mutex.
+type expiryQueue []expiryEntry
+
+func (q expiryQueue) Len() int           { return len(q) }
+func (q expiryQueue) Less(i, j int) bool { return q[i].expiresAt < q[j].expiresAt }
+func (q expiryQueue) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+
+func (q *expiryQueue) Push(x interface{}) {
+	*q = append(*q, x.(expiryEntry))
+}
+
+func (q *expiryQueue) Pop() interface{} {
+	old := *q
+	e := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return e
+}
+
+// trackExpiry queues row, already stored in s.data, if it has a TTL. The
+// caller must hold s.mux.
+func (s *KVStore) trackExpiry(row KVRow) {
+	if row.expiresAt == 0 {
+		return
+	}
+	heap.Push(&s.expiries, expiryEntry{key: row.Key, version: row.Version, expiresAt: row.expiresAt})
+	if len(s.expiries) > 2*len(s.data)+expiryQueueSlack {
+		s.rebuildExpiries()
+	}
+}
+
+// rebuildExpiries requeues the stored rows with a TTL, dropping the entries
+// of rows rewritten or removed since they were queued. The caller must hold
+// s.mux.
+func (s *KVStore) rebuildExpiries() {
+	s.expiries = s.expiries[:0]
+	for _, row := range s.data {
+		if row.expiresAt != 0 {
+			s.expiries = append(s.expiries, expiryEntry{key: row.Key, version: row.Version, expiresAt: row.expiresAt})
+		}
+	}
+	heap.Init(&s.expiries)
+}
@@ -0,0 +1,186 @@
+package memtable
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// keysOf returns the keys of rows.
+func keysOf(rows []KVRow) []string {
+	keys := make([]string, 0, len(rows))
+	for _, row := range rows {
+		keys = append(keys, row.Key)
+	}
+	return keys
+}
+
+func checkKeys(t *testing.T, what string, rows []KVRow, want ...string) {
+	t.Helper()
+	if got := keysOf(rows); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("%s: got %v, want %v", what, got, want)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	s := newKVStore()
+	now := time.Now()
+	_, err := s.CreateWithExpiry("later", "v", now.Add(time.Hour))
+	mustOK(t, err)
+	_, err = s.CreateWithExpiry("past", "v", now.Add(-time.Second))
+	mustOK(t, err)
+	_, err = s.CreateWithExpiry("pastest", "v", now.Add(-time.Minute))
+	mustOK(t, err)
+	_, err = s.Create("forever", "v")
+	mustOK(t, err)
+
+	// Expired rows are hidden before they are removed
+	if _, err := s.Read("past"); err != ErrKeyNotFound {
+		t.Fatalf("Read of an expired key got %v, want ErrKeyNotFound", err)
+	}
+	checkKeys(t, "Scan", s.Scan("", "", 0), "forever", "later")
+	checkKeys(t, "Expired", s.Expired(now), "pastest", "past")
+	checkKeys(t, "Expired again", s.Expired(now), "pastest", "past")
+	checkKeys(t, "Expired in two hours", s.Expired(now.Add(2*time.Hour)), "pastest", "past", "later")
+
+	if !s.Expire("past", now) || s.Expire("past", now) {
+		t.Fatal("Expire didn't remove an expired key exactly once")
+	}
+	checkKeys(t, "Expired after Expire", s.Expired(now), "pastest")
+
+	// A key created again after it expired is a new row
+	_, err = s.Create("pastest", "back")
+	mustOK(t, err)
+	checkKeys(t, "Expired after recreating", s.Expired(now.Add(2*time.Hour)), "later")
+}
+
+func TestExpiryRewritten(t *testing.T) {
+	s := newKVStore()
+	past := time.Now().Add(-time.Second)
+	_, err := s.CreateWithExpiry("k", "v", past)
+	mustOK(t, err)
+	_, err = s.CreateWithExpiry("k", "v", time.Now().Add(time.Hour))
+	mustOK(t, err)
+	checkKeys(t, "Expired after extending the TTL", s.Expired(time.Now()))
+
+	_, err = s.Update("k", "no ttl")
+	mustOK(t, err)
+	checkKeys(t, "Expired after dropping the TTL", s.Expired(time.Now().Add(2*time.Hour)))
+
+	mustOK(t, s.DeleteIf("k", Condition{}))
+	_, err = s.CreateWithExpiry("k", "v", past)
+	mustOK(t, err)
+	checkKeys(t, "Expired after recreating with a TTL", s.Expired(time.Now()), "k")
+}
+
+func TestExpiryQueueBounded(t *testing.T) {
+	s := newKVStore()
+	for i := 0; i < 1000; i++ {
+		_, err := s.CreateWithTTL("k", "v", time.Hour)
+		mustOK(t, err)
+	}
+	if n := len(s.expiries); n > 2*len(s.data)+expiryQueueSlack {
+		t.Fatalf("expiry queue holds %d entries for %d rows", n, len(s.data))
+	}
+	checkKeys(t, "Expired", s.Expired(time.Now().Add(2*time.Hour)), "k")
+}
+
+// TestReplayExpire replays records in log order: an EXPIRE record only
+// removes the row if it expired by the record's deadline, so it can't remove
+// a row written after it.
+func TestReplayExpire(t *testing.T) {
+	s := newKVStore()
+	deadline := time.Now().Add(-time.Minute)
+	s.Restore("k", "v1", deadline, 1)
+	s.Restore("k", "v2", deadline.Add(-time.Second), 2)
+	if !s.Expire("k", deadline) {
+		t.Fatal("EXPIRE didn't remove the row it expired")
+	}
+	s.Restore("k", "v3", time.Time{}, 3)
+	if s.Expire("k", deadline) {
+		t.Fatal("replayed EXPIRE removed a row without a TTL written after it")
+	}
+	s.Restore("k", "v4", deadline.Add(time.Second), 4)
+	if s.Expire("k", deadline) {
+		t.Fatal("replayed EXPIRE removed a row expiring after its deadline")
+	}
+
+	// A snapshot and the WAL after it can restore the same row twice
+	s.Restore("j", "v", deadline, 5)
+	s.Restore("j", "v", deadline, 5)
+	checkKeys(t, "Expired", s.Expired(time.Now()), "j", "k")
+	if s.revision != 5 {
+		t.Fatalf("revision %d after replay, want 5", s.revision)
+	}
+}
+
+func TestExpireRow(t *testing.T) {
+	s := NewDatabaseStore()
+	db := s.GetDatabase("db")
+	past := time.Now().Add(-time.Second)
+	_, err := db.CreateWithExpiry("k", "v", past)
+	mustOK(t, err)
+	row := db.Expired(time.Now())[0]
+
+	// The key was rewritten after the sweeper found it expired
+	_, err = db.CreateWithExpiry("k", "v2", past)
+	mustOK(t, err)
+	called := false
+	mustOK(t, db.expireRow("db", row, func(string, KVRow) error { called = true; return nil }))
+	if called {
+		t.Fatal("onExpire called for a version that was rewritten")
+	}
+	if _, ok := db.data["k"]; !ok {
+		t.Fatal("expireRow removed a row rewritten since it was found")
+	}
+
+	// A failed onExpire keeps the row for the next sweep
+	failure := errors.New("log failed")
+	row = db.Expired(time.Now())[0]
+	if err := db.expireRow("db", row, func(string, KVRow) error { return failure }); err != failure {
+		t.Fatalf("expireRow got %v, want the onExpire error", err)
+	}
+	checkKeys(t, "Expired after a failed onExpire", db.Expired(time.Now()), "k")
+
+	var expired []string
+	s.sweep(time.Now(), func(database string, row KVRow) error {
+		expired = append(expired, database+"/"+row.Key+"="+row.Value)
+		return nil
+	})
+	if fmt.Sprint(expired) != "[db/k=v2]" {
+		t.Fatalf("sweep expired %v, want [db/k=v2]", expired)
+	}
+	if _, ok := db.data["k"]; ok || db.index.length != 0 {
+		t.Fatal("sweep left the expired row behind")
+	}
+	checkKeys(t, "Expired after sweep", db.Expired(time.Now()))
+}
+
+func TestSweeper(t *testing.T) {
+	s := NewDatabaseStore()
+	db := s.GetDatabase("")
+	_, err := db.CreateWithTTL("k", "v", time.Millisecond)
+	mustOK(t, err)
+	removed := make(chan string, 1)
+	stop := s.StartSweeper(5*time.Millisecond, func(_ string, row KVRow) error {
+		removed <- row.Key
+		return nil
+	})
+	defer stop()
+	select {
+	case key := <-removed:
+		if key != "k" {
+			t.Fatalf("sweeper removed %q, want k", key)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("sweeper didn't remove the expired key")
+	}
+}
+
+func mustOK(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -2,7 +2,10 @@
 package memtable
 
 import (
+	"container/heap"
 	"errors"
+	"log"
+	"sort"
 	"sync"
 	"time"
 )
@@ -13,56 +16,319 @@ var (
 	ErrInvalidCommand       = errors.New("error: Invalid command")
 	ErrInvalidNoOfArguments = errors.New("error: Invalid number of arguments passed")
 	ErrKeyValueMissing      = errors.New("error: Key or value not passed")
+	ErrKeyExists            = errors.New("error: Key already exists")
+	ErrVersionMismatch      = errors.New("error: Version mismatch")
 )
 
 // KVRow individual row in db
 type KVRow struct {
 	Key       string
 	Value     string
+	Version   int64 // store revision of the write that produced the row
 	createdAt int64
+	expiresAt int64 // unix nanoseconds, 0 if the row never expires
+}
+
+// expired reports whether the row's TTL has run out at now
+func (r KVRow) expired(now time.Time) bool {
+	return r.expiresAt != 0 && r.expiresAt <= now.UnixNano()
+}
+
+// ExpiresAt returns when the row expires, or the zero Time if it never does
+func (r KVRow) ExpiresAt() time.Time {
+	if r.expiresAt == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, r.expiresAt)
 }
 
 // KVStore DB memory map
 type KVStore struct {
-	data map[string]KVRow
-	mux  sync.Mutex
+	data     map[string]KVRow
+	index    *skipList   // keys of data in lexical order
+	expiries expiryQueue // rows of data with a TTL, soonest expiry first
+	revision int64       // version handed to the latest write
+	mux      sync.Mutex
+}
+
+func newKVStore() *KVStore {
+	return &KVStore{data: make(map[string]KVRow), index: newSkipList()}
+}
+
+func newKVRow(key, value string, expiresAt time.Time, version int64) KVRow {
+	row := KVRow{Key: key, Value: value, Version: version, createdAt: time.Now().Unix()}
+	if !expiresAt.IsZero() {
+		row.expiresAt = expiresAt.UnixNano()
+	}
+	return row
+}
+
+// ExpiryFromTTL converts a TTL into an absolute expiry. A ttl <= 0 returns
+// the zero Time, which never expires.
+func ExpiryFromTTL(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(ttl)
 }
 
+// get returns the live row for key. The caller must hold s.mux.
+func (s *KVStore) get(key string, now time.Time) (KVRow, bool) {
+	row, ok := s.data[key]
+	if !ok || row.expired(now) {
+		return KVRow{}, false
+	}
+	return row, true
+}
 
 func (s *KVStore) Create(key, value string) (string, error) {
-	s.mux.Lock()
-	defer s.mux.Unlock()
-	s.data[key] = KVRow{key, value, time.Now().Unix()}
+	return s.CreateWithExpiry(key, value, time.Time{})
+}
+
+// CreateWithTTL inserts a key that disappears once ttl has elapsed. A ttl
+// <= 0 never expires.
+func (s *KVStore) CreateWithTTL(key, value string, ttl time.Duration) (string, error) {
+	return s.CreateWithExpiry(key, value, ExpiryFromTTL(ttl))
+}
+
+// CreateWithExpiry inserts a key that disappears at expiresAt. A zero
+// expiresAt never expires.
+func (s *KVStore) CreateWithExpiry(key, value string, expiresAt time.Time) (string, error) {
+	if _, err := s.CreateIf(key, value, expiresAt, Condition{}); err != nil {
+		return "Inserted 0", err
+	}
 	return "Inserted 1", nil
 }
 
+// CreateIf inserts or overwrites key when cond holds and returns the new row.
+func (s *KVStore) CreateIf(key, value string, expiresAt time.Time, cond Condition) (row KVRow, err error) {
+	err = s.Txn(func(tx *Tx) error {
+		if err := tx.Check(key, cond); err != nil {
+			return err
+		}
+		row = tx.Put(key, value, expiresAt)
+		return nil
+	})
+	return row, err
+}
+
 func (s *KVStore) Read(key string) (string, error) {
-	if s.data[key] != (KVRow{}) {
-		return s.data[key].Value, nil
-	}
-	return "", ErrKeyNotFound
+	row, err := s.ReadRow(key)
+	return row.Value, err
 }
 
-func (s *KVStore) Update(key, value string) (string, error) {
+// ReadRow returns the live row for key, including its version.
+func (s *KVStore) ReadRow(key string) (KVRow, error) {
 	s.mux.Lock()
 	defer s.mux.Unlock()
-	if found, _ := s.Read(key); len(found) == 0 {
-		return "Updated 0", ErrKeyNotFound
+	if row, ok := s.get(key, time.Now()); ok {
+		return row, nil
+	}
+	return KVRow{}, ErrKeyNotFound
+}
+
+// Update replaces the value of an existing key. Any TTL on the old row is
+// dropped.
+func (s *KVStore) Update(key, value string) (string, error) {
+	return s.UpdateWithExpiry(key, value, time.Time{})
+}
+
+// UpdateWithTTL replaces the value of an existing key and sets it to expire
+// once ttl has elapsed. A ttl <= 0 never expires.
+func (s *KVStore) UpdateWithTTL(key, value string, ttl time.Duration) (string, error) {
+	return s.UpdateWithExpiry(key, value, ExpiryFromTTL(ttl))
+}
+
+// UpdateWithExpiry replaces the value of an existing key and sets it to
+// expire at expiresAt. A zero expiresAt never expires.
+func (s *KVStore) UpdateWithExpiry(key, value string, expiresAt time.Time) (string, error) {
+	if _, err := s.UpdateIf(key, value, expiresAt, Condition{}); err != nil {
+		return "Updated 0", err
 	}
-	s.data[key] = KVRow{key, value, time.Now().Unix()}
 	return "Updated 1", nil
 }
 
+// UpdateIf replaces the value of an existing key when cond holds and returns
+// the new row.
+func (s *KVStore) UpdateIf(key, value string, expiresAt time.Time, cond Condition) (row KVRow, err error) {
+	err = s.Txn(func(tx *Tx) error {
+		if err := tx.Check(key, cond); err != nil {
+			return err
+		}
+		if _, ok := tx.Get(key); !ok {
+			return ErrKeyNotFound
+		}
+		row = tx.Put(key, value, expiresAt)
+		return nil
+	})
+	return row, err
+}
+
+// CompareAndSwap sets key to value only if its current version is
+// expectedVersion and returns the new row. An expectedVersion of 0 means the
+// key must not exist yet. The row keeps its TTL, if any.
+func (s *KVStore) CompareAndSwap(key string, expectedVersion int64, value string) (row KVRow, err error) {
+	err = s.Txn(func(tx *Tx) error {
+		cond := Condition{IfVersion: expectedVersion, IfNotExists: expectedVersion == 0}
+		if err := tx.Check(key, cond); err != nil {
+			return err
+		}
+		old, _ := tx.Get(key)
+		row = tx.Put(key, value, old.ExpiresAt())
+		return nil
+	})
+	return row, err
+}
+
 func (s *KVStore) Delete(key string) (string, error) {
+	if err := s.DeleteIf(key, Condition{}); err != nil {
+		return "Deleted 0", err
+	}
+	return "Deleted 1", nil
+}
+
+// DeleteIf removes an existing key when cond holds.
+func (s *KVStore) DeleteIf(key string, cond Condition) error {
+	return s.Txn(func(tx *Tx) error {
+		if err := tx.Check(key, cond); err != nil {
+			return err
+		}
+		if !tx.Delete(key) {
+			return ErrKeyNotFound
+		}
+		return nil
+	})
+}
+
+// Dump returns a copy of every live row in key order along with the store
+// revision, for writing a snapshot.
+func (s *KVStore) Dump() ([]KVRow, int64) {
+	return s.DumpWith(nil)
+}
+
+// DumpWith is Dump calling fn, if not nil, while the store is still locked,
+// so fn sees the store as it was copied.
+func (s *KVStore) DumpWith(fn func()) ([]KVRow, int64) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if fn != nil {
+		fn()
+	}
+	now := time.Now()
+	rows := make([]KVRow, 0, s.index.length)
+	for n := s.index.seek(""); n != nil; n = n.next[0] {
+		if row := s.data[n.key]; !row.expired(now) {
+			rows = append(rows, row)
+		}
+	}
+	return rows, s.revision
+}
+
+// SetRevision raises the store revision to at least revision, so versions of
+// rows deleted before a snapshot are never handed out again.
+func (s *KVStore) SetRevision(revision int64) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if revision > s.revision {
+		s.revision = revision
+	}
+}
+
+// Restore writes a row with a known version, as when rebuilding the store
+// from the WAL. It skips all checks and never lowers the store revision.
+func (s *KVStore) Restore(key, value string, expiresAt time.Time, version int64) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	row := newKVRow(key, value, expiresAt, version)
+	s.data[key] = row
+	s.index.insert(key)
+	s.trackExpiry(row)
+	if version > s.revision {
+		s.revision = version
+	}
+}
+
+// Expired returns the rows whose TTL has run out at now, soonest expiry
+// first. They stay in the store until Expire removes them.
+func (s *KVStore) Expired(now time.Time) []KVRow {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	var rows []KVRow
+	var found map[string]bool
+	for len(s.expiries) > 0 && s.expiries[0].expiresAt <= now.UnixNano() {
+		e := heap.Pop(&s.expiries).(expiryEntry)
+		row, ok := s.data[e.key]
+		if !ok || row.Version != e.version || found[e.key] {
+			// Rewritten or removed since it was queued
+			continue
+		}
+		if found == nil {
+			found = make(map[string]bool)
+		}
+		found[e.key] = true
+		rows = append(rows, row)
+	}
+	// Rows that fail to be removed are found again by the next call
+	for _, row := range rows {
+		heap.Push(&s.expiries, expiryEntry{key: row.Key, version: row.Version, expiresAt: row.expiresAt})
+	}
+	return rows
+}
+
+// Expire removes key if it has a TTL that ran out at or before deadline. A
+// key rewritten with a later or no expiry is kept, so replaying an old
+// expiry can't remove newer data. It reports whether the key was removed.
+func (s *KVStore) Expire(key string, deadline time.Time) bool {
 	s.mux.Lock()
 	defer s.mux.Unlock()
-	if found, _ := s.Read(key); len(found) == 0 {
-		return "Deleted 0", ErrKeyNotFound
+	row, ok := s.data[key]
+	if !ok || !row.expired(deadline) {
+		return false
 	}
 	delete(s.data, key)
-	return "Deleted 1", nil
+	s.index.remove(key)
+	return true
+}
+
+// Scan returns live rows with start <= key < end in lexical order. An empty
+// end scans to the last key and a limit <= 0 returns every matching row.
+func (s *KVStore) Scan(start, end string, limit int) []KVRow {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	now := time.Now()
+	var rows []KVRow
+	for n := s.index.seek(start); n != nil; n = n.next[0] {
+		if end != "" && n.key >= end {
+			break
+		}
+		if limit > 0 && len(rows) >= limit {
+			break
+		}
+		if row := s.data[n.key]; !row.expired(now) {
+			rows = append(rows, row)
+		}
+	}
+	return rows
 }
 
+// PrefixScan returns rows whose key starts with prefix in lexical order. A
+// limit <= 0 returns every matching row.
+func (s *KVStore) PrefixScan(prefix string, limit int) []KVRow {
+	return s.Scan(prefix, PrefixEnd(prefix), limit)
+}
+
+// PrefixEnd returns the smallest key greater than every key starting with
+// prefix, or "" when there is no such key (e.g. prefix is empty or all 0xff).
+func PrefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
 
 // Singleton KVStore instance
 var once sync.Once
@@ -71,7 +337,7 @@ var store *KVStore
 // NewDB returns a singleton KVStore instance
 func NewDB() *KVStore {
 	once.Do(func() {
-		store = &KVStore{data: make(map[string]KVRow)}
+		store = newKVStore()
 	})
 	return store
 }
@@ -96,13 +362,26 @@ func (s *DatabaseStore) GetDatabase(name string) *KVStore {
 
 	db, exists := s.databases[name]
 	if !exists {
-		db = &KVStore{data: make(map[string]KVRow)}
+		db = newKVStore()
 		s.databases[name] = db
 	}
 
 	return db
 }
 
+// Names returns the names of all databases in lexical order.
+func (s *DatabaseStore) Names() []string {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	names := make([]string, 0, len(s.databases))
+	for name := range s.databases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 // DeleteDatabase deletes an in-memory database by name.
 func (s *DatabaseStore) DeleteDatabase(name string) {
 	s.mux.Lock()
@@ -110,3 +389,71 @@ func (s *DatabaseStore) DeleteDatabase(name string) {
 
 	delete(s.databases, name)
 }
+
+// ExpireFunc is called by the sweeper for each expired row before it is
+// removed, with the row's database locked. Returning an error keeps the row
+// for the next sweep.
+type ExpireFunc func(database string, row KVRow) error
+
+// StartSweeper removes expired rows from every database once per interval
+// until the returned stop function is called. stop returns once the sweeper
+// has exited, so no sweep runs after it. onExpire may be nil.
+func (s *DatabaseStore) StartSweeper(interval time.Duration, onExpire ExpireFunc) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer close(stopped)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				s.sweep(now, onExpire)
+			}
+		}
+	}()
+	var stopOnce sync.Once
+	return func() {
+		stopOnce.Do(func() { close(done) })
+		<-stopped
+	}
+}
+
+func (s *DatabaseStore) sweep(now time.Time, onExpire ExpireFunc) {
+	s.mux.Lock()
+	databases := make(map[string]*KVStore, len(s.databases))
+	for name, db := range s.databases {
+		databases[name] = db
+	}
+	s.mux.Unlock()
+
+	for name, db := range databases {
+		for _, row := range db.Expired(now) {
+			if err := db.expireRow(name, row, onExpire); err != nil {
+				log.Printf("memtable: failed to expire %q in database %q: %v", row.Key, name, err)
+			}
+		}
+	}
+}
+
+// expireRow removes row if it is still the stored, expired version of its
+// key. onExpire runs under the store lock first, so nothing can rewrite the
+// key between the callback and the removal.
+func (s *KVStore) expireRow(database string, row KVRow, onExpire ExpireFunc) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	cur, ok := s.data[row.Key]
+	if !ok || cur.Version != row.Version || !cur.expired(time.Now()) {
+		return nil
+	}
+	if onExpire != nil {
+		if err := onExpire(database, cur); err != nil {
+			return err
+		}
+	}
+	delete(s.data, row.Key)
+	s.index.remove(row.Key)
+	return nil
+}
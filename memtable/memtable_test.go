@@ -0,0 +1,100 @@
+package memtable
+
+import (
+	"testing"
+	"time"
+)
+
+// storeWith returns a store holding keys, each with itself as value.
+func storeWith(t *testing.T, keys ...string) *KVStore {
+	t.Helper()
+	s := newKVStore()
+	for _, key := range keys {
+		_, err := s.Create(key, key)
+		mustOK(t, err)
+	}
+	return s
+}
+
+func TestScanRange(t *testing.T) {
+	s := storeWith(t, "b", "a", "c", "ca", "cb", "d", "")
+	for _, tc := range []struct {
+		start, end string
+		limit      int
+		want       []string
+	}{
+		{"", "", 0, []string{"", "a", "b", "c", "ca", "cb", "d"}},
+		{"b", "", 0, []string{"b", "c", "ca", "cb", "d"}},
+		{"b", "cb", 0, []string{"b", "c", "ca"}},
+		{"bz", "d", 0, []string{"c", "ca", "cb"}},
+		{"c", "c", 0, nil},
+		{"d", "a", 0, nil},
+		{"e", "", 0, nil},
+		{"", "", 3, []string{"", "a", "b"}},
+		{"c", "", 2, []string{"c", "ca"}},
+		{"a", "", -1, []string{"a", "b", "c", "ca", "cb", "d"}},
+	} {
+		checkKeys(t, "Scan", s.Scan(tc.start, tc.end, tc.limit), tc.want...)
+	}
+}
+
+func TestPrefixScan(t *testing.T) {
+	s := storeWith(t, "user:a", "user:b", "user", "user;", "use", "users:a", "role:a", "a\xff", "a\xff\xff", "b")
+	checkKeys(t, "user:", s.PrefixScan("user:", 0), "user:a", "user:b")
+	checkKeys(t, "user", s.PrefixScan("user", 0), "user", "user:a", "user:b", "user;", "users:a")
+	checkKeys(t, "user: limited", s.PrefixScan("user:", 1), "user:a")
+	checkKeys(t, "a\\xff", s.PrefixScan("a\xff", 0), "a\xff", "a\xff\xff")
+	checkKeys(t, "missing", s.PrefixScan("x", 0))
+	if rows := s.PrefixScan("", 0); len(rows) != 10 {
+		t.Fatalf("empty prefix got %d rows, want all 10", len(rows))
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	for prefix, want := range map[string]string{
+		"":           "",
+		"a":          "b",
+		"user:":      "user;",
+		"a\xff":      "b",
+		"ab\xff\xff": "ac",
+		"\xff":       "",
+		"\xff\xff":   "",
+		"a\xfe":      "a\xff",
+		"\x00":       "\x01",
+	} {
+		if got := PrefixEnd(prefix); got != want {
+			t.Errorf("PrefixEnd(%q) = %q, want %q", prefix, got, want)
+		}
+	}
+}
+
+func TestScanDeleteReinsert(t *testing.T) {
+	s := storeWith(t, "a", "b", "c")
+	_, err := s.Delete("b")
+	mustOK(t, err)
+	checkKeys(t, "after delete", s.Scan("", "", 0), "a", "c")
+	if _, err := s.Delete("b"); err != ErrKeyNotFound {
+		t.Fatalf("second delete got %v, want ErrKeyNotFound", err)
+	}
+
+	_, err = s.Create("b", "again")
+	mustOK(t, err)
+	rows := s.Scan("b", "c", 0)
+	checkKeys(t, "after reinsert", rows, "b")
+	if rows[0].Value != "again" || rows[0].Version != 4 {
+		t.Fatalf("reinserted row is %+v, want value again with version 4", rows[0])
+	}
+	if s.index.length != 3 {
+		t.Fatalf("index holds %d keys, want 3", s.index.length)
+	}
+
+	// Expired rows are skipped, and don't count towards the limit
+	_, err = s.CreateWithExpiry("a", "old", time.Now().Add(-time.Second))
+	mustOK(t, err)
+	checkKeys(t, "with an expired row", s.Scan("", "", 1), "b")
+	rows, revision := s.Dump()
+	checkKeys(t, "Dump", rows, "b", "c")
+	if revision != 5 {
+		t.Fatalf("Dump revision %d, want 5", revision)
+	}
+}
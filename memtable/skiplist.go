@@ -0,0 +1,104 @@
+package memtable
+
+import (
+	"math/rand"
+	"time"
+)
+
+const (
+	skipListMaxLevel = 16
+	skipListP        = 0.25
+)
+
+// skipNode is a single key in the skip list with its forward pointers.
+type skipNode struct {
+	key  string
+	next []*skipNode
+}
+
+// skipList keeps the keys of a KVStore in lexical order so they can be
+// scanned by range or prefix. It isn't safe for concurrent use; KVStore
+// guards it with its own mutex.
+type skipList struct {
+	head   *skipNode
+	level  int
+	length int
+	rnd    *rand.Rand
+}
+
+func newSkipList() *skipList {
+	return &skipList{
+		head:  &skipNode{next: make([]*skipNode, skipListMaxLevel)},
+		level: 1,
+		rnd:   rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (l *skipList) randomLevel() int {
+	level := 1
+	for level < skipListMaxLevel && l.rnd.Float64() < skipListP {
+		level++
+	}
+	return level
+}
+
+// findPrev fills update with the rightmost node at each level whose key is
+// lower than key and returns the first node at level 0 that is >= key.
+func (l *skipList) findPrev(key string, update []*skipNode) *skipNode {
+	x := l.head
+	for i := l.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && x.next[i].key < key {
+			x = x.next[i]
+		}
+		if update != nil {
+			update[i] = x
+		}
+	}
+	return x.next[0]
+}
+
+// insert adds key to the list. Inserting an existing key is a no-op.
+func (l *skipList) insert(key string) {
+	update := make([]*skipNode, skipListMaxLevel)
+	if n := l.findPrev(key, update); n != nil && n.key == key {
+		return
+	}
+	level := l.randomLevel()
+	if level > l.level {
+		for i := l.level; i < level; i++ {
+			update[i] = l.head
+		}
+		l.level = level
+	}
+	n := &skipNode{key: key, next: make([]*skipNode, level)}
+	for i := 0; i < level; i++ {
+		n.next[i] = update[i].next[i]
+		update[i].next[i] = n
+	}
+	l.length++
+}
+
+// remove deletes key from the list and reports whether it was present.
+func (l *skipList) remove(key string) bool {
+	update := make([]*skipNode, skipListMaxLevel)
+	n := l.findPrev(key, update)
+	if n == nil || n.key != key {
+		return false
+	}
+	for i := 0; i < l.level; i++ {
+		if update[i].next[i] != n {
+			break
+		}
+		update[i].next[i] = n.next[i]
+	}
+	for l.level > 1 && l.head.next[l.level-1] == nil {
+		l.level--
+	}
+	l.length--
+	return true
+}
+
+// seek returns the first node whose key is >= key, or nil.
+func (l *skipList) seek(key string) *skipNode {
+	return l.findPrev(key, nil)
+}
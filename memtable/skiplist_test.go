@@ -0,0 +1,113 @@
+package memtable
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// listKeys returns the keys of l in list order, checking that every level
+// is ordered and only skips over keys of the level below.
+func listKeys(t *testing.T, l *skipList) []string {
+	t.Helper()
+	var keys []string
+	for n := l.head.next[0]; n != nil; n = n.next[0] {
+		keys = append(keys, n.key)
+	}
+	for i := 1; i < l.level; i++ {
+		below := map[string]bool{}
+		for n := l.head.next[i-1]; n != nil; n = n.next[i-1] {
+			below[n.key] = true
+		}
+		prev := ""
+		for n := l.head.next[i]; n != nil; n = n.next[i] {
+			if !below[n.key] || (prev != "" && n.key <= prev) {
+				t.Fatalf("level %d out of order at %q", i, n.key)
+			}
+			prev = n.key
+		}
+	}
+	if len(keys) != l.length {
+		t.Fatalf("list holds %d keys, length says %d", len(keys), l.length)
+	}
+	return keys
+}
+
+func TestSkipListOrder(t *testing.T) {
+	l := newSkipList()
+	l.rnd = rand.New(rand.NewSource(1))
+	want := map[string]bool{}
+	for _, i := range rand.New(rand.NewSource(2)).Perm(1000) {
+		key := fmt.Sprintf("key%04d", i%700)
+		l.insert(key)
+		want[key] = true
+	}
+	sorted := make([]string, 0, len(want))
+	for key := range want {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+	if got := listKeys(t, l); fmt.Sprint(got) != fmt.Sprint(sorted) {
+		t.Fatalf("list holds %d keys out of order or duplicated, want %d sorted", len(got), len(sorted))
+	}
+	if l.level < 2 {
+		t.Fatalf("1000 inserts used %d levels", l.level)
+	}
+}
+
+func TestSkipListSeek(t *testing.T) {
+	l := newSkipList()
+	for _, key := range []string{"b", "d", "a", "", "c\x00", "c"} {
+		l.insert(key)
+	}
+	for seek, want := range map[string]string{
+		"":      "",
+		"\x00":  "a",
+		"b":     "b",
+		"bb":    "c",
+		"c":     "c",
+		"c\x00": "c\x00",
+		"c\x01": "d",
+	} {
+		if n := l.seek(seek); n == nil || n.key != want {
+			t.Errorf("seek(%q) got %v, want %q", seek, n, want)
+		}
+	}
+	if n := l.seek("e"); n != nil {
+		t.Errorf("seek past the last key got %q", n.key)
+	}
+}
+
+func TestSkipListRemove(t *testing.T) {
+	l := newSkipList()
+	for i := 0; i < 100; i++ {
+		l.insert(fmt.Sprintf("%02d", i))
+	}
+	for i := 0; i < 100; i += 2 {
+		if !l.remove(fmt.Sprintf("%02d", i)) {
+			t.Fatalf("remove of %02d found nothing", i)
+		}
+	}
+	if l.remove("00") || l.remove("missing") {
+		t.Fatal("remove of a key not in the list reported it removed")
+	}
+	keys := listKeys(t, l)
+	if len(keys) != 50 || keys[0] != "01" || keys[49] != "99" {
+		t.Fatalf("after removing the even keys the list holds %v", keys)
+	}
+
+	// Removed keys can be inserted again, once
+	l.insert("00")
+	l.insert("00")
+	if keys := listKeys(t, l); keys[0] != "00" || keys[1] != "01" || len(keys) != 51 {
+		t.Fatalf("after reinserting 00 the list starts %v", keys[:2])
+	}
+
+	for _, key := range listKeys(t, l) {
+		l.remove(key)
+	}
+	if l.level != 1 || l.length != 0 || l.seek("") != nil {
+		t.Fatalf("emptied list has level %d and length %d", l.level, l.length)
+	}
+}
@@ -0,0 +1,102 @@
+package memtable
+
+import "time"
+
+// Condition guards a write. The zero Condition always holds.
+type Condition struct {
+	// IfNotExists requires the key to be absent or expired.
+	IfNotExists bool
+	// IfVersion, when non-zero, requires the key's current version to match.
+	IfVersion int64
+}
+
+// Tx stages reads and writes against a locked KVStore. It is only valid
+// inside the function passed to KVStore.Txn.
+type Tx struct {
+	s        *KVStore
+	now      time.Time
+	writes   map[string]*KVRow // staged rows, nil marks a delete
+	order    []string
+	revision int64
+}
+
+// Txn runs fn with the store locked. Writes staged through tx are applied
+// when fn returns nil and dropped otherwise, so fn can check conditions and
+// log the writes before anything becomes visible.
+func (s *KVStore) Txn(fn func(tx *Tx) error) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	tx := &Tx{s: s, now: time.Now(), writes: make(map[string]*KVRow), revision: s.revision}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	tx.commit()
+	return nil
+}
+
+// Get returns the live row for key, including writes staged earlier in tx.
+func (tx *Tx) Get(key string) (KVRow, bool) {
+	if row, staged := tx.writes[key]; staged {
+		if row == nil {
+			return KVRow{}, false
+		}
+		return *row, true
+	}
+	return tx.s.get(key, tx.now)
+}
+
+// Check returns ErrKeyExists, ErrKeyNotFound or ErrVersionMismatch when cond
+// doesn't hold for key.
+func (tx *Tx) Check(key string, cond Condition) error {
+	row, ok := tx.Get(key)
+	if cond.IfNotExists && ok {
+		return ErrKeyExists
+	}
+	if cond.IfVersion != 0 {
+		if !ok {
+			return ErrKeyNotFound
+		}
+		if row.Version != cond.IfVersion {
+			return ErrVersionMismatch
+		}
+	}
+	return nil
+}
+
+// Put stages key with a new version and returns the staged row.
+func (tx *Tx) Put(key, value string, expiresAt time.Time) KVRow {
+	tx.revision++
+	row := newKVRow(key, value, expiresAt, tx.revision)
+	tx.stage(key, &row)
+	return row
+}
+
+// Delete stages the removal of key and reports whether it was live.
+func (tx *Tx) Delete(key string) bool {
+	if _, ok := tx.Get(key); !ok {
+		return false
+	}
+	tx.stage(key, nil)
+	return true
+}
+
+func (tx *Tx) stage(key string, row *KVRow) {
+	if _, staged := tx.writes[key]; !staged {
+		tx.order = append(tx.order, key)
+	}
+	tx.writes[key] = row
+}
+
+func (tx *Tx) commit() {
+	for _, key := range tx.order {
+		if row := tx.writes[key]; row != nil {
+			tx.s.data[key] = *row
+			tx.s.index.insert(key)
+			tx.s.trackExpiry(*row)
+		} else {
+			delete(tx.s.data, key)
+			tx.s.index.remove(key)
+		}
+	}
+	tx.s.revision = tx.revision
+}
@@ -7,11 +7,13 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/rickcollette/primodb/client"
 	"github.com/rickcollette/primodb/clientconfig"
+	pb "github.com/rickcollette/primodb/primodb/primodproto"
 )
 
 const (
@@ -29,13 +31,19 @@ type commands struct {
 	DELETE string
 	DEL    string
 	ID     string
+	USERS      string
+	CREATEUSER string
+	DELUSER    string
+	PASSWD     string
+	GRANT      string
+	REVOKE     string
 }
 
 
 // CommandEnum enum of supported commands
 var (
 	dbClient *client.PrimoDBClient
-	CommandEnum = commands{"READ", "CREATE", "UPDATE", "DELETE", "DEL", "ID"}
+	CommandEnum = commands{"READ", "CREATE", "UPDATE", "DELETE", "DEL", "ID", "USERS", "CREATEUSER", "DELUSER", "PASSWD", "GRANT", "REVOKE"}
 	// ErrKeyNotFound raise when no value found for a given key
 	ErrKeyNotFound = errors.New("error: Key not found")
 	// ErrInvalidCommand raised when command passed from CLI
@@ -101,6 +109,78 @@ func processedCmd(input string) (string, string, string, error) {
 	return cmd, key, value, err
 }
 
+// userCommand runs the user management commands, which take a different
+// number of arguments than the key commands, and reports whether input was
+// one of them.
+func userCommand(input string) (string, bool, error) {
+	fields := strings.Fields(input)
+	if len(fields) == 0 {
+		return "", false, nil
+	}
+	args := fields[1:]
+	switch strings.ToUpper(fields[0]) {
+	case CommandEnum.USERS:
+		if len(args) != 0 {
+			return "", true, ErrInvalidNoOfArguments
+		}
+		users, err := dbClient.ListUsers()
+		return formatUsers(users), true, err
+	case CommandEnum.CREATEUSER:
+		if len(args) != 2 {
+			return "", true, ErrInvalidNoOfArguments
+		}
+		result, err := dbClient.CreateUser(args[0], args[1])
+		return result, true, err
+	case CommandEnum.DELUSER:
+		if len(args) != 1 {
+			return "", true, ErrInvalidNoOfArguments
+		}
+		result, err := dbClient.DeleteUser(args[0])
+		return result, true, err
+	case CommandEnum.PASSWD:
+		if len(args) != 3 {
+			return "", true, ErrInvalidNoOfArguments
+		}
+		result, err := dbClient.ChangePassword(args[0], args[1], args[2])
+		return result, true, err
+	case CommandEnum.GRANT:
+		// Without a database, the role is on the default one
+		if len(args) != 2 && len(args) != 3 {
+			return "", true, ErrInvalidNoOfArguments
+		}
+		result, err := dbClient.GrantRole(args[0], optionalArg(args, 2), args[1])
+		return result, true, err
+	case CommandEnum.REVOKE:
+		if len(args) != 1 && len(args) != 2 {
+			return "", true, ErrInvalidNoOfArguments
+		}
+		result, err := dbClient.RevokeRole(args[0], optionalArg(args, 1))
+		return result, true, err
+	}
+	return "", false, nil
+}
+
+func optionalArg(args []string, i int) string {
+	if i < len(args) {
+		return args[i]
+	}
+	return ""
+}
+
+// formatUsers prints a user per line with its roles, as database=role.
+func formatUsers(users []*pb.UserInfo) string {
+	lines := make([]string, 0, len(users))
+	for _, user := range users {
+		grants := make([]string, 0, len(user.Roles))
+		for _, grant := range user.Roles {
+			grants = append(grants, fmt.Sprintf("%q=%s", grant.Database, grant.Role))
+		}
+		sort.Strings(grants)
+		lines = append(lines, strings.TrimSpace(user.Username+" "+strings.Join(grants, " ")))
+	}
+	return strings.Join(lines, "\n")
+}
+
 func cli(host string, port int, dbname string, timeout int) {
     var result string
     log.SetFlags(0)
@@ -120,6 +200,15 @@ func cli(host string, port int, dbname string, timeout int) {
             log.Fatal(err)
         }
 
+        if result, ok, err := userCommand(input); ok {
+            if err != nil {
+                log.Println(err)
+            } else if result != "" {
+                fmt.Println(result)
+            }
+            continue
+        }
+
         cmd, key, value, err := processedCmd(input)
         if err != nil {
             log.Println(err)
@@ -182,6 +271,12 @@ func printHelp() {
 	fmt.Println("  DELETE <key>          - Delete the value for the given key.")
 	fmt.Println("  DEL <key>             - Alias for DELETE.")
 	fmt.Println("  ID                    - Retrieve the client ID.")
+	fmt.Println("  USERS                 - List the users.")
+	fmt.Println("  CREATEUSER <user> <password> - Create a user.")
+	fmt.Println("  DELUSER <user>        - Delete a user.")
+	fmt.Println("  PASSWD <user> <old> <new> - Change a user's password.")
+	fmt.Println("  GRANT <user> <role> [database] - Grant admin, readwrite or readonly on a database, * for all.")
+	fmt.Println("  REVOKE <user> [database] - Revoke the role on a database.")
 	fmt.Println("  .version 			 - Display the version of PrimoDB.")
 	fmt.Println("  .quit, .exit, .q      - Exit the CLI.")
 	fmt.Println("  .help                 - Display this help message.")
@@ -189,7 +284,7 @@ func printHelp() {
 func main() {
     flag.StringVar(&host, "host", "localhost", "host")
     flag.IntVar(&port, "port", 9969, "port")
-    flag.StringVar(&dbname, "dbname", "primodb", "dbname")
+    flag.StringVar(&dbname, "dbname", "", "database to use, the server's default one if empty")
     flag.IntVar(&timeout, "timeout", 5, "timeout")
     flag.StringVar(&username, "username", "", "username")
     flag.StringVar(&password, "password", "", "password")
@@ -204,7 +299,8 @@ func main() {
     fmt.Printf("Loaded client configuration: %+v\n", clientConfig)
 
     // Initialize dbClient with the loaded configuration
-    dbClient, err := client.NewClient(host, port, dbname, time.Duration(timeout)*time.Second, clientConfig, username, password)
+    var err error
+    dbClient, err = client.NewClient(host, port, dbname, time.Duration(timeout)*time.Second, clientConfig, username, password)
     if err != nil {
         fmt.Println("Error initializing dbClient:", err)
         return
@@ -220,6 +316,12 @@ func main() {
         CommandEnum.DELETE: dbClient.Delete,
         CommandEnum.DEL:    dbClient.Delete,
         CommandEnum.ID:     dbClient.GetID,
+        CommandEnum.USERS:      dbClient.ListUsers,
+        CommandEnum.CREATEUSER: dbClient.CreateUser,
+        CommandEnum.DELUSER:    dbClient.DeleteUser,
+        CommandEnum.PASSWD:     dbClient.ChangePassword,
+        CommandEnum.GRANT:      dbClient.GrantRole,
+        CommandEnum.REVOKE:     dbClient.RevokeRole,
     }
 
     cli(host, port, dbname, timeout)
@@ -5,47 +5,69 @@ import (
 	"errors"
 	"time"
 
-	"github.com/rickcollette/primodb/memtable"
 	pb "github.com/rickcollette/primodb/primodb/primodproto"
 
-	jwt "github.com/dgrijalva/jwt-go"
-	"golang.org/x/crypto/bcrypt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
-var SecretKey = []byte("your_secret_key")
 
+// StoreUserCredentials creates a user with a bcrypt hash of password.
 func (s *server) StoreUserCredentials(ctx context.Context, username, password string) error {
-    hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-    if err != nil {
-        return err // or handle error appropriately
-    }
-
-    // Access the 'users' database and store the hashed password
-    db := s.db.dbStore.GetDatabase("users") // Access 'users' database
-    _, err = db.Create("user:"+username, string(hashedPassword))
-    return err
+    return s.db.CreateUser(username, password)
 }
 
+// Authenticate logs a user in with a password, or without one over mutual
+// TLS as the user named by the common name of the client certificate.
 func (s *server) Authenticate(ctx context.Context, req *pb.AuthRequest) (*pb.AuthResponse, error) {
-    // Retrieve hashed password from the 'users' database
-    hashedPassword, err := s.db.dbStore.GetDatabase("users").Read("user:" + req.Username)
-    if err != nil {
-        // Handle error (e.g., user not found)
-        if err == memtable.ErrKeyNotFound {
-            // Return a generic error message rather than a specific 'user not found' to avoid user enumeration attacks
-            return &pb.AuthResponse{Authenticated: false}, errors.New("authentication failed")
-        }
-        return &pb.AuthResponse{Authenticated: false}, err
+    if req.Password == "" {
+        return s.authenticateCert(ctx, req.Username)
     }
 
     // Compare the provided password with the stored hashed password
-    err = bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(req.Password))
+    ok, err := s.db.CheckPassword(req.Username, req.Password)
     if err != nil {
-        // Passwords do not match
-        return &pb.AuthResponse{Authenticated: false}, errors.New("authentication failed")
+        return &pb.AuthResponse{Authenticated: false}, err
+    }
+    if !ok {
+        // Return a generic error message rather than a specific 'user not found' to avoid user enumeration attacks
+        return &pb.AuthResponse{Authenticated: false}, status.Error(codes.Unauthenticated, "authentication failed")
     }
 
     // Authentication successful, generate a secure token
-    token, err := generateSecureToken()
+    return issueToken(req.Username, s.db.RolesOf(req.Username))
+}
+
+// authenticateCert logs in the user named by the client certificate. A
+// username, if given, must match it.
+func (s *server) authenticateCert(ctx context.Context, username string) (*pb.AuthResponse, error) {
+    name, ok := certUsername(ctx)
+    if !ok || (username != "" && username != name) {
+        return &pb.AuthResponse{Authenticated: false}, status.Error(codes.Unauthenticated, "authentication failed")
+    }
+    if _, err := s.db.Read(usersDatabase, userKeyPrefix+name); err != nil {
+        return &pb.AuthResponse{Authenticated: false}, status.Error(codes.Unauthenticated, "authentication failed")
+    }
+    return issueToken(name, s.db.RolesOf(name))
+}
+
+// RefreshToken issues the caller a new token, for a token that hasn't
+// expired yet. The new token is signed with the current signing key and
+// carries the user's current roles, so refreshing is how clients pick up
+// key rotations and role changes. Deleted users can't refresh.
+func (s *server) RefreshToken(ctx context.Context, req *pb.RefreshTokenRequest) (*pb.AuthResponse, error) {
+    caller := CallerFromContext(ctx)
+    if caller == nil {
+        return nil, status.Error(codes.Unauthenticated, ErrMissingToken.Error())
+    }
+    if _, err := s.db.Read(usersDatabase, userKeyPrefix+caller.Username); err != nil {
+        return nil, status.Error(codes.Unauthenticated, ErrUserNotFound.Error())
+    }
+    return issueToken(caller.Username, s.db.RolesOf(caller.Username))
+}
+
+// issueToken returns the response carrying a new token for username.
+func issueToken(username string, roles Roles) (*pb.AuthResponse, error) {
+    token, expiresAt, err := generateSecureToken(username, roles)
     if err != nil {
         // Handle token generation error
         return &pb.AuthResponse{Authenticated: false}, errors.New("failed to generate token")
@@ -55,21 +77,13 @@ func (s *server) Authenticate(ctx context.Context, req *pb.AuthRequest) (*pb.Aut
     return &pb.AuthResponse{
         Authenticated: true,
         Token:         token,
+        ExpiresAt:     expiresAt.Unix(),
     }, nil
 }
 
-func generateSecureToken() (string, error) {
-    // Create a new token object, specifying signing method and the claims
-    token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-        "exp": time.Now().Add(time.Hour * 24).Unix(), // Token expiration set to 24 hours
-        // You can add more claims if needed
-    })
-
-    // Sign and get the complete encoded token as a string
-    tokenString, err := token.SignedString(SecretKey)
-    if err != nil {
-        return "", err
-    }
-
-    return tokenString, nil
+// generateSecureToken issues a token naming the user and the roles it has
+// now, signed with the current signing key; changes to its roles apply to
+// the tokens issued after them.
+func generateSecureToken(username string, roles Roles) (string, time.Time, error) {
+    return tokenKeys.Load().issue(username, roles)
 }
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"log"
+	"path/filepath"
+	"time"
+
+	"github.com/rickcollette/primodb/snapshot"
+	"github.com/rickcollette/primodb/wal"
+)
+
+// snapshotsToKeep is how many snapshots are retained. The WAL is only pruned
+// up to the oldest of them, so recovery can fall back to it if the newest
+// turns out to be corrupted.
+const snapshotsToKeep = 2
+
+// Checkpoint writes a snapshot of every database tagged with the last WAL
+// sequence it covers, then removes the snapshots and WAL segments it makes
+// redundant. It returns the snapshot's sequence and path.
+//
+// Writes keep going while the snapshot is taken. Every record up to the
+// tagged sequence is already in the memtable when a database is copied, and
+// the later records that may also be in the copy restore rows by version, so
+// replaying them on top of the snapshot is harmless. The snapshot records the
+// last sequence it may hold, so point-in-time recovery only uses it for
+// targets after that. Under group commit those records may not be durable
+// yet, so the snapshot is only put in place once the WAL has synced them.
+func (s *Server) Checkpoint() (int64, string, error) {
+	s.checkpointMu.Lock()
+	defer s.checkpointMu.Unlock()
+
+	s.sinceCheckpoint.Store(0)
+	codec, err := s.snapshotCodec()
+	if err != nil {
+		return 0, "", err
+	}
+	seq := s.walObj.LastSeq()
+	path, err := snapshot.Write(s.walConfig.Datadir, seq, s.dbStore, s.walObj.LastSeq, s.walObj.Sync, codec)
+	if err != nil {
+		return 0, "", err
+	}
+	if s.archive != nil {
+		// Lets a restore from the archive start from the snapshot
+		if err := s.archive.Put(filepath.Base(path), path); err != nil {
+			log.Printf("Failed to archive snapshot %s: %s", filepath.Base(path), err)
+		}
+	}
+	oldest, err := snapshot.Prune(s.walConfig.Datadir, snapshotsToKeep)
+	if err != nil {
+		return seq, path, err
+	}
+	removed, err := s.walObj.Prune(oldest)
+	if err != nil {
+		return seq, path, err
+	}
+	log.Printf("Checkpoint at seq %d written to %s, %d WAL segments removed", seq, filepath.Base(path), len(removed))
+	return seq, path, nil
+}
+
+// snapshotCodec returns a codec that stores snapshots compressed and
+// encrypted like the WAL, so the data is no less protected in them.
+func (s *Server) snapshotCodec() (*wal.Codec, error) {
+	compression, err := wal.ParseCompression(s.walConfig.Compression)
+	if err != nil {
+		return nil, err
+	}
+	return wal.NewCodec(compression, s.walKey)
+}
+
+// requestCheckpoint asks the checkpointer for a checkpoint without blocking.
+func (s *Server) requestCheckpoint() {
+	select {
+	case s.checkpointCh <- struct{}{}:
+	default:
+	}
+}
+
+// StartCheckpointer writes a checkpoint every interval and whenever
+// walConfig.CheckpointRecords records were logged since the last one.
+// An interval <= 0 disables timed checkpoints.
+func (s *Server) StartCheckpointer(interval time.Duration) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		var tick <-chan time.Time
+		if interval > 0 {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+		for {
+			select {
+			case <-done:
+				return
+			case <-tick:
+			case <-s.checkpointCh:
+			}
+			if _, _, err := s.Checkpoint(); err != nil {
+				log.Printf("Checkpoint failed: %s", err)
+			}
+		}
+	}()
+	s.stopCheckpointer = func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// StopCheckpointer stops the checkpointer started by StartCheckpointer
+func (s *Server) StopCheckpointer() {
+	if s.stopCheckpointer != nil {
+		s.stopCheckpointer()
+	}
+}
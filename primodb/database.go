@@ -1,19 +1,25 @@
 package server
 
 import (
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
+	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/rickcollette/primodb/serverconfig"
 	"github.com/rickcollette/primodb/memtable"
 	"github.com/rickcollette/primodb/primodb/primodproto"
+	"github.com/rickcollette/primodb/snapshot"
 	"github.com/rickcollette/primodb/wal"
+	"google.golang.org/grpc"
 	"google.golang.org/protobuf/proto"
 )
 
@@ -25,23 +31,47 @@ const (
 )
 
 type Server struct {
-	dbStore      *memtable.DatabaseStore
-	mu           sync.Mutex
-	mode         Mode
-	rWalObj      *wal.Wal
-	walObj       *wal.Wal
-	useS3        bool
-	s3Config     serverconfig.S3Config
-	s3Uploader   *s3manager.Uploader
-	s3Downloader *s3manager.Downloader
-	s3Session    *session.Session
-}
-
-func NewServer(walDir string, useS3 bool, s3Config serverconfig.S3Config) *Server {
+	dbStore     *memtable.DatabaseStore
+	mu          sync.Mutex
+	mode        Mode
+	rWalObj     *wal.Wal
+	walObj      *wal.Wal
+	walConfig   serverconfig.WalConfig
+	walKey      []byte // encrypts WAL records, nil for none
+	dirLock     *wal.DirLock
+	archive     wal.ArchiveBackend
+	stopSweeper func()
+	watchers    *watchHub
+	// walFailed is called when a write fails to reach the WAL after it was
+	// applied to the memtable, see awaitCommit. It stops the process.
+	walFailed func(error)
+
+	checkpointMu     sync.Mutex
+	checkpointCh     chan struct{}
+	sinceCheckpoint  atomic.Int64 // records logged since the last checkpoint
+	stopCheckpointer func()
+
+	lifecycleMu  sync.Mutex
+	grpcServer   *grpc.Server // set by Serve
+	tlsCerts     *tlsReloader // set by Serve when TLS is configured
+	closing      bool
+	shutdownOnce sync.Once
+	shutdownErr  error
+}
+
+func NewServer(walConfig serverconfig.WalConfig) *Server {
+	return NewServerUntil(walConfig, RecoveryTarget{})
+}
+
+// NewServerUntil is NewServer with recovery stopped at target. Whatever was
+// logged after the target is set aside, and new writes continue from there.
+func NewServerUntil(walConfig serverconfig.WalConfig, target RecoveryTarget) *Server {
+	walDir := walConfig.Datadir
 	server := &Server{
-		dbStore:  memtable.NewDatabaseStore(),
-		useS3:    useS3,
-		s3Config: s3Config,
+		dbStore:      memtable.NewDatabaseStore(),
+		walConfig:    walConfig,
+		checkpointCh: make(chan struct{}, 1),
+		walFailed:    stopOnWALFailure,
 	}
 
 	server.mu.Lock()
@@ -51,137 +81,622 @@ func NewServer(walDir string, useS3 bool, s3Config serverconfig.S3Config) *Serve
 
 	// WAL setup
 	var err error
-	if useS3 {
-		// Initialize AWS session and S3 uploader/downloader
-		server.s3Config = s3Config
-		server.s3Session, err = session.NewSession(&aws.Config{
-			Region:      aws.String(s3Config.Region),
-			Credentials: credentials.NewStaticCredentials(s3Config.AccessKey, s3Config.SecretKey, ""),
-		})
+	// Only one process may write to the data directory
+	if err := os.MkdirAll(walDir, 0755); err != nil {
+		log.Fatalf("Failed to create data directory: %s", err)
+	}
+	server.dirLock, err = wal.LockDir(walDir)
+	if err != nil {
+		log.Fatalf("Failed to lock data directory: %s", err)
+	}
+	server.walKey, err = LoadEncryptionKey(walConfig)
+	if err != nil {
+		log.Fatalf("Failed to load WAL encryption key: %s", err)
+	}
+	server.archive, err = openArchive(walConfig)
+	if err != nil {
+		log.Fatalf("Failed to open WAL archive: %s", err)
+	}
+	if server.archive != nil {
+		// A fresh node rebuilds its data directory from the archive
+		empty, err := dataDirEmpty(walDir)
 		if err != nil {
-			log.Fatalf("Failed to create AWS session: %s", err)
+			log.Fatalf("Failed to read data directory: %s", err)
+		}
+		if empty {
+			if err := restoreFromArchive(server.archive, walDir, server.walKey, target); err != nil {
+				log.Fatalf("Restore from archive failed: %s", err)
+			}
 		}
-		server.s3Uploader = s3manager.NewUploader(server.s3Session)
-		server.s3Downloader = s3manager.NewDownloader(server.s3Session)
 	}
 
-	server.walObj, err = wal.New(walDir, useS3, s3Config, server.s3Session)
+	// Database recovery: load the newest snapshot, then replay the WAL
+	// records after it
+	server.setMode(RecoveryMode)
+	var match func(snapshot.Info) bool
+	if !target.IsZero() {
+		log.Printf("Recovering until %s", target)
+		match = target.allowsSnapshot
+	}
+	snapSeq, err := snapshot.LoadLatestMatching(walDir, server.dbStore, server.walKey, match)
+	if err != nil && err != snapshot.ErrSnapshotNotFound && !os.IsNotExist(err) {
+		log.Fatalf("Failed to load snapshot: %s", err)
+	}
+	if err == nil {
+		log.Printf("Loaded snapshot at seq %d", snapSeq)
+	}
+	lastSeq, stopped, err := server.recoverFromWAL(walDir, snapSeq, target)
 	if err != nil {
-		log.Fatalf("Failed to initialize WAL: %s", err)
+		log.Fatalf("Recovery failed: %s", err)
+	}
+	if stopped || !target.IsZero() {
+		// Snapshots past the target may exist even if the WAL ended first
+		if err := server.discardAfter(walDir, lastSeq); err != nil {
+			log.Fatalf("Failed to discard WAL after seq %d: %s", lastSeq, err)
+		}
 	}
 
-	// Database recovery
-	server.setMode(RecoveryMode)
-	if err := server.recoverFromWAL(walDir); err != nil {
-		log.Fatalf("Recovery failed: %s", err)
+	// New records continue the sequence after the last recovered one
+	opts, err := server.walOptions(lastSeq)
+	if err != nil {
+		log.Fatalf("Invalid WAL config: %s", err)
+	}
+	server.walObj, err = wal.New(walDir, opts)
+	if err != nil {
+		log.Fatalf("Failed to initialize WAL: %s", err)
+	}
+	if snapSeq > 0 {
+		// Segments from before the oldest kept snapshot are never replayed
+		oldest, err := snapshot.Prune(walDir, snapshotsToKeep)
+		if err == nil {
+			_, err = server.walObj.Prune(oldest)
+		}
+		if err != nil {
+			log.Printf("Failed to remove old WAL segments: %s", err)
+		}
 	}
 	server.setMode(ActiveMode)
+	server.watchers = newWatchHub(server.walObj.LastSeq() + 1)
 
 	log.Println("Server initialization finished")
 	return server
 }
+func (s *Server) walOptions(lastSeq int64) (wal.Options, error) {
+	syncPolicy, err := wal.ParseSyncPolicy(s.walConfig.Sync)
+	if err != nil {
+		return wal.Options{}, err
+	}
+	compression, err := wal.ParseCompression(s.walConfig.Compression)
+	if err != nil {
+		return wal.Options{}, err
+	}
+	return wal.Options{
+		SegmentMaxBytes:   s.walConfig.SegmentMaxBytes,
+		SegmentMaxRecords: s.walConfig.SegmentMaxRecords,
+		LastSeq:           lastSeq,
+		Sync:              syncPolicy,
+		SyncInterval:      s.walConfig.SyncInterval * time.Millisecond,
+		Archive:           s.archive,
+		Compression:       compression,
+		EncryptionKey:     s.walKey,
+	}, nil
+}
+
+// LoadEncryptionKey returns the hex encoded AES key set by
+// walConfig.EncryptionKey or read from walConfig.EncryptionKeyFile, or nil if
+// neither is set.
+func LoadEncryptionKey(walConfig serverconfig.WalConfig) ([]byte, error) {
+	encoded := walConfig.EncryptionKey
+	if walConfig.EncryptionKeyFile != "" {
+		if encoded != "" {
+			return nil, fmt.Errorf("set only one of encryptionKey and encryptionKeyFile")
+		}
+		data, err := os.ReadFile(walConfig.EncryptionKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		encoded = string(data)
+	}
+	encoded = strings.TrimSpace(encoded)
+	if encoded == "" {
+		return nil, nil
+	}
+	key, err := hex.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("key is not hex encoded: %w", err)
+	}
+	switch len(key) {
+	case 16, 24, 32:
+		return key, nil
+	}
+	return nil, fmt.Errorf("key is %d bytes, want 16, 24 or 32", len(key))
+}
+
+// openArchive returns the archive backend selected by walConfig.Archive, or
+// nil if archiving is off. The legacy useS3 flag selects the S3 backend.
+func openArchive(walConfig serverconfig.WalConfig) (wal.ArchiveBackend, error) {
+	backend := walConfig.Archive
+	if backend == "" && walConfig.UseS3 {
+		backend = "s3"
+	}
+	switch backend {
+	case "", "none":
+		return nil, nil
+	case "local":
+		if walConfig.ArchiveDir == "" {
+			return nil, fmt.Errorf("archive %q needs archiveDir", backend)
+		}
+		return wal.NewLocalArchive(walConfig.ArchiveDir)
+	case "s3":
+		s3Config := walConfig.S3Config
+		sess, err := session.NewSession(&aws.Config{
+			Region:      aws.String(s3Config.Region),
+			Credentials: credentials.NewStaticCredentials(s3Config.AccessKey, s3Config.SecretKey, ""),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create AWS session: %w", err)
+		}
+		return wal.NewS3Archive(sess, s3Config.Bucket), nil
+	}
+	return nil, fmt.Errorf("unknown archive backend %q", backend)
+}
+
 func (s *Server) setMode(mode Mode) {
 	s.mode = mode
 }
 
-func (s *Server) recoverFromWAL(walDir string) error {
-	var err error
+// recoverFromWAL replays the WAL records after snapSeq, oldest first, into
+// the DatabaseStore, stopping at target. It returns the sequence of the last
+// record replayed, or snapSeq if the WAL ends before it, and whether it
+// stopped before the end of the WAL.
+func (s *Server) recoverFromWAL(walDir string, snapSeq int64, target RecoveryTarget) (int64, bool, error) {
+	policy, err := wal.ParseRecoveryPolicy(s.walConfig.RecoveryPolicy)
+	if err != nil {
+		return 0, false, err
+	}
 	// Open the existing WAL for recovery
-	s.rWalObj, err = wal.Open(walDir)
+	s.rWalObj, err = wal.Open(walDir, policy, s.walKey)
 	if err != nil {
 		if err == wal.ErrWalNotFound {
-			return nil // No WAL found, nothing to recover
+			return snapSeq, false, nil // No WAL found, nothing to recover
 		}
-		return err
+		return 0, false, err
 	}
 	defer s.rWalObj.Close()
 
-	if s.useS3 {
-		s.walObj, err = wal.New(walDir, true, s.s3Config, s.s3Session)
-	} else {
-		s.walObj, err = wal.New(walDir, false, serverconfig.S3Config{}, nil)
-	}
-	if err != nil {
-		return err
-	}
-
-	for record := range s.rWalObj.Read() {
+	next := snapSeq + 1
+	damage, err := s.rWalObj.Read(func(record *wal.Record) error {
+		if record.Seq < next {
+			return nil // already in the snapshot
+		}
+		// Skipped records leave gaps, anything else means the WAL lost
+		// records the snapshot doesn't have.
+		if record.Seq != next && policy != wal.SkipCorrupt {
+			return fmt.Errorf("WAL resumes at seq %d but the snapshot ends at seq %d", record.Seq, snapSeq)
+		}
 		recordData := &primodproto.Record{}
 		if err := proto.Unmarshal(record.Data, recordData); err != nil {
 			return err
 		}
+		if !target.includes(record.Seq, recordData.GetTimestamp()) {
+			return errStopReplay
+		}
+		next = record.Seq + 1
+		return s.applyRecord(recordData)
+	})
+	for _, d := range damage {
+		log.Printf("WAL recovery (%s): %s", policy, d)
+	}
+	if errors.Is(err, errStopReplay) {
+		return next - 1, true, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return next - 1, false, nil
+}
 
-		dbName, key := parseDbNameAndKey(recordData.Key)
-		db := s.dbStore.GetDatabase(dbName)
-		var err error
-		switch recordData.Cmd {
-		case "CREATE":
-			_, err = db.Create(key, recordData.GetValue())
-		case "DELETE":
-			_, err = db.Delete(key)
-		case "UPDATE":
-			_, err = db.Update(key, recordData.GetValue())
-		default:
-			return fmt.Errorf("invalid command during recovery: %s", recordData.Cmd)
+// applyRecord replays a single WAL record into the DatabaseStore.
+func (s *Server) applyRecord(recordData *primodproto.Record) error {
+	if recordData.Cmd == "TXN" {
+		for _, op := range recordData.Ops {
+			if err := s.applyOp(op, op.GetDatabase(), op.GetKey()); err != nil {
+				return err
+			}
 		}
+		return nil
+	}
 
-		if err != nil {
-			return err
+	database, key := recordData.GetDatabase(), recordData.GetKey()
+	if recordData.GetTimestamp() == 0 && database == "" {
+		// Records logged before the database and timestamp were recorded
+		// only hold the key, and were replayed into the database named by
+		// the part of the key before the first ':'. Keep doing that, so
+		// old WALs recover to the same state they always did.
+		database, key = parseDbNameAndKey(key)
+	}
+	return s.applyOp(recordData, database, key)
+}
+
+// parseDbNameAndKey splits a legacy "database:key" WAL key. Keys without a
+// ':' belong to the "" database.
+func parseDbNameAndKey(combinedKey string) (string, string) {
+	parts := strings.SplitN(combinedKey, ":", 2)
+	if len(parts) != 2 {
+		return "", combinedKey
+	}
+	return parts[0], parts[1]
+}
+
+// applyOp replays a single mutation to key in database.
+func (s *Server) applyOp(recordData *primodproto.Record, database, key string) error {
+	db := s.dbStore.GetDatabase(database)
+	expiresAt := unixNanoTime(recordData.GetExpiresAt())
+	var err error
+	switch recordData.Cmd {
+	case "CREATE", "UPDATE":
+		if version := recordData.GetVersion(); version != 0 {
+			// Only writes that passed their checks are logged, so
+			// versioned records are restored as-is.
+			db.Restore(key, recordData.GetValue(), expiresAt, version)
+		} else if recordData.Cmd == "CREATE" {
+			_, err = db.CreateWithExpiry(key, recordData.GetValue(), expiresAt)
+		} else if _, err = db.UpdateWithExpiry(key, recordData.GetValue(), expiresAt); err == memtable.ErrKeyNotFound {
+			// Legacy records weren't checked against each other, so
+			// an update may follow a delete of its key.
+			err = nil
+		}
+	case "DELETE":
+		// A row that was live when deleted may have expired by now.
+		if _, err = db.Delete(key); err == memtable.ErrKeyNotFound {
+			err = nil
 		}
+	case "EXPIRE":
+		db.Expire(key, expiresAt)
+	default:
+		return fmt.Errorf("invalid command during recovery: %s", recordData.Cmd)
 	}
-	return nil
+	return err
 }
-func (s *Server) logRecord(cmd, key, value string) error {
-    record, err := proto.Marshal(&primodproto.Record{Cmd: cmd, Key: key, Value: value})
+
+// logRecord appends a single mutation to the WAL, see appendRecord.
+func (s *Server) logRecord(cmd, databaseName, key, value string, expiresAt time.Time, version int64) (int64, wal.Pending, error) {
+    return s.appendRecord(newRecord(cmd, databaseName, key, value, expiresAt, version))
+}
+
+// appendRecord appends rec to the WAL and returns its sequence number.
+// Writers append while their database is locked, so records are in the order
+// the changes were applied, and Wait on the returned Pending once it is
+// unlocked: under group commit the record is only durable after that, and
+// waiting outside the lock lets writes to the same database share an fsync.
+func (s *Server) appendRecord(rec *primodproto.Record) (int64, wal.Pending, error) {
+    // The timestamp lets recovery stop at a point in time
+    rec.Timestamp = time.Now().UnixNano()
+    record, err := proto.Marshal(rec)
     if err != nil {
-        return err
+        return 0, wal.Pending{}, err
     }
-    return s.walObj.Write(record)
+    seq, pending, err := s.walObj.Append(record)
+    if err == nil {
+        if n := s.walConfig.CheckpointRecords; n > 0 && s.sinceCheckpoint.Add(1) >= n {
+            s.requestCheckpoint()
+        }
+    }
+    return seq, pending, err
 }
 
-func parseDbNameAndKey(combinedKey string) (string, string) {
-    parts := strings.SplitN(combinedKey, ":", 2)
-    if len(parts) != 2 {
-        return "", combinedKey
+func newRecord(cmd, databaseName, key, value string, expiresAt time.Time, version int64) *primodproto.Record {
+    rec := &primodproto.Record{Cmd: cmd, Database: databaseName, Key: key, Value: value, Version: version}
+    if !expiresAt.IsZero() {
+        rec.ExpiresAt = expiresAt.UnixNano()
+    }
+    return rec
+}
+
+// unixNanoTime is the inverse of the Record.ExpiresAt encoding: 0 maps to
+// the zero Time.
+func unixNanoTime(ns int64) time.Time {
+    if ns == 0 {
+        return time.Time{}
     }
-    return parts[0], parts[1]
+    return time.Unix(0, ns)
 }
+
 func (s *Server) Create(databaseName, key, value string) (string, error) {
+	return s.CreateWithTTL(databaseName, key, value, 0)
+}
+
+// CreateWithTTL inserts a key that expires once ttl has elapsed. A ttl <= 0
+// never expires.
+func (s *Server) CreateWithTTL(databaseName, key, value string, ttl time.Duration) (string, error) {
+	if _, err := s.CreateIf(databaseName, key, value, ttl, memtable.Condition{}); err != nil {
+		return "Inserted 0", err
+	}
+	return "Inserted 1", nil
+}
+
+// CreateIf inserts or overwrites a key when cond holds and returns the new
+// row. The record is logged while the database is locked, so writes whose
+// condition fails never reach the WAL.
+func (s *Server) CreateIf(databaseName, key, value string, ttl time.Duration, cond memtable.Condition) (memtable.KVRow, error) {
 	db := s.dbStore.GetDatabase(databaseName) // Access the specific database
+	// The absolute expiry is logged so replay doesn't restart the TTL.
+	expiresAt := memtable.ExpiryFromTTL(ttl)
 
-	// Log the operation
-	if err := s.logRecord("CREATE", key, value); err != nil {
-		return "", err
+	var row memtable.KVRow
+	var logged wal.Pending
+	var staged *stagedEvents
+	err := db.Txn(func(tx *memtable.Tx) error {
+		if err := tx.Check(key, cond); err != nil {
+			return err
+		}
+		old, existed := tx.Get(key)
+		row = tx.Put(key, value, expiresAt)
+		seq, pending, err := s.logRecord("CREATE", databaseName, key, value, expiresAt, row.Version)
+		if err != nil {
+			return err
+		}
+		logged = pending
+		staged = s.watchers.stage(putEvent(seq, databaseName, old, existed, row))
+		return nil
+	})
+	if err == nil {
+		err = s.awaitCommit(logged, staged)
 	}
+	return row, err
+}
 
-	// Call Create method from memtable package
-	return db.Create(key, value)
-} // Get retrieves a value for a key from a specific database.
+// Get retrieves a value for a key from a specific database.
 func (s *Server) Read(databaseName, key string) (string, error) {
 	db := s.dbStore.GetDatabase(databaseName) // Access the specific database
 	return db.Read(key)
 }
 
+// ReadRow retrieves a key's row, including its version, from a specific database.
+func (s *Server) ReadRow(databaseName, key string) (memtable.KVRow, error) {
+	db := s.dbStore.GetDatabase(databaseName) // Access the specific database
+	return db.ReadRow(key)
+}
+
 func (s *Server) Update(databaseName, key, value string) (string, error) {
+	return s.UpdateWithTTL(databaseName, key, value, 0)
+}
+
+// UpdateWithTTL replaces a key's value and sets it to expire once ttl has
+// elapsed. A ttl <= 0 never expires.
+func (s *Server) UpdateWithTTL(databaseName, key, value string, ttl time.Duration) (string, error) {
+	if _, err := s.UpdateIf(databaseName, key, value, ttl, memtable.Condition{}); err != nil {
+		return "Updated 0", err
+	}
+	return "Updated 1", nil
+}
+
+// UpdateIf replaces an existing key's value when cond holds and returns the
+// new row.
+func (s *Server) UpdateIf(databaseName, key, value string, ttl time.Duration, cond memtable.Condition) (memtable.KVRow, error) {
 	db := s.dbStore.GetDatabase(databaseName) // Access the specific database
+	expiresAt := memtable.ExpiryFromTTL(ttl)
 
-	// Log the operation
-	if err := s.logRecord("UPDATE", key, ""); err != nil {
-		return "", err
+	var row memtable.KVRow
+	var logged wal.Pending
+	var staged *stagedEvents
+	err := db.Txn(func(tx *memtable.Tx) error {
+		if err := tx.Check(key, cond); err != nil {
+			return err
+		}
+		old, ok := tx.Get(key)
+		if !ok {
+			return memtable.ErrKeyNotFound
+		}
+		row = tx.Put(key, value, expiresAt)
+		seq, pending, err := s.logRecord("UPDATE", databaseName, key, value, expiresAt, row.Version)
+		if err != nil {
+			return err
+		}
+		logged = pending
+		staged = s.watchers.stage(putEvent(seq, databaseName, old, true, row))
+		return nil
+	})
+	if err == nil {
+		err = s.awaitCommit(logged, staged)
 	}
+	return row, err
+}
+
+// CompareAndSwap sets key to value only if its current version is
+// expectedVersion, 0 meaning the key must not exist, and returns the new row.
+func (s *Server) CompareAndSwap(databaseName, key string, expectedVersion int64, value string) (memtable.KVRow, error) {
+	db := s.dbStore.GetDatabase(databaseName) // Access the specific database
 
-	return db.Update(key, value)
+	var row memtable.KVRow
+	var logged wal.Pending
+	var staged *stagedEvents
+	err := db.Txn(func(tx *memtable.Tx) error {
+		cond := memtable.Condition{IfVersion: expectedVersion, IfNotExists: expectedVersion == 0}
+		if err := tx.Check(key, cond); err != nil {
+			return err
+		}
+		old, existed := tx.Get(key)
+		row = tx.Put(key, value, old.ExpiresAt())
+		seq, pending, err := s.logRecord("UPDATE", databaseName, key, value, row.ExpiresAt(), row.Version)
+		if err != nil {
+			return err
+		}
+		logged = pending
+		staged = s.watchers.stage(putEvent(seq, databaseName, old, existed, row))
+		return nil
+	})
+	if err == nil {
+		err = s.awaitCommit(logged, staged)
+	}
+	return row, err
 }
 
 // Del deletes a key-value pair from a specific database.
 func (s *Server) Delete(databaseName, key string) (string, error) {
+	if err := s.DeleteIf(databaseName, key, memtable.Condition{}); err != nil {
+		return "Deleted 0", err
+	}
+	return "Deleted 1", nil
+}
+
+// DeleteIf deletes an existing key when cond holds.
+func (s *Server) DeleteIf(databaseName, key string, cond memtable.Condition) error {
 	db := s.dbStore.GetDatabase(databaseName) // Access the specific database
 
-	// Log the operation
-	if err := s.logRecord("DELETE", key, ""); err != nil {
-		return "", err
+	var logged wal.Pending
+	var staged *stagedEvents
+	err := db.Txn(func(tx *memtable.Tx) error {
+		if err := tx.Check(key, cond); err != nil {
+			return err
+		}
+		old, ok := tx.Get(key)
+		if !ok {
+			return memtable.ErrKeyNotFound
+		}
+		tx.Delete(key)
+		seq, pending, err := s.logRecord("DELETE", databaseName, key, "", time.Time{}, 0)
+		if err != nil {
+			return err
+		}
+		logged = pending
+		staged = s.watchers.stage(deleteEvent(seq, databaseName, old))
+		return nil
+	})
+	if err == nil {
+		err = s.awaitCommit(logged, staged)
 	}
+	return err
+}
+
+// TxnCondition must hold on Key for a transaction to apply.
+type TxnCondition struct {
+	Key string
+	memtable.Condition
+}
+
+// TxnOp is a single put or delete in a transaction.
+type TxnOp struct {
+	Delete bool
+	Key    string
+	Value  string
+	TTL    time.Duration // puts only, <= 0 never expires
+}
 
-	return db.Delete(key)
+// Txn applies ops in order if every condition holds, and nothing otherwise.
+// The whole transaction is written to the WAL as one TXN record, so recovery
+// replays all of it or none of it. It returns the new row for each op; rows
+// for deletes are zero. Deleting a missing key is not an error.
+func (s *Server) Txn(databaseName string, conds []TxnCondition, ops []TxnOp) ([]memtable.KVRow, error) {
+	db := s.dbStore.GetDatabase(databaseName) // Access the specific database
+
+	rows := make([]memtable.KVRow, len(ops))
+	var logged wal.Pending
+	var staged *stagedEvents
+	err := db.Txn(func(tx *memtable.Tx) error {
+		for _, cond := range conds {
+			if err := tx.Check(cond.Key, cond.Condition); err != nil {
+				return fmt.Errorf("condition on %q failed: %w", cond.Key, err)
+			}
+		}
+		txnRecord := &primodproto.Record{Cmd: "TXN", Database: databaseName}
+		var events []WatchEvent
+		for i, op := range ops {
+			old, existed := tx.Get(op.Key)
+			if op.Delete {
+				if tx.Delete(op.Key) {
+					txnRecord.Ops = append(txnRecord.Ops, newRecord("DELETE", databaseName, op.Key, "", time.Time{}, 0))
+					events = append(events, deleteEvent(0, databaseName, old))
+				}
+				continue
+			}
+			expiresAt := memtable.ExpiryFromTTL(op.TTL)
+			rows[i] = tx.Put(op.Key, op.Value, expiresAt)
+			txnRecord.Ops = append(txnRecord.Ops, newRecord("CREATE", databaseName, op.Key, op.Value, expiresAt, rows[i].Version))
+			events = append(events, putEvent(0, databaseName, old, existed, rows[i]))
+		}
+		if len(txnRecord.Ops) == 0 {
+			return nil
+		}
+		seq, pending, err := s.appendRecord(txnRecord)
+		if err != nil {
+			return err
+		}
+		logged = pending
+		for i := range events {
+			events[i].Seq = seq
+		}
+		staged = s.watchers.stage(events...)
+		return nil
+	})
+	if err == nil {
+		err = s.awaitCommit(logged, staged)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+// StartExpirySweeper removes expired keys every interval. Each removal is
+// logged to the WAL as an EXPIRE record first, so recovery doesn't bring the
+// key back.
+func (s *Server) StartExpirySweeper(interval time.Duration) {
+	s.stopSweeper = s.dbStore.StartSweeper(interval, s.logExpiry)
+}
+
+// StopExpirySweeper stops the sweeper started by StartExpirySweeper
+func (s *Server) StopExpirySweeper() {
+	if s.stopSweeper != nil {
+		s.stopSweeper()
+	}
+}
+
+// logExpiry runs with the row's database locked, just before the sweeper
+// removes it. Watchers see the expiry as a DELETE. Unlike client writes it
+// waits for the record under the lock, as the sweeper only removes the row
+// once it is logged.
+func (s *Server) logExpiry(databaseName string, row memtable.KVRow) error {
+	seq, pending, err := s.logRecord("EXPIRE", databaseName, row.Key, "", row.ExpiresAt(), 0)
+	if err != nil {
+		return err
+	}
+	return s.awaitCommit(pending, s.watchers.stage(deleteEvent(seq, databaseName, row)))
+}
+
+// awaitCommit waits for a logged write to be durable, then lets watchers see
+// its staged events, which are dropped if the write failed.
+//
+// Only group commit fails here, once the write is already applied to the
+// memtable, where other writes may have built on it since. Rather than serve
+// changes the WAL doesn't have, the server stops through s.walFailed, and
+// recovery on the next start restores the state the WAL holds. The WAL
+// refuses further writes in the meantime.
+func (s *Server) awaitCommit(logged wal.Pending, staged *stagedEvents) error {
+	err := logged.Wait()
+	s.watchers.commit(staged, err)
+	if err != nil {
+		s.walFailed(err)
+	}
+	return err
+}
+
+// stopOnWALFailure is the default Server.walFailed.
+func stopOnWALFailure(err error) {
+	log.Fatalf("WAL write failed after it was applied, stopping so recovery restores what the WAL holds: %s", err)
+}
+
+// Watch streams committed changes to key, or to every key starting with
+// prefix when key is empty, in a specific database. With startSeq > 0 the
+// retained events from that WAL sequence on are delivered first; it fails
+// with ErrWatchCompacted if they are no longer available.
+func (s *Server) Watch(databaseName, key, prefix string, startSeq int64) (*Watcher, error) {
+	return s.watchers.watch(databaseName, key, prefix, startSeq)
+}
+
+// Scan returns up to limit rows with start <= key < end from a specific database.
+func (s *Server) Scan(databaseName, start, end string, limit int) []memtable.KVRow {
+	db := s.dbStore.GetDatabase(databaseName) // Access the specific database
+	return db.Scan(start, end, limit)
 }
 
@@ -0,0 +1,308 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rickcollette/primodb/memtable"
+	"github.com/rickcollette/primodb/primodb/primodproto"
+	"github.com/rickcollette/primodb/serverconfig"
+	"github.com/rickcollette/primodb/snapshot"
+	"github.com/rickcollette/primodb/wal"
+)
+
+// dumpDatabases returns every row of every database of s, formatted for
+// comparison.
+func dumpDatabases(s *Server) map[string][]string {
+	dump := map[string][]string{}
+	for _, name := range s.dbStore.Names() {
+		for _, row := range s.Scan(name, "", "", 0) {
+			dump[name] = append(dump[name], fmt.Sprintf("%s=%q v%d exp %d", row.Key, row.Value, row.Version, row.ExpiresAt().UnixNano()))
+		}
+	}
+	return dump
+}
+
+func mustOK(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeEverything runs each kind of write against s, across several
+// databases, including ones whose condition fails and so are never logged.
+func writeEverything(t *testing.T, s *Server, tag string) {
+	t.Helper()
+	for _, database := range []string{"", "users", "orders"} {
+		_, err := s.Create(database, tag+"a", "1")
+		mustOK(t, err)
+		_, err = s.Create(database, tag+"b", "1")
+		mustOK(t, err)
+		_, err = s.Update(database, tag+"a", "2")
+		mustOK(t, err)
+		_, err = s.Delete(database, tag+"b")
+		mustOK(t, err)
+		_, err = s.CreateWithTTL(database, tag+"ttl", "expires", time.Hour)
+		mustOK(t, err)
+		_, err = s.UpdateWithTTL(database, tag+"a", "3", 2*time.Hour)
+		mustOK(t, err)
+	}
+
+	row, err := s.CompareAndSwap("orders", tag+"cas", 0, "v1")
+	mustOK(t, err)
+	_, err = s.CompareAndSwap("orders", tag+"cas", row.Version, "v2")
+	mustOK(t, err)
+	if _, err := s.CompareAndSwap("orders", tag+"cas", row.Version, "stale"); err != memtable.ErrVersionMismatch {
+		t.Fatalf("stale CompareAndSwap: got %v, want %v", err, memtable.ErrVersionMismatch)
+	}
+	if _, err := s.CreateIf("", tag+"a", "exists", 0, memtable.Condition{IfNotExists: true}); err != memtable.ErrKeyExists {
+		t.Fatalf("CreateIf on an existing key: got %v, want %v", err, memtable.ErrKeyExists)
+	}
+
+	ops := []TxnOp{
+		{Key: tag + "txn1", Value: "x"},
+		{Key: tag + "txn2", Value: "y", TTL: time.Hour},
+		{Delete: true, Key: tag + "a"},
+	}
+	_, err = s.Txn("users", nil, ops)
+	mustOK(t, err)
+	conds := []TxnCondition{{Key: tag + "txn1", Condition: memtable.Condition{IfNotExists: true}}}
+	if _, err := s.Txn("users", conds, []TxnOp{{Key: tag + "txn3", Value: "z"}}); err == nil {
+		t.Fatal("Txn with a failing condition succeeded")
+	}
+}
+
+// restart shuts s down and starts a new server on the same data directory.
+func restart(t *testing.T, s *Server, cfg serverconfig.WalConfig) *Server {
+	t.Helper()
+	mustOK(t, s.Shutdown(context.Background()))
+	s = NewServer(cfg)
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+	return s
+}
+
+func checkReplayed(t *testing.T, want map[string][]string, s *Server) {
+	t.Helper()
+	got := dumpDatabases(s)
+	for name, rows := range want {
+		if fmt.Sprint(got[name]) != fmt.Sprint(rows) {
+			t.Errorf("database %q after restart:\n got  %v\n want %v", name, got[name], rows)
+		}
+	}
+	for name, rows := range got {
+		if _, ok := want[name]; !ok && len(rows) > 0 {
+			t.Errorf("database %q appeared after restart: %v", name, rows)
+		}
+	}
+}
+
+func TestReplayWAL(t *testing.T) {
+	for _, sync := range []string{"always", "group"} {
+		t.Run(sync, func(t *testing.T) {
+			cfg := serverconfig.WalConfig{Datadir: t.TempDir(), Sync: sync}
+			s := NewServer(cfg)
+			writeEverything(t, s, "")
+			want := dumpDatabases(s)
+
+			s = restart(t, s, cfg)
+			checkReplayed(t, want, s)
+
+			// Versions continue from the replayed ones
+			row, err := s.ReadRow("orders", "cas")
+			mustOK(t, err)
+			_, err = s.CompareAndSwap("orders", "cas", row.Version, "v3")
+			mustOK(t, err)
+		})
+	}
+}
+
+func TestShutdownReportsWALError(t *testing.T) {
+	cfg := serverconfig.WalConfig{Datadir: t.TempDir()}
+	s := NewServer(cfg)
+	_, err := s.Create("", "k", "v")
+	mustOK(t, err)
+	// The segment can't be finalized once its directory is gone
+	mustOK(t, os.RemoveAll(cfg.Datadir))
+	err = s.Shutdown(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "finalize") {
+		t.Fatalf("Shutdown got %v, want the error closing the WAL", err)
+	}
+}
+
+// TestReplayExpiry checks that the EXPIRE records the sweeper logs remove
+// the rows they expired on replay, but not the rows written after them.
+func TestReplayExpiry(t *testing.T) {
+	cfg := serverconfig.WalConfig{Datadir: t.TempDir()}
+	s := NewServer(cfg)
+	_, err := s.CreateWithTTL("", "gone", "v", time.Millisecond)
+	mustOK(t, err)
+	_, err = s.CreateWithTTL("", "back", "v1", time.Millisecond)
+	mustOK(t, err)
+	seq := s.walObj.LastSeq()
+	s.StartExpirySweeper(5 * time.Millisecond)
+	for deadline := time.Now().Add(5 * time.Second); s.walObj.LastSeq() < seq+2; {
+		if time.Now().After(deadline) {
+			t.Fatal("sweeper logged no expiry")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	s.StopExpirySweeper()
+	_, err = s.Create("", "back", "v2")
+	mustOK(t, err)
+	want := dumpDatabases(s)
+
+	s = restart(t, s, cfg)
+	checkReplayed(t, want, s)
+	if v, err := s.Read("", "back"); err != nil || v != "v2" {
+		t.Fatalf("key written after its expiry reads %q, %v after replay", v, err)
+	}
+}
+
+func TestReplaySnapshotAndWALTail(t *testing.T) {
+	// Small segments, so the checkpoint prunes records that are then only
+	// in the snapshot
+	cfg := serverconfig.WalConfig{Datadir: t.TempDir(), SegmentMaxRecords: 4}
+	s := NewServer(cfg)
+	writeEverything(t, s, "before-")
+	_, path, err := s.Checkpoint()
+	mustOK(t, err)
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("checkpoint wrote no snapshot: %v", err)
+	}
+	writeEverything(t, s, "after-")
+	_, err = s.Update("", "before-ttl", "changed after the checkpoint")
+	mustOK(t, err)
+	want := dumpDatabases(s)
+
+	s = restart(t, s, cfg)
+	checkReplayed(t, want, s)
+}
+
+// walSeqs returns the sequences of the records left in the WAL in dir.
+func walSeqs(t *testing.T, dir string) []int64 {
+	t.Helper()
+	w, err := wal.Open(dir, wal.Strict, nil)
+	mustOK(t, err)
+	defer w.Close()
+	var seqs []int64
+	_, err = w.Read(func(r *wal.Record) error {
+		seqs = append(seqs, r.Seq)
+		return nil
+	})
+	mustOK(t, err)
+	return seqs
+}
+
+// TestCheckpointPrunes checks that a checkpoint removes the segments the
+// oldest kept snapshot covers, and only those.
+func TestCheckpointPrunes(t *testing.T) {
+	cfg := serverconfig.WalConfig{Datadir: t.TempDir(), SegmentMaxRecords: 4}
+	s := NewServer(cfg)
+	create := func(from, to int) {
+		for i := from; i <= to; i++ {
+			_, err := s.Create("", fmt.Sprintf("key%02d", i), "v")
+			mustOK(t, err)
+		}
+	}
+	// Segments hold 1-4, 5-8, 9-12 and so on
+	create(1, 10)
+	first, _, err := s.Checkpoint()
+	mustOK(t, err)
+	create(11, 20)
+	second, _, err := s.Checkpoint()
+	mustOK(t, err)
+	if first != 10 || second != 20 {
+		t.Fatalf("checkpoints at seqs %d and %d, want 10 and 20", first, second)
+	}
+	create(21, 22)
+	want := dumpDatabases(s)
+	mustOK(t, s.Shutdown(context.Background()))
+
+	// The first snapshot is the oldest kept, so only the segments before
+	// the one holding seq 11 go
+	seqs := walSeqs(t, cfg.Datadir)
+	if len(seqs) != 14 || seqs[0] != 9 || seqs[len(seqs)-1] != 22 {
+		t.Fatalf("WAL holds seqs %v after the checkpoints, want 9 to 22", seqs)
+	}
+	snaps, err := snapshot.List(cfg.Datadir)
+	mustOK(t, err)
+	if len(snaps) != 2 || snaps[0].Seq != 10 || snaps[1].Seq != 20 {
+		t.Fatalf("data directory holds snapshots %+v, want seqs 10 and 20", snaps)
+	}
+
+	s = NewServer(cfg)
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+	checkReplayed(t, want, s)
+
+	// Without the newest snapshot, recovery falls back to the oldest one
+	// and the segments after it
+	mustOK(t, s.Shutdown(context.Background()))
+	mustOK(t, os.Remove(snaps[1].Path))
+	s = NewServer(cfg)
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+	checkReplayed(t, want, s)
+}
+
+func TestEncryptedSnapshot(t *testing.T) {
+	// Small segments, so the checkpoint prunes records that are then only
+	// in the snapshot
+	cfg := serverconfig.WalConfig{
+		Datadir:           t.TempDir(),
+		SegmentMaxRecords: 100,
+		Compression:       "flate",
+		EncryptionKey:     strings.Repeat("ab", 32),
+		Archive:           "local",
+		ArchiveDir:        t.TempDir(),
+	}
+	s := NewServer(cfg)
+	// Enough rows for the snapshot to take several blocks
+	for i := 0; i < 2000; i++ {
+		_, err := s.Create("secrets", fmt.Sprintf("key%04d", i), fmt.Sprintf("plaintext-value-%04d-%s", i, strings.Repeat("x", 64)))
+		mustOK(t, err)
+	}
+	_, path, err := s.Checkpoint()
+	mustOK(t, err)
+	want := dumpDatabases(s)
+
+	for _, p := range []string{path, filepath.Join(cfg.ArchiveDir, filepath.Base(path))} {
+		data, err := os.ReadFile(p)
+		mustOK(t, err)
+		if bytes.Contains(data, []byte("plaintext-value")) || bytes.Contains(data, []byte("key0001")) {
+			t.Fatalf("%s holds data in plaintext", p)
+		}
+	}
+
+	s = restart(t, s, cfg)
+	checkReplayed(t, want, s)
+}
+
+// TestReplayLegacyRecords replays records logged before the database was
+// recorded, which only held the key.
+func TestReplayLegacyRecords(t *testing.T) {
+	s := NewServer(serverconfig.WalConfig{Datadir: t.TempDir()})
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+	for _, rec := range []*primodproto.Record{
+		{Cmd: "CREATE", Key: "plain", Value: "1"},
+		{Cmd: "CREATE", Key: "orders:a", Value: "1"},
+		{Cmd: "UPDATE", Key: "orders:a", Value: "2"},
+		{Cmd: "CREATE", Key: "orders:b:c", Value: "1"},
+		{Cmd: "DELETE", Key: "orders:gone"},
+		{Cmd: "UPDATE", Key: "orders:gone", Value: "1"},
+	} {
+		if err := s.applyRecord(rec); err != nil {
+			t.Fatalf("replaying %s %q: %v", rec.Cmd, rec.Key, err)
+		}
+	}
+	never := time.Time{}.UnixNano()
+	checkReplayed(t, map[string][]string{
+		"":       {fmt.Sprintf(`plain="1" v1 exp %d`, never)},
+		"orders": {fmt.Sprintf(`a="2" v2 exp %d`, never), fmt.Sprintf(`b:c="1" v3 exp %d`, never)},
+	}, s)
+}
@@ -0,0 +1,214 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	pb "github.com/rickcollette/primodb/primodb/primodproto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// authorizationHeader is the metadata key clients send their token in, as
+// "Bearer <token>".
+const authorizationHeader = "authorization"
+
+var (
+	// ErrMissingToken is returned for calls without a bearer token.
+	ErrMissingToken = errors.New("missing bearer token")
+	// ErrInvalidToken is returned for tokens that fail verification.
+	ErrInvalidToken = errors.New("invalid token")
+)
+
+// publicMethods can be called without a token.
+var publicMethods = map[string]bool{
+	pb.PrimoDBService_Authenticate_FullMethodName: true,
+}
+
+// databaseMethods need a role on the database their requests name.
+var databaseMethods = map[string]Role{
+	pb.PrimoDB_Read_FullMethodName:           RoleReadOnly,
+	pb.PrimoDB_Scan_FullMethodName:           RoleReadOnly,
+	pb.PrimoDB_Watch_FullMethodName:          RoleReadOnly,
+	pb.PrimoDB_Create_FullMethodName:         RoleReadWrite,
+	pb.PrimoDB_Update_FullMethodName:         RoleReadWrite,
+	pb.PrimoDB_Delete_FullMethodName:         RoleReadWrite,
+	pb.PrimoDB_CompareAndSwap_FullMethodName: RoleReadWrite,
+	pb.PrimoDB_Txn_FullMethodName:            RoleReadWrite,
+}
+
+// handlerCheckedMethods check the caller's roles in their handlers, since
+// what they need depends on more than the method. Any other method needs the
+// admin role on all databases.
+var handlerCheckedMethods = map[string]bool{
+	pb.PrimoDBService_ChangePassword_FullMethodName: true,
+	pb.PrimoDBService_GrantRole_FullMethodName:      true,
+	pb.PrimoDBService_RevokeRole_FullMethodName:     true,
+	pb.PrimoDBService_RefreshToken_FullMethodName:   true,
+}
+
+// databaseRequest is implemented by the requests of databaseMethods.
+type databaseRequest interface {
+	GetDatabase() string
+}
+
+// tokenFromContext returns the bearer token in the incoming metadata.
+func tokenFromContext(ctx context.Context) (string, error) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return "", ErrMissingToken
+	}
+	for _, value := range md.Get(authorizationHeader) {
+		if token, ok := strings.CutPrefix(value, "Bearer "); ok && token != "" {
+			return token, nil
+		}
+	}
+	return "", ErrMissingToken
+}
+
+// verifyToken checks a token's signature against the key its kid names and
+// that it carries an expiry that hasn't passed, and returns the caller it
+// names.
+func verifyToken(tokenString string) (*Caller, error) {
+	token, err := jwt.Parse(tokenString, tokenKeys.Load().keyFor)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return nil, ErrInvalidToken
+	}
+	// Parse only checks exp when it is present
+	if !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+		return nil, fmt.Errorf("%w: no expiry", ErrInvalidToken)
+	}
+	return callerFromClaims(claims)
+}
+
+// callerFromClaims reads the subject and roles claims of a token.
+func callerFromClaims(claims jwt.MapClaims) (*Caller, error) {
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		return nil, fmt.Errorf("%w: no subject", ErrInvalidToken)
+	}
+	caller := &Caller{Username: subject, Roles: Roles{}}
+	roles, _ := claims["roles"].(map[string]interface{})
+	for database, role := range roles {
+		name, _ := role.(string)
+		r, err := ParseRole(name)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+		}
+		caller.Roles[database] = r
+	}
+	return caller, nil
+}
+
+// authorize checks the token of a call to method and returns its caller,
+// nil for publicMethods.
+func authorize(ctx context.Context, method string) (*Caller, error) {
+	if publicMethods[method] {
+		return nil, nil
+	}
+	token, err := tokenFromContext(ctx)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+	caller, err := verifyToken(token)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+	return caller, nil
+}
+
+// checkAccess checks that caller's roles allow calling method with req. req
+// is only looked at for databaseMethods.
+func checkAccess(caller *Caller, method string, req interface{}) error {
+	if role, ok := databaseMethods[method]; ok {
+		dr, ok := req.(databaseRequest)
+		if !ok {
+			return status.Errorf(codes.Internal, "%s request names no database", method)
+		}
+		if !caller.Roles.Allows(dr.GetDatabase(), role) {
+			return status.Errorf(codes.PermissionDenied, "%s needs the %s role on database %q", method, role, dr.GetDatabase())
+		}
+		return nil
+	}
+	if handlerCheckedMethods[method] || caller.Roles.IsAdmin() {
+		return nil
+	}
+	return status.Errorf(codes.PermissionDenied, "%s needs the admin role on all databases", method)
+}
+
+// requireRole checks, in a handler, that the caller has role on database.
+func requireRole(ctx context.Context, database string, role Role) error {
+	caller := CallerFromContext(ctx)
+	if caller == nil || !caller.Roles.Allows(database, role) {
+		return status.Errorf(codes.PermissionDenied, "needs the %s role on database %q", role, database)
+	}
+	return nil
+}
+
+// unaryAuthInterceptor rejects unary calls without a valid token or the
+// roles they need, and hands the caller to the handler in its context.
+func unaryAuthInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	caller, err := authorize(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	if caller != nil {
+		if err := checkAccess(caller, info.FullMethod, req); err != nil {
+			return nil, err
+		}
+		ctx = withCaller(ctx, caller)
+	}
+	return handler(ctx, req)
+}
+
+// streamAuthInterceptor rejects streaming calls without a valid token or the
+// roles they need. Requests only arrive once the handler runs, so those of
+// databaseMethods are checked as they are received.
+func streamAuthInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	caller, err := authorize(ss.Context(), info.FullMethod)
+	if err != nil {
+		return err
+	}
+	if caller == nil {
+		return handler(srv, ss)
+	}
+	if _, ok := databaseMethods[info.FullMethod]; !ok {
+		if err := checkAccess(caller, info.FullMethod, nil); err != nil {
+			return err
+		}
+	}
+	return handler(srv, &checkedStream{ServerStream: ss, ctx: withCaller(ss.Context(), caller), caller: caller, method: info.FullMethod})
+}
+
+// checkedStream checks the access of each request received on a stream and
+// hands the caller to the handler in its context.
+type checkedStream struct {
+	grpc.ServerStream
+	ctx    context.Context
+	caller *Caller
+	method string
+}
+
+func (s *checkedStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *checkedStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	if _, ok := databaseMethods[s.method]; !ok {
+		return nil
+	}
+	return checkAccess(s.caller, s.method, m)
+}
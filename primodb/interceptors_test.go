@@ -0,0 +1,164 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	pb "github.com/rickcollette/primodb/primodb/primodproto"
+	"github.com/rickcollette/primodb/serverconfig"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// testSecret is the HS256 key of the servers started by serveAuth.
+const testSecret = "test key"
+
+// serveAuth starts a server without TLS, with the auth config of cfg or the
+// HS256 key testSecret if cfg is nil, and a user alice with password secret
+// who can read and write the default database. It returns a connection that
+// sends no token by itself.
+func serveAuth(t *testing.T, cfg *serverconfig.ServerConfig) (*Server, *grpc.ClientConn) {
+	t.Helper()
+	s := NewServer(serverconfig.WalConfig{Datadir: t.TempDir()})
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+	mustOK(t, s.CreateUser("alice", "secret"))
+	mustOK(t, s.GrantRole("alice", "", RoleReadWrite))
+
+	if cfg == nil {
+		cfg = &serverconfig.ServerConfig{}
+		cfg.Auth.SecretKey = testSecret
+	}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	mustOK(t, err)
+	go s.Serve(lis, cfg)
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	mustOK(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return s, conn
+}
+
+// withToken returns a context whose calls carry token.
+func withToken(token string) context.Context {
+	ctx := context.Background()
+	if token == "" {
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx, authorizationHeader, "Bearer "+token)
+}
+
+// login returns a token for username from the Authenticate RPC.
+func login(t *testing.T, conn *grpc.ClientConn, username, password string) string {
+	t.Helper()
+	resp, err := pb.NewPrimoDBServiceClient(conn).Authenticate(context.Background(), &pb.AuthRequest{Username: username, Password: password})
+	mustOK(t, err)
+	return resp.Token
+}
+
+// signToken signs claims with HS256 and secret, under kid unless it is
+// empty.
+func signToken(t *testing.T, claims jwt.MapClaims, kid, secret string) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString([]byte(secret))
+	mustOK(t, err)
+	return signed
+}
+
+// aliceClaims are the claims of a token for alice expiring at exp.
+func aliceClaims(exp time.Time) jwt.MapClaims {
+	return jwt.MapClaims{
+		"exp":   exp.Unix(),
+		"sub":   "alice",
+		"roles": map[string]interface{}{"": string(RoleReadWrite)},
+	}
+}
+
+// checkCode fails t unless err is a status error with code.
+func checkCode(t *testing.T, err error, code codes.Code) {
+	t.Helper()
+	if status.Code(err) != code {
+		t.Fatalf("got %v, want %v", err, code)
+	}
+}
+
+// callUnary makes a Read call with token.
+func callUnary(conn *grpc.ClientConn, token string) error {
+	_, err := pb.NewPrimoDBClient(conn).Read(withToken(token), &pb.ReadRequest{Key: "k"})
+	return err
+}
+
+// callScan makes a Scan call with token and returns the error it ends
+// with, nil if it ends normally.
+func callScan(conn *grpc.ClientConn, token string) error {
+	stream, err := pb.NewPrimoDBClient(conn).Scan(withToken(token), &pb.ScanRequest{})
+	if err != nil {
+		return err
+	}
+	for {
+		if _, err := stream.Recv(); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// callWatch starts a Watch call with token and returns the error it ends
+// with, or nil if it is still running after a moment.
+func callWatch(conn *grpc.ClientConn, token string) error {
+	ctx, cancel := context.WithTimeout(withToken(token), 200*time.Millisecond)
+	defer cancel()
+	stream, err := pb.NewPrimoDBClient(conn).Watch(ctx, &pb.WatchRequest{Prefix: "k"})
+	if err != nil {
+		return err
+	}
+	_, err = stream.Recv()
+	if status.Code(err) == codes.DeadlineExceeded {
+		return nil
+	}
+	return err
+}
+
+func TestAuthInterceptors(t *testing.T) {
+	_, conn := serveAuth(t, nil)
+	calls := map[string]func(*grpc.ClientConn, string) error{
+		"unary": callUnary,
+		"scan":  callScan,
+		"watch": callWatch,
+	}
+	tokens := map[string]string{
+		"missing":    "",
+		"garbage":    "not a token",
+		"wrong key":  signToken(t, aliceClaims(time.Now().Add(time.Hour)), defaultKid, "other key"),
+		"expired":    signToken(t, aliceClaims(time.Now().Add(-time.Minute)), defaultKid, testSecret),
+		"unsigned":   "eyJhbGciOiJub25lIiwidHlwIjoiSldUIn0.eyJzdWIiOiJhbGljZSJ9.",
+		"no subject": signToken(t, jwt.MapClaims{"exp": time.Now().Add(time.Hour).Unix()}, defaultKid, testSecret),
+	}
+	valid := login(t, conn, "alice", "secret")
+
+	for callName, call := range calls {
+		t.Run(callName, func(t *testing.T) {
+			mustOK(t, call(conn, valid))
+			for tokenName, token := range tokens {
+				if err := call(conn, token); status.Code(err) != codes.Unauthenticated {
+					t.Errorf("%s token: got %v, want Unauthenticated", tokenName, err)
+				}
+			}
+		})
+	}
+
+	// Authenticate is the one call that needs no token
+	_, err := pb.NewPrimoDBServiceClient(conn).Authenticate(context.Background(), &pb.AuthRequest{Username: "alice", Password: "wrong"})
+	checkCode(t, err, codes.Unauthenticated)
+	mustOK(t, callUnary(conn, login(t, conn, "alice", "secret")))
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+
+	pb "github.com/rickcollette/primodb/primodb/primodproto"
+	"github.com/rickcollette/primodb/serverconfig"
+	"google.golang.org/grpc"
+)
+
+// ErrServerClosed is returned by Serve once Shutdown was called.
+var ErrServerClosed = errors.New("server is shut down")
+
+// Serve answers gRPC requests on lis until Shutdown is called, and returns
+// nil then. cfg is handed to the RPC handlers. Every call but Authenticate
+// needs a token signed with the key set up from cfg.Auth. Connections use
+// TLS when cfg.TLS has a certificate.
+func (s *Server) Serve(lis net.Listener, cfg *serverconfig.ServerConfig) error {
+	if err := configureAuth(cfg.Auth); err != nil {
+		lis.Close()
+		return err
+	}
+	opts := []grpc.ServerOption{
+		grpc.UnaryInterceptor(unaryAuthInterceptor),
+		grpc.StreamInterceptor(streamAuthInterceptor),
+	}
+	var certs *tlsReloader
+	if cfg.TLS.CertFile != "" {
+		var err error
+		if certs, err = newTLSReloader(cfg.TLS); err != nil {
+			lis.Close()
+			return err
+		}
+		opts = append(opts, grpc.Creds(certs.credentials()))
+	} else {
+		log.Println("No tls.certFile configured, serving without TLS; passwords and tokens are sent in the clear")
+	}
+	gs := grpc.NewServer(opts...)
+	handler := &server{db: s, config: cfg}
+	pb.RegisterPrimoDBServer(gs, handler)
+	pb.RegisterPrimoDBServiceServer(gs, handler)
+
+	s.lifecycleMu.Lock()
+	if s.closing {
+		s.lifecycleMu.Unlock()
+		lis.Close()
+		return ErrServerClosed
+	}
+	s.grpcServer = gs
+	s.tlsCerts = certs
+	s.lifecycleMu.Unlock()
+	return gs.Serve(lis)
+}
+
+// Shutdown stops the server: it stops accepting connections, lets in-flight
+// RPCs finish, ends watches, stops the background tasks, writes a final
+// snapshot if walConfig.SnapshotOnShutdown is set, flushes, fsyncs and closes
+// the WAL, and releases the data directory. RPCs still running when ctx ends
+// are cut off, and the final snapshot is skipped, but the WAL is still closed
+// cleanly. It returns the first error of the final snapshot, closing the
+// WAL and releasing the data directory. Calling Shutdown again waits for the
+// first call and returns its result.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.shutdownOnce.Do(func() {
+		s.shutdownErr = s.shutdown(ctx)
+	})
+	return s.shutdownErr
+}
+
+func (s *Server) shutdown(ctx context.Context) error {
+	s.lifecycleMu.Lock()
+	s.closing = true
+	gs := s.grpcServer
+	s.lifecycleMu.Unlock()
+
+	// Watch streams never end on their own, so they'd hold up GracefulStop
+	s.watchers.close()
+	if gs != nil {
+		stopped := make(chan struct{})
+		go func() {
+			gs.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			log.Printf("Shutdown: %v waiting for RPCs to finish, cutting them off", ctx.Err())
+			gs.Stop()
+			<-stopped
+		}
+	}
+
+	s.StopExpirySweeper()
+	s.StopCheckpointer()
+	var err error
+	if s.walConfig.SnapshotOnShutdown {
+		if ctx.Err() != nil {
+			log.Printf("Shutdown: skipping final snapshot: %v", ctx.Err())
+		} else if seq, path, cerr := s.Checkpoint(); cerr != nil {
+			err = cerr
+			log.Printf("Shutdown: final snapshot failed: %v", cerr)
+		} else {
+			log.Printf("Shutdown: final snapshot at seq %d written to %s", seq, path)
+		}
+	}
+
+	if cerr := s.walObj.Close(); cerr != nil {
+		log.Printf("Shutdown: closing the WAL failed: %v", cerr)
+		if err == nil {
+			err = cerr
+		}
+	}
+	if uerr := s.dirLock.Unlock(); uerr != nil && err == nil {
+		err = uerr
+	}
+	log.Println("Server shut down")
+	return err
+}
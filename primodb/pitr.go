@@ -0,0 +1,136 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rickcollette/primodb/serverconfig"
+	"github.com/rickcollette/primodb/snapshot"
+	"github.com/rickcollette/primodb/wal"
+)
+
+// errStopReplay ends recovery at the recovery target.
+var errStopReplay = errors.New("recovery target reached")
+
+// RecoveryTarget stops recovery at a point in the WAL's history, for undoing
+// changes made after it. The zero value recovers everything.
+type RecoveryTarget struct {
+	Seq  int64     // replay records up to this sequence, 0 for no limit
+	Time time.Time // replay records logged up to this time, zero for no limit
+}
+
+// ParseRecoveryTarget builds a RecoveryTarget from the --until-seq and
+// --until-time flags. untilTime is in RFC 3339 format.
+func ParseRecoveryTarget(untilSeq int64, untilTime string) (RecoveryTarget, error) {
+	target := RecoveryTarget{Seq: untilSeq}
+	if untilSeq < 0 {
+		return target, fmt.Errorf("invalid --until-seq %d", untilSeq)
+	}
+	if untilTime != "" {
+		t, err := time.Parse(time.RFC3339Nano, untilTime)
+		if err != nil {
+			return target, fmt.Errorf("invalid --until-time: %w", err)
+		}
+		target.Time = t
+	}
+	return target, nil
+}
+
+// IsZero reports whether the target recovers everything.
+func (t RecoveryTarget) IsZero() bool {
+	return t.Seq == 0 && t.Time.IsZero()
+}
+
+func (t RecoveryTarget) String() string {
+	switch {
+	case t.Seq > 0 && !t.Time.IsZero():
+		return fmt.Sprintf("seq %d and %s", t.Seq, t.Time.Format(time.RFC3339Nano))
+	case t.Seq > 0:
+		return fmt.Sprintf("seq %d", t.Seq)
+	case !t.Time.IsZero():
+		return t.Time.Format(time.RFC3339Nano)
+	}
+	return "end of WAL"
+}
+
+// includes reports whether a record comes before the target. Records logged
+// before timestamps were recorded count as before any time.
+func (t RecoveryTarget) includes(seq, timestamp int64) bool {
+	if t.Seq > 0 && seq > t.Seq {
+		return false
+	}
+	if !t.Time.IsZero() && timestamp != 0 && time.Unix(0, timestamp).After(t.Time) {
+		return false
+	}
+	return true
+}
+
+// allowsSnapshot reports whether a snapshot holds nothing after the target.
+// Snapshots that don't record what they hold can't be used for a target.
+func (t RecoveryTarget) allowsSnapshot(info snapshot.Info) bool {
+	if t.Seq > 0 && info.MaxSeq > t.Seq {
+		return false
+	}
+	if !t.Time.IsZero() && (info.Time.IsZero() || info.Time.After(t.Time)) {
+		return false
+	}
+	return true
+}
+
+// discardAfter sets aside the snapshots and WAL records after seq, so the
+// server carries on from the recovered point. The archive gets the same
+// treatment, keeping the old copies under their discarded names.
+func (s *Server) discardAfter(walDir string, seq int64) error {
+	snaps, err := snapshot.DiscardAfter(walDir, seq)
+	if err != nil {
+		return err
+	}
+	cuts, err := wal.TruncateAfter(walDir, seq)
+	if err != nil {
+		return err
+	}
+	log.Printf("Kept WAL up to seq %d: set aside %d snapshots and %d WAL segments after it", seq, len(snaps), len(cuts))
+	if s.archive == nil {
+		return nil
+	}
+
+	for _, snap := range snaps {
+		if err := s.archive.Put(snap.Discarded, filepath.Join(walDir, snap.Discarded)); err != nil {
+			return err
+		}
+		if err := s.archive.Delete(snap.Snapshot); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	for _, cut := range cuts {
+		if err := s.archive.Put(cut.Discarded, filepath.Join(walDir, cut.Discarded)); err != nil {
+			return err
+		}
+		if cut.Truncated {
+			err = s.archive.Put(cut.Segment, filepath.Join(walDir, cut.Segment))
+		} else {
+			err = s.archive.Delete(cut.Segment)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// TruncateAfter implements `primod wal truncate`: it sets aside the WAL
+// records and snapshots after seq in the data directory of walConfig, and in
+// the archive if one is configured, as point-in-time recovery does. The
+// caller must hold the data directory lock.
+func TruncateAfter(walConfig serverconfig.WalConfig, seq int64) error {
+	archive, err := openArchive(walConfig)
+	if err != nil {
+		return err
+	}
+	s := &Server{walConfig: walConfig, archive: archive}
+	return s.discardAfter(walConfig.Datadir, seq)
+}
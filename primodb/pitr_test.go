@@ -0,0 +1,110 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/rickcollette/primodb/serverconfig"
+	"github.com/rickcollette/primodb/snapshot"
+)
+
+// writeKeys creates keys k<from> to k<to> in the "" database, one WAL record
+// each, and returns the dump after each write, by sequence.
+func writeKeys(t *testing.T, s *Server, from, to int, dumps map[int64]map[string][]string) {
+	t.Helper()
+	for i := from; i <= to; i++ {
+		_, err := s.Create("", fmt.Sprintf("k%d", i), "v")
+		mustOK(t, err)
+		dumps[s.walObj.LastSeq()] = dumpDatabases(s)
+	}
+}
+
+// restartUntil shuts s down and recovers its data directory up to target.
+func restartUntil(t *testing.T, s *Server, cfg serverconfig.WalConfig, target RecoveryTarget) *Server {
+	t.Helper()
+	mustOK(t, s.Shutdown(context.Background()))
+	s = NewServerUntil(cfg, target)
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+	return s
+}
+
+func TestRecoverUntilSeq(t *testing.T) {
+	cfg := serverconfig.WalConfig{Datadir: t.TempDir()}
+	s := NewServer(cfg)
+	dumps := map[int64]map[string][]string{}
+	writeKeys(t, s, 1, 5, dumps)
+
+	s = restartUntil(t, s, cfg, RecoveryTarget{Seq: 3})
+	checkReplayed(t, dumps[3], s)
+
+	// New writes continue after the target, and the records set aside
+	// don't come back
+	writeKeys(t, s, 6, 6, dumps)
+	if seq := s.walObj.LastSeq(); seq != 4 {
+		t.Fatalf("write after recovery got seq %d, want 4", seq)
+	}
+	s = restart(t, s, cfg)
+	checkReplayed(t, dumps[4], s)
+}
+
+func TestRecoverUntilTime(t *testing.T) {
+	cfg := serverconfig.WalConfig{Datadir: t.TempDir()}
+	s := NewServer(cfg)
+	dumps := map[int64]map[string][]string{}
+	writeKeys(t, s, 1, 2, dumps)
+	time.Sleep(10 * time.Millisecond)
+	until := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	writeKeys(t, s, 3, 4, dumps)
+
+	s = restartUntil(t, s, cfg, RecoveryTarget{Time: until})
+	checkReplayed(t, dumps[2], s)
+}
+
+func TestRecoverUntilUsesSnapshot(t *testing.T) {
+	cfg := serverconfig.WalConfig{Datadir: t.TempDir()}
+	s := NewServer(cfg)
+	dumps := map[int64]map[string][]string{}
+	writeKeys(t, s, 1, 2, dumps)
+	_, path, err := s.Checkpoint()
+	mustOK(t, err)
+	writeKeys(t, s, 3, 5, dumps)
+
+	s = restartUntil(t, s, cfg, RecoveryTarget{Seq: 4})
+	checkReplayed(t, dumps[4], s)
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("snapshot before the target was set aside: %v", err)
+	}
+}
+
+func TestRecoverUntilSkipsSnapshotPastTarget(t *testing.T) {
+	cfg := serverconfig.WalConfig{Datadir: t.TempDir()}
+	s := NewServer(cfg)
+	dumps := map[int64]map[string][]string{}
+	writeKeys(t, s, 1, 5, dumps)
+	// A snapshot tagged with seq 3 that caught writes up to seq 5 while it
+	// was taken, as a checkpoint racing with writers does
+	codec, err := s.snapshotCodec()
+	mustOK(t, err)
+	path, err := snapshot.Write(cfg.Datadir, 3, s.dbStore, s.walObj.LastSeq, nil, codec)
+	mustOK(t, err)
+	info, err := snapshot.ReadInfo(path)
+	mustOK(t, err)
+	if info.Seq != 3 || info.MaxSeq != 5 {
+		t.Fatalf("snapshot covers seq %d to %d, want 3 to 5", info.Seq, info.MaxSeq)
+	}
+
+	s = restartUntil(t, s, cfg, RecoveryTarget{Seq: 4})
+	checkReplayed(t, dumps[4], s)
+	if _, err := os.Stat(path + snapshot.DiscardedExtension); err != nil {
+		t.Fatalf("snapshot holding records after the target was not set aside: %v", err)
+	}
+
+	// Sequence 5 is handed out again, and only the new write has it
+	writeKeys(t, s, 6, 6, dumps)
+	s = restart(t, s, cfg)
+	checkReplayed(t, dumps[5], s)
+}
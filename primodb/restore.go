@@ -0,0 +1,148 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rickcollette/primodb/serverconfig"
+	"github.com/rickcollette/primodb/snapshot"
+	"github.com/rickcollette/primodb/wal"
+)
+
+// dataDirEmpty reports whether dataDir holds no WAL segments or snapshots,
+// creating it if it doesn't exist.
+func dataDirEmpty(dataDir string) (bool, error) {
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return false, err
+	}
+	entries, err := os.ReadDir(dataDir)
+	if err != nil {
+		return false, err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if wal.IsSegmentName(name) || strings.HasSuffix(name, ".wal.tmp") {
+			return false, nil
+		}
+		if _, err := snapshot.ParseName(name); err == nil {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// restoreFromArchive fills an empty data directory from the archive: the
+// newest snapshot that verifies and doesn't go past target, if there is one,
+// and every archived segment in order. The segments are verified together,
+// decrypted with key if they are encrypted, so a missing or corrupted one
+// fails the restore and nothing is left behind for recovery to pick up.
+func restoreFromArchive(archive wal.ArchiveBackend, dataDir string, key []byte, target RecoveryTarget) (err error) {
+	names, err := archive.List()
+	if err != nil {
+		return err
+	}
+	var segments, snapshots []string
+	for _, name := range names {
+		if wal.IsSegmentName(name) {
+			segments = append(segments, name)
+		} else if _, err := snapshot.ParseName(name); err == nil {
+			snapshots = append(snapshots, name)
+		}
+	}
+	if len(segments) == 0 && len(snapshots) == 0 {
+		log.Println("Archive is empty, nothing to restore")
+		return nil
+	}
+	log.Printf("Restoring from archive: %d segments, %d snapshots", len(segments), len(snapshots))
+
+	var downloaded []string
+	defer func() {
+		if err != nil {
+			for _, path := range downloaded {
+				os.Remove(path)
+			}
+		}
+	}()
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		if seq, _ := snapshot.ParseName(snapshots[i]); target.Seq > 0 && seq > target.Seq {
+			continue
+		}
+		path := filepath.Join(dataDir, snapshots[i])
+		if err := download(archive, snapshots[i], path); err != nil {
+			return err
+		}
+		if err := snapshot.Verify(path); err != nil {
+			log.Printf("Skipping archived snapshot %s: %s", snapshots[i], err)
+			os.Remove(path)
+			continue
+		}
+		if info, err := snapshot.ReadInfo(path); err != nil || !target.allowsSnapshot(info) {
+			os.Remove(path)
+			continue
+		}
+		downloaded = append(downloaded, path)
+		break
+	}
+	for _, name := range segments {
+		path := filepath.Join(dataDir, name)
+		if err := download(archive, name, path); err != nil {
+			return err
+		}
+		downloaded = append(downloaded, path)
+	}
+	if len(segments) > 0 {
+		r, err := wal.Open(dataDir, wal.Strict, key)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		if err := r.Verify(); err != nil {
+			return fmt.Errorf("archived WAL failed verification: %w", err)
+		}
+	}
+	log.Printf("Restored %d files from archive", len(downloaded))
+	return nil
+}
+
+// download fetches name from the archive to path. The file only appears
+// under path once it is complete.
+func download(archive wal.ArchiveBackend, name, path string) error {
+	tmpPath := path + ".download"
+	if err := archive.Get(name, tmpPath); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to download %s: %w", name, err)
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// Restore rebuilds the empty data directory in walConfig from the configured
+// archive and replays it up to target, then writes a checkpoint so the next
+// start doesn't replay everything again.
+func Restore(walConfig serverconfig.WalConfig, target RecoveryTarget) error {
+	archive, err := openArchive(walConfig)
+	if err != nil {
+		return err
+	}
+	if archive == nil {
+		return fmt.Errorf("no archive configured")
+	}
+	empty, err := dataDirEmpty(walConfig.Datadir)
+	if err != nil {
+		return err
+	}
+	if !empty {
+		return fmt.Errorf("data directory %s is not empty", walConfig.Datadir)
+	}
+
+	// NewServer restores into the empty data directory before recovering
+	s := NewServerUntil(walConfig, target)
+	defer s.dirLock.Unlock()
+	_, _, err = s.Checkpoint()
+	if cerr := s.walObj.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
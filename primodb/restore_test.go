@@ -0,0 +1,114 @@
+package server
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rickcollette/primodb/serverconfig"
+	"github.com/rickcollette/primodb/snapshot"
+	"github.com/rickcollette/primodb/wal"
+)
+
+// archivedServer writes to a server archiving to a local archive, with a
+// checkpoint in the middle, shuts it down and returns what it held.
+func archivedServer(t *testing.T, cfg serverconfig.WalConfig) map[string][]string {
+	t.Helper()
+	s := NewServer(cfg)
+	writeEverything(t, s, "before")
+	_, _, err := s.Checkpoint()
+	mustOK(t, err)
+	writeEverything(t, s, "after")
+	want := dumpDatabases(s)
+	mustOK(t, s.Shutdown(context.Background()))
+	return want
+}
+
+// archivedFiles returns the segments and snapshots in the archive of cfg.
+func archivedFiles(t *testing.T, cfg serverconfig.WalConfig) (segments, snapshots []string) {
+	t.Helper()
+	entries, err := os.ReadDir(cfg.ArchiveDir)
+	mustOK(t, err)
+	for _, entry := range entries {
+		if wal.IsSegmentName(entry.Name()) {
+			segments = append(segments, entry.Name())
+		} else if _, err := snapshot.ParseName(entry.Name()); err == nil {
+			snapshots = append(snapshots, entry.Name())
+		}
+	}
+	return segments, snapshots
+}
+
+func TestRestoreFromArchive(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		cfg  serverconfig.WalConfig
+	}{
+		{"plain", serverconfig.WalConfig{}},
+		{"encrypted", serverconfig.WalConfig{Compression: "flate", EncryptionKey: strings.Repeat("ab", 32)}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := tc.cfg
+			cfg.Datadir = t.TempDir()
+			cfg.Archive = "local"
+			cfg.ArchiveDir = t.TempDir()
+			cfg.SegmentMaxRecords = 10
+			want := archivedServer(t, cfg)
+			segments, snapshots := archivedFiles(t, cfg)
+			if len(segments) < 2 || len(snapshots) != 1 {
+				t.Fatalf("archive holds segments %v and snapshots %v, want several segments and a snapshot", segments, snapshots)
+			}
+
+			// Lose the data directory
+			mustOK(t, os.RemoveAll(cfg.Datadir))
+			mustOK(t, Restore(cfg, RecoveryTarget{}))
+			if _, err := os.Stat(filepath.Join(cfg.Datadir, snapshots[0])); err != nil {
+				t.Fatalf("restore didn't download the archived snapshot: %v", err)
+			}
+			if err := Restore(cfg, RecoveryTarget{}); err == nil {
+				t.Fatal("restore into a data directory that isn't empty succeeded")
+			}
+
+			s := NewServer(cfg)
+			t.Cleanup(func() { s.Shutdown(context.Background()) })
+			checkReplayed(t, want, s)
+		})
+	}
+
+	// A new node restores on its first start, without primod restore
+	t.Run("on start", func(t *testing.T) {
+		cfg := serverconfig.WalConfig{Datadir: t.TempDir(), Archive: "local", ArchiveDir: t.TempDir(), SegmentMaxRecords: 10}
+		want := archivedServer(t, cfg)
+		cfg.Datadir = t.TempDir()
+		s := NewServer(cfg)
+		t.Cleanup(func() { s.Shutdown(context.Background()) })
+		checkReplayed(t, want, s)
+	})
+}
+
+func TestRestoreMissingSegment(t *testing.T) {
+	cfg := serverconfig.WalConfig{Datadir: t.TempDir(), Archive: "local", ArchiveDir: t.TempDir(), SegmentMaxRecords: 10}
+	s := NewServer(cfg)
+	writeEverything(t, s, "")
+	mustOK(t, s.Shutdown(context.Background()))
+	segments, _ := archivedFiles(t, cfg)
+	if len(segments) < 3 {
+		t.Fatalf("archive holds segments %v, want at least 3", segments)
+	}
+	mustOK(t, os.Remove(filepath.Join(cfg.ArchiveDir, segments[1])))
+
+	archive, err := wal.NewLocalArchive(cfg.ArchiveDir)
+	mustOK(t, err)
+	dataDir := t.TempDir()
+	err = restoreFromArchive(archive, dataDir, nil, RecoveryTarget{})
+	if err == nil || !strings.Contains(err.Error(), "verification") {
+		t.Fatalf("restore with a segment missing from the archive got %v, want a verification error", err)
+	}
+	empty, err := dataDirEmpty(dataDir)
+	mustOK(t, err)
+	if !empty {
+		t.Fatal("failed restore left files behind")
+	}
+}
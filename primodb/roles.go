@@ -0,0 +1,232 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/rickcollette/primodb/memtable"
+	pb "github.com/rickcollette/primodb/primodb/primodproto"
+)
+
+// Role is what a user may do on a database. Each role includes the ones
+// below it: readonly reads, scans and watches, readwrite also writes, and
+// admin also grants roles on the database.
+type Role string
+
+const (
+	RoleReadOnly  Role = "readonly"
+	RoleReadWrite Role = "readwrite"
+	RoleAdmin     Role = "admin"
+)
+
+// AllDatabases stands for every database in a grant. An admin on all
+// databases manages users and is the only one who can use the users
+// database.
+const AllDatabases = "*"
+
+// roleKeyPrefix starts the users database keys holding grants, one per user
+// and database: role:<username>:<database>.
+const roleKeyPrefix = "role:"
+
+var (
+	// ErrBadRole is returned for a role that isn't one of the Role constants.
+	ErrBadRole = errors.New("unknown role, use admin, readwrite or readonly")
+	// ErrNoGrant is returned when revoking a role the user doesn't have.
+	ErrNoGrant = errors.New("user has no role on that database")
+	// ErrAdminExists is returned by InitAdmin when the server has an admin.
+	ErrAdminExists = errors.New("an admin already exists")
+)
+
+var roleRanks = map[Role]int{RoleReadOnly: 1, RoleReadWrite: 2, RoleAdmin: 3}
+
+// ParseRole checks that s names a role.
+func ParseRole(s string) (Role, error) {
+	if _, ok := roleRanks[Role(s)]; !ok {
+		return "", fmt.Errorf("%w: %q", ErrBadRole, s)
+	}
+	return Role(s), nil
+}
+
+// Roles maps database names, or AllDatabases, to the role granted on them.
+type Roles map[string]Role
+
+// On returns the role on database, the higher of the ones granted on it and
+// on AllDatabases. The users database is hidden from anyone but admins of
+// all databases.
+func (r Roles) On(database string) Role {
+	if database == usersDatabase {
+		if r.IsAdmin() {
+			return RoleAdmin
+		}
+		return ""
+	}
+	role, all := r[database], r[AllDatabases]
+	if roleRanks[all] > roleRanks[role] {
+		return all
+	}
+	return role
+}
+
+// Allows reports whether the roles include role on database.
+func (r Roles) Allows(database string, role Role) bool {
+	return roleRanks[r.On(database)] >= roleRanks[role]
+}
+
+// IsAdmin reports whether the roles make an admin of all databases.
+func (r Roles) IsAdmin() bool {
+	return r[AllDatabases] == RoleAdmin
+}
+
+// Caller is the authenticated user of an RPC, as its token says.
+type Caller struct {
+	Username string
+	Roles    Roles
+}
+
+type callerKey struct{}
+
+func withCaller(ctx context.Context, caller *Caller) context.Context {
+	return context.WithValue(ctx, callerKey{}, caller)
+}
+
+// CallerFromContext returns the caller of the RPC ctx belongs to, or nil for
+// the calls that need no token.
+func CallerFromContext(ctx context.Context) *Caller {
+	caller, _ := ctx.Value(callerKey{}).(*Caller)
+	return caller
+}
+
+func roleKey(username, database string) string {
+	return roleKeyPrefix + username + ":" + database
+}
+
+// RolesOf returns the roles granted to username.
+func (s *Server) RolesOf(username string) Roles {
+	prefix := roleKey(username, "")
+	roles := Roles{}
+	for _, row := range s.Scan(usersDatabase, prefix, memtable.PrefixEnd(prefix), 0) {
+		roles[strings.TrimPrefix(row.Key, prefix)] = Role(row.Value)
+	}
+	return roles
+}
+
+// hasAdmin reports whether any user is an admin of all databases.
+func (s *Server) hasAdmin() bool {
+	for _, row := range s.Scan(usersDatabase, roleKeyPrefix, memtable.PrefixEnd(roleKeyPrefix), 0) {
+		if strings.HasSuffix(row.Key, ":"+AllDatabases) && Role(row.Value) == RoleAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// userTxnError maps the errors of a transaction conditioned on a user's row
+// to the errors of user operations.
+func userTxnError(err error) error {
+	switch {
+	case errors.Is(err, memtable.ErrKeyNotFound):
+		return ErrUserNotFound
+	case errors.Is(err, memtable.ErrVersionMismatch):
+		return memtable.ErrVersionMismatch
+	}
+	return err
+}
+
+// GrantRole gives username role on database, or on every database with
+// AllDatabases, replacing the role it had there. Tokens carry the roles
+// granted when they were issued, so the change applies from the user's next
+// login.
+func (s *Server) GrantRole(username, database string, role Role) error {
+	if _, err := ParseRole(string(role)); err != nil {
+		return err
+	}
+	userKey := userKeyPrefix + username
+	row, err := s.ReadRow(usersDatabase, userKey)
+	if err == memtable.ErrKeyNotFound {
+		return ErrUserNotFound
+	} else if err != nil {
+		return err
+	}
+	// The condition keeps grants of a user deleted in the meantime out
+	conds := []TxnCondition{{Key: userKey, Condition: memtable.Condition{IfVersion: row.Version}}}
+	_, err = s.Txn(usersDatabase, conds, []TxnOp{{Key: roleKey(username, database), Value: string(role)}})
+	return userTxnError(err)
+}
+
+// RevokeRole takes away the role username has on database. A role on
+// AllDatabases has to be revoked as such.
+func (s *Server) RevokeRole(username, database string) error {
+	err := s.DeleteIf(usersDatabase, roleKey(username, database), memtable.Condition{})
+	if err == memtable.ErrKeyNotFound {
+		return ErrNoGrant
+	}
+	return err
+}
+
+func rolesToProto(roles Roles) []*pb.RoleGrant {
+	grants := make([]*pb.RoleGrant, 0, len(roles))
+	for database, role := range roles {
+		grants = append(grants, &pb.RoleGrant{Database: database, Role: string(role)})
+	}
+	return grants
+}
+
+// BootstrapAdmin makes username an admin of all databases when no one is,
+// so someone can log in to a new server and manage it, and reports whether
+// it did. The user is created with password if it doesn't exist. An existing
+// user is only made an admin if password is its password, failing with
+// ErrWrongPassword otherwise, so the bootstrap can't hand out someone else's
+// account.
+func (s *Server) BootstrapAdmin(username, password string) (bool, error) {
+	if s.hasAdmin() {
+		return false, nil
+	}
+	err := s.CreateUser(username, password)
+	if err == ErrUserExists {
+		ok, err := s.CheckPassword(username, password)
+		if err != nil {
+			return false, err
+		}
+		if !ok {
+			return false, ErrWrongPassword
+		}
+	} else if err != nil {
+		return false, err
+	}
+	if err := s.GrantRole(username, AllDatabases, RoleAdmin); err != nil {
+		return false, err
+	}
+	log.Printf("Made %q an admin of all databases", username)
+	return true, nil
+}
+
+// GrantRole needs the admin role on the database granted on.
+func (s *server) GrantRole(ctx context.Context, req *pb.GrantRoleRequest) (*pb.UserResponse, error) {
+	log.Printf("GRANT: %s on %q to %s", req.Role, req.Database, req.Username)
+	if err := requireRole(ctx, req.Database, RoleAdmin); err != nil {
+		return nil, err
+	}
+	role, err := ParseRole(req.Role)
+	if err != nil {
+		return nil, userStatus(ErrBadRole)
+	}
+	if err := s.db.GrantRole(req.Username, req.Database, role); err != nil {
+		return nil, userStatus(err)
+	}
+	return &pb.UserResponse{Message: fmt.Sprintf("Granted %s on %q to %s", role, req.Database, req.Username)}, nil
+}
+
+// RevokeRole needs the admin role on the database revoked on.
+func (s *server) RevokeRole(ctx context.Context, req *pb.RevokeRoleRequest) (*pb.UserResponse, error) {
+	log.Printf("REVOKE: %q from %s", req.Database, req.Username)
+	if err := requireRole(ctx, req.Database, RoleAdmin); err != nil {
+		return nil, err
+	}
+	if err := s.db.RevokeRole(req.Username, req.Database); err != nil {
+		return nil, userStatus(err)
+	}
+	return &pb.UserResponse{Message: fmt.Sprintf("Revoked %q from %s", req.Database, req.Username)}, nil
+}
@@ -0,0 +1,212 @@
+package server
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/rickcollette/primodb/client"
+	"github.com/rickcollette/primodb/clientconfig"
+	pb "github.com/rickcollette/primodb/primodb/primodproto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+func TestRolesOn(t *testing.T) {
+	roles := Roles{"orders": RoleReadOnly, AllDatabases: RoleReadWrite, "stock": RoleAdmin}
+	for database, want := range map[string]Role{
+		"orders":      RoleReadWrite,
+		"stock":       RoleAdmin,
+		"":            RoleReadWrite,
+		usersDatabase: "",
+	} {
+		if got := roles.On(database); got != want {
+			t.Errorf("role on %q is %q, want %q", database, got, want)
+		}
+	}
+	if roles.IsAdmin() || roles.Allows(usersDatabase, RoleReadOnly) {
+		t.Error("readwrite on all databases gives access to the users database")
+	}
+	admin := Roles{AllDatabases: RoleAdmin}
+	if !admin.IsAdmin() || !admin.Allows(usersDatabase, RoleAdmin) {
+		t.Error("admin of all databases can't use the users database")
+	}
+	if (Roles{}).Allows("", RoleReadOnly) {
+		t.Error("no roles allow reading")
+	}
+}
+
+// grantedToken creates username with roles and returns a context whose
+// calls carry its token.
+func grantedToken(t *testing.T, s *Server, conn *grpc.ClientConn, username string, roles Roles) context.Context {
+	t.Helper()
+	mustOK(t, s.CreateUser(username, "pw"))
+	for database, role := range roles {
+		mustOK(t, s.GrantRole(username, database, role))
+	}
+	return withToken(login(t, conn, username, "pw"))
+}
+
+func TestRolesPerDatabase(t *testing.T) {
+	s, conn := serveAuth(t, nil)
+	db := pb.NewPrimoDBClient(conn)
+	reader := grantedToken(t, s, conn, "reader", Roles{"orders": RoleReadOnly})
+	writer := grantedToken(t, s, conn, "writer", Roles{"orders": RoleReadWrite})
+	everywhere := grantedToken(t, s, conn, "everywhere", Roles{AllDatabases: RoleReadWrite})
+	root := grantedToken(t, s, conn, "root", Roles{AllDatabases: RoleAdmin})
+
+	denied := func(t *testing.T, err error) {
+		t.Helper()
+		checkCode(t, err, codes.PermissionDenied)
+	}
+	scan := func(ctx context.Context, database string) error {
+		stream, err := db.Scan(ctx, &pb.ScanRequest{Database: database})
+		if err != nil {
+			return err
+		}
+		_, err = stream.Recv()
+		return err
+	}
+	watch := func(ctx context.Context, database string) error {
+		ctx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+		defer cancel()
+		stream, err := db.Watch(ctx, &pb.WatchRequest{Prefix: "k", Database: database})
+		if err != nil {
+			return err
+		}
+		_, err = stream.Recv()
+		if err != nil && ctx.Err() != nil {
+			return nil
+		}
+		return err
+	}
+
+	t.Run("readonly", func(t *testing.T) {
+		_, err := db.Read(reader, &pb.ReadRequest{Key: "k", Database: "orders"})
+		mustOK(t, err)
+		_, err = db.Create(reader, &pb.CreateRequest{Key: "k", Value: "v", Database: "orders"})
+		denied(t, err)
+		_, err = db.Delete(reader, &pb.DeleteRequest{Key: "k", Database: "orders"})
+		denied(t, err)
+		_, err = db.Txn(reader, &pb.TxnRequest{Database: "orders"})
+		denied(t, err)
+		mustOK(t, watch(reader, "orders"))
+
+		// No role on the default database
+		_, err = db.Read(reader, &pb.ReadRequest{Key: "k"})
+		denied(t, err)
+		denied(t, scan(reader, ""))
+		denied(t, watch(reader, ""))
+	})
+
+	t.Run("readwrite", func(t *testing.T) {
+		_, err := db.Create(writer, &pb.CreateRequest{Key: "k", Value: "v", Database: "orders"})
+		mustOK(t, err)
+		_, err = db.Update(writer, &pb.UpdateRequest{Key: "k", Value: "w", Database: "orders"})
+		mustOK(t, err)
+		_, err = db.Create(writer, &pb.CreateRequest{Key: "k", Value: "v", Database: "stock"})
+		denied(t, err)
+		_, err = db.Checkpoint(writer, &pb.CheckpointRequest{})
+		denied(t, err)
+	})
+
+	t.Run("users database", func(t *testing.T) {
+		// A role on all databases doesn't reach the users database
+		_, err := db.Read(everywhere, &pb.ReadRequest{Key: userKeyPrefix + "root", Database: usersDatabase})
+		denied(t, err)
+		denied(t, scan(everywhere, usersDatabase))
+		denied(t, watch(everywhere, usersDatabase))
+		_, err = db.Create(everywhere, &pb.CreateRequest{Key: roleKey("everywhere", AllDatabases), Value: string(RoleAdmin), Database: usersDatabase})
+		denied(t, err)
+		if s.RolesOf("everywhere").IsAdmin() {
+			t.Fatal("a non-admin made itself an admin through the users database")
+		}
+
+		resp, err := db.Read(root, &pb.ReadRequest{Key: userKeyPrefix + "root", Database: usersDatabase})
+		mustOK(t, err)
+		if resp.Value == "" {
+			t.Fatal("admin read no password hash from the users database")
+		}
+	})
+
+	t.Run("grant", func(t *testing.T) {
+		users := pb.NewPrimoDBServiceClient(conn)
+		orderAdmin := grantedToken(t, s, conn, "orderadmin", Roles{"orders": RoleAdmin})
+		_, err := users.GrantRole(orderAdmin, &pb.GrantRoleRequest{Username: "reader", Database: "orders", Role: string(RoleReadWrite)})
+		mustOK(t, err)
+		_, err = users.GrantRole(orderAdmin, &pb.GrantRoleRequest{Username: "reader", Database: "stock", Role: string(RoleReadOnly)})
+		denied(t, err)
+		_, err = users.GrantRole(orderAdmin, &pb.GrantRoleRequest{Username: "orderadmin", Database: AllDatabases, Role: string(RoleAdmin)})
+		denied(t, err)
+		_, err = users.RevokeRole(orderAdmin, &pb.RevokeRoleRequest{Username: "reader", Database: "orders"})
+		mustOK(t, err)
+		_, err = users.RevokeRole(orderAdmin, &pb.RevokeRoleRequest{Username: "reader", Database: "orders"})
+		checkCode(t, err, codes.NotFound)
+
+		_, err = users.GrantRole(root, &pb.GrantRoleRequest{Username: "reader", Database: "orders", Role: "owner"})
+		checkCode(t, err, codes.InvalidArgument)
+	})
+}
+
+// TestClientSendsDatabase checks that the client's key operations go to the
+// database it was opened on, so roles on that database apply to them.
+// newClient logs in to the server conn is connected to as username, with
+// key operations going to database.
+func newClient(t *testing.T, conn *grpc.ClientConn, database, username, password string) *client.PrimoDBClient {
+	t.Helper()
+	host, portString, err := net.SplitHostPort(conn.Target())
+	mustOK(t, err)
+	port, err := strconv.Atoi(portString)
+	mustOK(t, err)
+	cfg := &clientconfig.ClientConfig{}
+	cfg.Server.Timeout = 5
+	c, err := client.NewClient(host, port, database, 5*time.Second, cfg, username, password)
+	mustOK(t, err)
+	return c
+}
+
+func TestClientSendsDatabase(t *testing.T) {
+	s, conn := serveAuth(t, nil)
+	mustOK(t, s.CreateUser("writer", "pw"))
+	mustOK(t, s.GrantRole("writer", "orders", RoleReadWrite))
+	open := func(database string) *client.PrimoDBClient {
+		return newClient(t, conn, database, "writer", "pw")
+	}
+
+	orders := open("orders")
+	_, err := orders.Create("k", "v")
+	mustOK(t, err)
+	if v, err := s.Read("orders", "k"); err != nil || v != "v" {
+		t.Fatalf("client write to orders reads back %q, %v", v, err)
+	}
+	if _, err := s.Read("", "k"); err == nil {
+		t.Fatal("client write to orders landed in the default database")
+	}
+	v, err := orders.Read("k")
+	mustOK(t, err)
+	if v != "v" {
+		t.Fatalf("client read %q from orders, want v", v)
+	}
+	it, err := orders.Scan("", "", "", 0, false)
+	mustOK(t, err)
+	for it.Next() {
+	}
+	mustOK(t, it.Err())
+
+	// The writer has no role on the default database. Key operations
+	// return the error rather than exit.
+	defaultDB := open("")
+	it, err = defaultDB.Scan("", "", "", 0, false)
+	mustOK(t, err)
+	for it.Next() {
+	}
+	checkCode(t, it.Err(), codes.PermissionDenied)
+	_, err = defaultDB.Create("k", "v")
+	checkCode(t, err, codes.PermissionDenied)
+	_, err = defaultDB.Read("k")
+	checkCode(t, err, codes.PermissionDenied)
+	_, _, err = defaultDB.CompareAndSwap("k", 0, "v")
+	checkCode(t, err, codes.PermissionDenied)
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/rickcollette/primodb/client"
+)
+
+// scanAll returns the keys and values it reads, failing on a scan error.
+func scanAll(t *testing.T, it *client.ScanIterator) (keys, values []string) {
+	t.Helper()
+	defer it.Close()
+	for it.Next() {
+		keys = append(keys, it.Key())
+		values = append(values, it.Value())
+	}
+	mustOK(t, it.Err())
+	return keys, values
+}
+
+// numberedKeys returns the keys k<first> up to k<last - 1>.
+func numberedKeys(first, last int) []string {
+	var keys []string
+	for i := first; i < last; i++ {
+		keys = append(keys, fmt.Sprintf("k%05d", i))
+	}
+	return keys
+}
+
+// TestScan pages through more rows than a memtable batch, so every scan
+// that returns more than scanBatchSize rows resumes after the last key of a
+// batch.
+func TestScan(t *testing.T) {
+	s, conn := serveAuth(t, nil)
+	n := 2*scanBatchSize + 10
+	ops := []TxnOp{{Key: "a", Value: "before"}, {Key: "l", Value: "after"}}
+	for _, key := range numberedKeys(0, n) {
+		ops = append(ops, TxnOp{Key: key, Value: "v" + key})
+	}
+	_, err := s.Txn("", nil, ops)
+	mustOK(t, err)
+	c := newClient(t, conn, "", "alice", "secret")
+
+	for _, tc := range []struct {
+		name       string
+		start, end string
+		prefix     string
+		limit      int
+		want       []string
+	}{
+		{"everything", "", "", "", 0, append(append([]string{"a"}, numberedKeys(0, n)...), "l")},
+		{"prefix", "", "", "k", 0, numberedKeys(0, n)},
+		{"limit", "", "", "k", scanBatchSize + 5, numberedKeys(0, scanBatchSize+5)},
+		{"limit at a batch", "", "", "k", scanBatchSize, numberedKeys(0, scanBatchSize)},
+		{"range", "k00500", "k02005", "", 0, numberedKeys(500, 2005)},
+		{"range and limit", "k00500", "k02005", "", 1200, numberedKeys(500, 1700)},
+		{"prefix within bounds", "a", "z", "k", 0, numberedKeys(0, n)},
+		{"bounds within prefix", "k01999", "k02003", "k", 0, numberedKeys(1999, 2003)},
+		{"start past prefix", "l", "", "k", 0, nil},
+		{"end before prefix", "", "b", "k", 0, nil},
+		{"prefix of one key", "", "", "k00001", 0, numberedKeys(1, 2)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			it, err := c.Scan(tc.start, tc.end, tc.prefix, tc.limit, false)
+			mustOK(t, err)
+			keys, values := scanAll(t, it)
+			if len(keys) != len(tc.want) || fmt.Sprint(keys) != fmt.Sprint(tc.want) {
+				t.Fatalf("scan got %d keys, want %d: got %v, want %v", len(keys), len(tc.want), ends(keys), ends(tc.want))
+			}
+			for i, key := range keys {
+				if key[0] == 'k' && values[i] != "v"+key {
+					t.Fatalf("scan got %q=%q, want v%s", key, values[i], key)
+				}
+			}
+		})
+	}
+
+	// Keys-only scans page the same way, without the values
+	it, err := c.Scan("", "", "k", 0, true)
+	mustOK(t, err)
+	keys, values := scanAll(t, it)
+	if fmt.Sprint(keys) != fmt.Sprint(numberedKeys(0, n)) {
+		t.Fatalf("keys-only scan got %d keys, want %d", len(keys), n)
+	}
+	for i, value := range values {
+		if value != "" {
+			t.Fatalf("keys-only scan got %q=%q", keys[i], value)
+		}
+	}
+}
+
+// ends returns the first and last of keys, for short failure messages.
+func ends(keys []string) []string {
+	if len(keys) < 2 {
+		return keys
+	}
+	return []string{keys[0], keys[len(keys)-1]}
+}
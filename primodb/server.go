@@ -8,85 +8,227 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
+	"github.com/rickcollette/primodb/memtable"
 	"github.com/rickcollette/primodb/serverconfig"
 	pb "github.com/rickcollette/primodb/primodb/primodproto"
-	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
-const serverStartMsg = "PrimoDB server started."
+const (
+    serverStartMsg = "PrimoDB server started."
+    // scanBatchSize is the number of rows fetched from the memtable per
+    // page while streaming a Scan, so the store lock is never held for the
+    // whole scan.
+    scanBatchSize = 1000
+    // defaultSweepInterval is used when the config doesn't set
+    // server.sweepInterval.
+    defaultSweepInterval = time.Second
+    // defaultShutdownTimeout is used when the config doesn't set
+    // server.shutdownTimeout.
+    defaultShutdownTimeout = 30 * time.Second
+)
 
 type server struct {
     db     *Server // Use *Server instead of *database
     config *serverconfig.ServerConfig
     pb.UnimplementedPrimoDBServer
+    pb.UnimplementedPrimoDBServiceServer
+}
+
+// resultMessage renders the "<verb> <count>" message CRUD responses carry.
+func resultMessage(verb string, err error) string {
+    if err != nil {
+        return verb + " 0"
+    }
+    return verb + " 1"
 }
 
 func (s *server) Create(ctx context.Context, req *pb.CreateRequest) (*pb.CreateResponse, error) {
     log.Printf("[Client: %s] SET: %s in database: %s", req.ClientId, req.Key, req.Database)
-    value, err := s.db.Create(req.Database, req.Key, req.Value) // Updated to include database
+    cond := memtable.Condition{IfNotExists: req.IfNotExists, IfVersion: req.IfVersion}
+    row, err := s.db.CreateIf(req.Database, req.Key, req.Value, time.Duration(req.TtlSeconds)*time.Second, cond)
     respMsg := ""
     if err != nil {
         respMsg = err.Error()
     }
-    return &pb.CreateResponse{Message: value, RespMsg: respMsg, StatusCode: 201}, nil
+    return &pb.CreateResponse{Message: resultMessage("Inserted", err), RespMsg: respMsg, StatusCode: 201, Version: row.Version}, nil
 }
 
 func (s *server) Read(ctx context.Context, req *pb.ReadRequest) (*pb.ReadResponse, error) {
     log.Printf("[Client: %s] GET: %s in database: %s", req.ClientId, req.Key, req.Database)
-    value, err := s.db.Read(req.Database, req.Key) // Updated to include database
+    row, err := s.db.ReadRow(req.Database, req.Key) // Updated to include database
     respMsg := ""
     if err != nil {
         respMsg = err.Error()
     }
-    return &pb.ReadResponse{Value: value, RespMsg: respMsg, StatusCode: 200}, nil
+    return &pb.ReadResponse{Value: row.Value, RespMsg: respMsg, StatusCode: 200, Version: row.Version}, nil
 }
 
 func (s *server) Update(ctx context.Context, req *pb.UpdateRequest) (*pb.UpdateResponse, error) {
     log.Printf("[Client: %s] UPDATE: %s in database: %s", req.ClientId, req.Key, req.Database)
-    value, err := s.db.Update(req.Database, req.Key, req.Value) // Updated to include database
+    cond := memtable.Condition{IfVersion: req.IfVersion}
+    row, err := s.db.UpdateIf(req.Database, req.Key, req.Value, time.Duration(req.TtlSeconds)*time.Second, cond)
     respMsg := ""
     if err != nil {
         respMsg = err.Error()
     }
-    return &pb.UpdateResponse{Message: value, RespMsg: respMsg, StatusCode: 200}, nil
+    return &pb.UpdateResponse{Message: resultMessage("Updated", err), RespMsg: respMsg, StatusCode: 200, Version: row.Version}, nil
 }
 
 func (s *server) Delete(ctx context.Context, req *pb.DeleteRequest) (*pb.DeleteResponse, error) {
     log.Printf("[Client: %s] DEL: %s in database: %s", req.ClientId, req.Key, req.Database)
-    value, err := s.db.Delete(req.Database, req.Key) // Updated to include database
+    err := s.db.DeleteIf(req.Database, req.Key, memtable.Condition{IfVersion: req.IfVersion})
+    respMsg := ""
+    if err != nil {
+        respMsg = err.Error()
+    }
+    return &pb.DeleteResponse{Message: resultMessage("Deleted", err), RespMsg: respMsg, StatusCode: 204}, nil
+}
+
+func (s *server) CompareAndSwap(ctx context.Context, req *pb.CompareAndSwapRequest) (*pb.CompareAndSwapResponse, error) {
+    log.Printf("[Client: %s] CAS: %s@%d in database: %s", req.ClientId, req.Key, req.ExpectedVersion, req.Database)
+    row, err := s.db.CompareAndSwap(req.Database, req.Key, req.ExpectedVersion, req.Value)
     respMsg := ""
     if err != nil {
         respMsg = err.Error()
     }
-    return &pb.DeleteResponse{Message: value, RespMsg: respMsg, StatusCode: 204}, nil
+    return &pb.CompareAndSwapResponse{Swapped: err == nil, Version: row.Version, RespMsg: respMsg, StatusCode: 200}, nil
+}
+
+func (s *server) Txn(ctx context.Context, req *pb.TxnRequest) (*pb.TxnResponse, error) {
+    log.Printf("[Client: %s] TXN: %d conditions, %d ops in database: %s", req.ClientId, len(req.Conditions), len(req.Ops), req.Database)
+    conds := make([]TxnCondition, 0, len(req.Conditions))
+    for _, c := range req.Conditions {
+        conds = append(conds, TxnCondition{Key: c.Key, Condition: memtable.Condition{IfNotExists: c.IfNotExists, IfVersion: c.IfVersion}})
+    }
+    ops := make([]TxnOp, 0, len(req.Ops))
+    for _, op := range req.Ops {
+        ops = append(ops, TxnOp{
+            Delete: op.Type == pb.TxnOp_DELETE,
+            Key:    op.Key,
+            Value:  op.Value,
+            TTL:    time.Duration(op.TtlSeconds) * time.Second,
+        })
+    }
+
+    rows, err := s.db.Txn(req.Database, conds, ops)
+    if err != nil {
+        return &pb.TxnResponse{Succeeded: false, RespMsg: err.Error(), StatusCode: 200}, nil
+    }
+    versions := make([]int64, len(rows))
+    for i, row := range rows {
+        versions[i] = row.Version
+    }
+    return &pb.TxnResponse{Succeeded: true, Versions: versions, StatusCode: 200}, nil
 }
 
-func cleanup(db *Server) { // Change parameter type to *Server
-    if db != nil && db.walObj != nil {
-        db.walObj.Close()
+func (s *server) Watch(req *pb.WatchRequest, stream pb.PrimoDB_WatchServer) error {
+    log.Printf("[Client: %s] WATCH: key %q prefix %q from seq %d in database: %s", req.ClientId, req.Key, req.Prefix, req.StartSeq, req.Database)
+    w, err := s.db.Watch(req.Database, req.Key, req.Prefix, req.StartSeq)
+    if err == ErrWatchCompacted {
+        return status.Error(codes.OutOfRange, err.Error())
+    } else if err == ErrWatchClosed {
+        return status.Error(codes.Unavailable, err.Error())
+    } else if err != nil {
+        return err
+    }
+    defer w.Cancel()
+
+    for {
+        select {
+        case <-stream.Context().Done():
+            return stream.Context().Err()
+        case ev, ok := <-w.C:
+            if !ok {
+                if err := w.Err(); err == ErrWatchClosed {
+                    return status.Error(codes.Unavailable, err.Error())
+                } else if err != nil {
+                    return status.Error(codes.Aborted, err.Error())
+                }
+                return nil
+            }
+            if err := stream.Send(&pb.WatchEvent{
+                Type:     pb.WatchEvent_Type(pb.WatchEvent_Type_value[ev.Type]),
+                Seq:      ev.Seq,
+                Key:      ev.Key,
+                OldValue: ev.OldValue,
+                NewValue: ev.NewValue,
+                Version:  ev.Version,
+            }); err != nil {
+                return err
+            }
+        }
     }
 }
 
-func Run() {
+func (s *server) Checkpoint(ctx context.Context, req *pb.CheckpointRequest) (*pb.CheckpointResponse, error) {
+    log.Printf("[Client: %s] CHECKPOINT", req.ClientId)
+    seq, path, err := s.db.Checkpoint()
+    if err != nil {
+        return &pb.CheckpointResponse{Seq: seq, Path: path, RespMsg: err.Error(), StatusCode: 500}, nil
+    }
+    return &pb.CheckpointResponse{Seq: seq, Path: path, StatusCode: 200}, nil
+}
+
+func (s *server) Scan(req *pb.ScanRequest, stream pb.PrimoDB_ScanServer) error {
+    log.Printf("[Client: %s] SCAN: [%q, %q) prefix %q in database: %s", req.ClientId, req.StartKey, req.EndKey, req.Prefix, req.Database)
+    start, end := req.StartKey, req.EndKey
+    if req.Prefix != "" {
+        if start < req.Prefix {
+            start = req.Prefix
+        }
+        if prefixEnd := memtable.PrefixEnd(req.Prefix); prefixEnd != "" && (end == "" || prefixEnd < end) {
+            end = prefixEnd
+        }
+    }
+
+    sent := 0
+    for {
+        batch := scanBatchSize
+        if req.Limit > 0 && int(req.Limit)-sent < batch {
+            batch = int(req.Limit) - sent
+        }
+        if batch <= 0 {
+            return nil
+        }
+        rows := s.db.Scan(req.Database, start, end, batch)
+        for _, row := range rows {
+            resp := &pb.ScanResponse{Key: row.Key}
+            if !req.KeysOnly {
+                resp.Value = row.Value
+            }
+            if err := stream.Send(resp); err != nil {
+                return err
+            }
+        }
+        sent += len(rows)
+        if len(rows) < batch {
+            return nil
+        }
+        // Resume right after the last key we sent.
+        start = rows[len(rows)-1].Key + "\x00"
+    }
+}
+
+// Run starts the server, recovering up to target first.
+func Run(target RecoveryTarget) {
     cfg := serverconfig.Config("server").(*serverconfig.ServerConfig)
 
-    var db *Server // Change type to *Server
-    if cfg.Wal.UseS3 {
-        db = NewServer(cfg.Wal.Datadir, true, cfg.Wal.S3Config) // Use NewServer instead of NewDb
-    } else {
-        db = NewServer(cfg.Wal.Datadir, false, serverconfig.S3Config{}) // Use NewServer instead of NewDb
+    db := NewServerUntil(cfg.Wal, target)
+    if err := db.bootstrapFromConfig(cfg.Auth); err != nil {
+        log.Fatalf("Failed to create the admin user: %v", err)
     }
-    defer cleanup(db)
 
+    sweepInterval := cfg.Server.SweepInterval * time.Second
+    if sweepInterval <= 0 {
+        sweepInterval = defaultSweepInterval
+    }
+    db.StartExpirySweeper(sweepInterval)
+    db.StartCheckpointer(cfg.Wal.CheckpointInterval * time.Second)
 
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-	go func() {
-		<-c
-		fmt.Println("\nShutting down server...")
-		os.Exit(0)
-	}()
 
 	addr := fmt.Sprintf("%s:%d", cfg.Server.Host, cfg.Server.Port)
 	lis, err := net.Listen("tcp", addr)
@@ -94,8 +236,49 @@ func Run() {
 		log.Fatalf("Failed to listen: %v", err)
 	}
 
-	s := grpc.NewServer()
-	pb.RegisterPrimoDBServer(s, &server{db: db, config: cfg})
+	shutdownTimeout := cfg.Server.ShutdownTimeout * time.Second
+	if shutdownTimeout <= 0 {
+		shutdownTimeout = defaultShutdownTimeout
+	}
+	stopped := make(chan struct{})
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-c
+		fmt.Printf("\nReceived %s, shutting down server...\n", sig)
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := db.Shutdown(ctx); err != nil {
+			log.Printf("Shutdown: %v", err)
+		}
+		close(stopped)
+	}()
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := db.ReloadTLS(); err != nil {
+				log.Printf("Failed to reload TLS certificates, keeping the old ones: %v", err)
+			} else if cfg.TLS.CertFile != "" {
+				log.Println("Reloaded TLS certificates")
+			}
+		}
+	}()
+
 	fmt.Printf("*************\n%s\n*************\n", serverStartMsg)
-	log.Fatal(s.Serve(lis))
+	if err := db.Serve(lis, cfg); err != nil {
+		log.Fatalf("Failed to serve: %v", err)
+	}
+	<-stopped
+	fmt.Println("Server stopped.")
+}
+
+// RunRestore implements `primod restore`: it rebuilds the empty data
+// directory from the configured WAL archive, up to target, and exits.
+func RunRestore(target RecoveryTarget) {
+	cfg := serverconfig.Config("server").(*serverconfig.ServerConfig)
+	if err := Restore(cfg.Wal, target); err != nil {
+		log.Fatalf("Restore failed: %s", err)
+	}
+	fmt.Println("Restore finished.")
 }
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync/atomic"
+
+	"github.com/rickcollette/primodb/serverconfig"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+// tlsReloader hands connections the certificate and client CAs last loaded
+// from the files in cfg, so they can be replaced without a restart.
+type tlsReloader struct {
+	cfg     serverconfig.TLSConfig
+	current atomic.Pointer[tls.Config]
+}
+
+func newTLSReloader(cfg serverconfig.TLSConfig) (*tlsReloader, error) {
+	if cfg.KeyFile == "" {
+		return nil, fmt.Errorf("tls.certFile needs tls.keyFile")
+	}
+	if cfg.RequireClientCert && cfg.ClientCAFile == "" {
+		return nil, fmt.Errorf("tls.requireClientCert needs tls.clientCAFile")
+	}
+	r := &tlsReloader{cfg: cfg}
+	return r, r.reload()
+}
+
+// reload reads the files again. On error, the previous certificates stay in
+// use.
+func (r *tlsReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(r.cfg.CertFile, r.cfg.KeyFile)
+	if err != nil {
+		return err
+	}
+	conf := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   []string{"h2"},
+	}
+	if r.cfg.ClientCAFile != "" {
+		data, err := os.ReadFile(r.cfg.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		conf.ClientCAs = x509.NewCertPool()
+		if !conf.ClientCAs.AppendCertsFromPEM(data) {
+			return fmt.Errorf("%s: no PEM certificates", r.cfg.ClientCAFile)
+		}
+		conf.ClientAuth = tls.VerifyClientCertIfGiven
+		if r.cfg.RequireClientCert {
+			conf.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	r.current.Store(conf)
+	return nil
+}
+
+// credentials returns the transport credentials of a gRPC server using the
+// reloader's certificates.
+func (r *tlsReloader) credentials() credentials.TransportCredentials {
+	return credentials.NewTLS(&tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return r.current.Load(), nil
+		},
+	})
+}
+
+// ReloadTLS reads the TLS certificate, key and client CAs again, for new
+// connections; primod does it on SIGHUP. It does nothing without TLS.
+func (s *Server) ReloadTLS() error {
+	s.lifecycleMu.Lock()
+	certs := s.tlsCerts
+	s.lifecycleMu.Unlock()
+	if certs == nil {
+		return nil
+	}
+	return certs.reload()
+}
+
+// certUsername returns the common name of the verified client certificate
+// of the connection ctx belongs to, if it has one.
+func certUsername(ctx context.Context) (string, bool) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return "", false
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.VerifiedChains) == 0 || len(info.State.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+	name := info.State.VerifiedChains[0][0].Subject.CommonName
+	return name, name != ""
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/rickcollette/primodb/client"
+	"github.com/rickcollette/primodb/clientconfig"
+	"github.com/rickcollette/primodb/serverconfig"
+)
+
+// testCA issues certificates for the TLS tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	dir  string
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	mustOK(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "primodb test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	mustOK(t, err)
+	cert, err := x509.ParseCertificate(der)
+	mustOK(t, err)
+	ca := &testCA{cert: cert, key: key, dir: t.TempDir()}
+	writePEM(t, ca.path("ca.pem"), "CERTIFICATE", der)
+	return ca
+}
+
+func (ca *testCA) path(name string) string {
+	return filepath.Join(ca.dir, name)
+}
+
+// issue writes a certificate for commonName, and its key, to
+// <name>.pem and <name>.key. Server certificates are for 127.0.0.1.
+func (ca *testCA) issue(t *testing.T, name, commonName string, serial int64, server bool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	mustOK(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if server {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		tmpl.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1)}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	mustOK(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	mustOK(t, err)
+	writePEM(t, ca.path(name+".pem"), "CERTIFICATE", der)
+	writePEM(t, ca.path(name+".key"), "EC PRIVATE KEY", keyDER)
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	t.Helper()
+	mustOK(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600))
+}
+
+// serveTLS starts a server with TLS and client certificate login, and a
+// user alice who can read and write the default database.
+func serveTLS(t *testing.T, ca *testCA) (*Server, int) {
+	t.Helper()
+	s := NewServer(serverconfig.WalConfig{Datadir: t.TempDir()})
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+	mustOK(t, s.CreateUser("alice", "secret"))
+	mustOK(t, s.GrantRole("alice", "", RoleReadWrite))
+
+	cfg := &serverconfig.ServerConfig{}
+	cfg.Auth.SecretKey = "test key"
+	cfg.TLS = serverconfig.TLSConfig{
+		CertFile:     ca.path("server.pem"),
+		KeyFile:      ca.path("server.key"),
+		ClientCAFile: ca.path("ca.pem"),
+	}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	mustOK(t, err)
+	go s.Serve(lis, cfg)
+	return s, lis.Addr().(*net.TCPAddr).Port
+}
+
+func connect(port int, tlsConfig clientconfig.TLSConfig, username, password string) (*client.PrimoDBClient, error) {
+	cfg := &clientconfig.ClientConfig{TLS: tlsConfig}
+	cfg.Server.Timeout = 5
+	return client.NewClient("127.0.0.1", port, "", 5*time.Second, cfg, username, password)
+}
+
+func TestTLS(t *testing.T) {
+	ca := newTestCA(t)
+	ca.issue(t, "server", "server", 2, true)
+	ca.issue(t, "alice", "alice", 3, false)
+	s, port := serveTLS(t, ca)
+
+	t.Run("password login", func(t *testing.T) {
+		c, err := connect(port, clientconfig.TLSConfig{CAFile: ca.path("ca.pem")}, "alice", "secret")
+		mustOK(t, err)
+		_, err = c.Create("k", "v")
+		mustOK(t, err)
+	})
+
+	t.Run("plaintext rejected", func(t *testing.T) {
+		if _, err := connect(port, clientconfig.TLSConfig{}, "alice", "secret"); err == nil {
+			t.Fatal("plaintext client logged in to a TLS server")
+		}
+	})
+
+	t.Run("certificate login", func(t *testing.T) {
+		tlsConfig := clientconfig.TLSConfig{
+			CAFile:   ca.path("ca.pem"),
+			CertFile: ca.path("alice.pem"),
+			KeyFile:  ca.path("alice.key"),
+		}
+		c, err := connect(port, tlsConfig, "", "")
+		mustOK(t, err)
+		claims := jwt.MapClaims{}
+		if _, _, err := new(jwt.Parser).ParseUnverified(c.Token, claims); err != nil {
+			t.Fatal(err)
+		}
+		if claims["sub"] != "alice" {
+			t.Fatalf("certificate login got token for %v, want alice", claims["sub"])
+		}
+
+		// Without a certificate an empty password is no login
+		if _, err := connect(port, clientconfig.TLSConfig{CAFile: ca.path("ca.pem")}, "alice", ""); err == nil {
+			t.Fatal("empty password without a client certificate logged in")
+		}
+	})
+
+	t.Run("reload", func(t *testing.T) {
+		ca.issue(t, "server", "server", 4, true)
+		mustOK(t, s.ReloadTLS())
+
+		roots := x509.NewCertPool()
+		roots.AddCert(ca.cert)
+		conn, err := tls.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port), &tls.Config{RootCAs: roots})
+		mustOK(t, err)
+		defer conn.Close()
+		if serial := conn.ConnectionState().PeerCertificates[0].SerialNumber; serial.Int64() != 4 {
+			t.Fatalf("server still uses certificate %v after reload, want 4", serial)
+		}
+	})
+}
@@ -0,0 +1,287 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/rickcollette/primodb/serverconfig"
+)
+
+const (
+	// defaultKid names the key of secretKey, and is the key tokens without
+	// a kid, issued before keys had one, are checked with.
+	defaultKid = "default"
+	// defaultTokenLifetime is used when the config doesn't set
+	// auth.tokenLifetime.
+	defaultTokenLifetime = 24 * time.Hour
+)
+
+// ErrUnknownKid is returned for tokens signed with a key the server doesn't
+// have, such as one rotated out.
+var ErrUnknownKid = errors.New("unknown signing key")
+
+// tokenKey is a key that verifies tokens, and signs them if signKey is set.
+type tokenKey struct {
+	kid       string
+	method    jwt.SigningMethod
+	signKey   interface{}
+	verifyKey interface{}
+}
+
+// keyRing holds the keys tokens are signed and verified with.
+type keyRing struct {
+	keys     map[string]*tokenKey
+	signing  *tokenKey
+	lifetime time.Duration
+}
+
+// tokenKeys is the key ring Serve sets up from the auth config.
+var tokenKeys atomic.Pointer[keyRing]
+
+// configureAuth sets up tokenKeys from cfg, with a random HS256 key if cfg
+// has none.
+func configureAuth(cfg serverconfig.AuthConfig) error {
+	ring, err := newKeyRing(cfg)
+	if err != nil {
+		return err
+	}
+	tokenKeys.Store(ring)
+	return nil
+}
+
+func newKeyRing(cfg serverconfig.AuthConfig) (*keyRing, error) {
+	ring := &keyRing{keys: map[string]*tokenKey{}, lifetime: cfg.TokenLifetime * time.Second}
+	if ring.lifetime <= 0 {
+		ring.lifetime = defaultTokenLifetime
+	}
+
+	keyConfigs := cfg.Keys
+	if len(keyConfigs) == 0 {
+		secret, err := configSecret(cfg.SecretKey, cfg.SecretKeyFile, "secretKey")
+		if err != nil {
+			return nil, err
+		}
+		if secret == "" {
+			log.Println("No auth keys configured, using a random one; tokens won't survive a restart")
+			random := make([]byte, 32)
+			if _, err := rand.Read(random); err != nil {
+				return nil, err
+			}
+			secret = string(random)
+		}
+		keyConfigs = []serverconfig.TokenKeyConfig{{Kid: defaultKid, Secret: secret}}
+	} else if cfg.SecretKey != "" || cfg.SecretKeyFile != "" {
+		return nil, fmt.Errorf("set auth keys or secretKey, not both")
+	}
+
+	for _, kc := range keyConfigs {
+		key, err := loadTokenKey(kc)
+		if err != nil {
+			return nil, fmt.Errorf("auth key %q: %w", kc.Kid, err)
+		}
+		if ring.keys[key.kid] != nil {
+			return nil, fmt.Errorf("auth key %q: duplicate kid", key.kid)
+		}
+		ring.keys[key.kid] = key
+		if ring.signing == nil && key.signKey != nil && cfg.SigningKey == "" {
+			ring.signing = key
+		}
+	}
+	if cfg.SigningKey != "" {
+		ring.signing = ring.keys[cfg.SigningKey]
+		if ring.signing == nil || ring.signing.signKey == nil {
+			return nil, fmt.Errorf("auth signingKey %q isn't a key that can sign", cfg.SigningKey)
+		}
+	}
+	if ring.signing == nil {
+		return nil, fmt.Errorf("no auth key can sign tokens")
+	}
+	return ring, nil
+}
+
+// configSecret returns a secret given in the config either directly or as
+// the path of a file holding it.
+func configSecret(value, file, name string) (string, error) {
+	if file == "" {
+		return value, nil
+	}
+	if value != "" {
+		return "", fmt.Errorf("set only one of %s and %sFile", name, name)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func loadTokenKey(kc serverconfig.TokenKeyConfig) (*tokenKey, error) {
+	if kc.Kid == "" {
+		return nil, fmt.Errorf("missing kid")
+	}
+	key := &tokenKey{kid: kc.Kid}
+	switch kc.Algorithm {
+	case "", jwt.SigningMethodHS256.Alg():
+		secret, err := configSecret(kc.Secret, kc.SecretFile, "secret")
+		if err != nil {
+			return nil, err
+		}
+		if secret == "" {
+			return nil, fmt.Errorf("HS256 needs secret or secretFile")
+		}
+		key.method = jwt.SigningMethodHS256
+		key.signKey, key.verifyKey = []byte(secret), []byte(secret)
+	case jwt.SigningMethodRS256.Alg():
+		key.method = jwt.SigningMethodRS256
+		if kc.PrivateKeyFile != "" {
+			data, err := os.ReadFile(kc.PrivateKeyFile)
+			if err != nil {
+				return nil, err
+			}
+			private, err := jwt.ParseRSAPrivateKeyFromPEM(data)
+			if err != nil {
+				return nil, err
+			}
+			key.signKey, key.verifyKey = private, &private.PublicKey
+		}
+		if kc.PublicKeyFile != "" {
+			data, err := os.ReadFile(kc.PublicKeyFile)
+			if err != nil {
+				return nil, err
+			}
+			if key.verifyKey, err = jwt.ParseRSAPublicKeyFromPEM(data); err != nil {
+				return nil, err
+			}
+		}
+	case signingMethodEdDSA.Alg():
+		key.method = signingMethodEdDSA
+		if kc.PrivateKeyFile != "" {
+			private, err := readEd25519Key(kc.PrivateKeyFile, true)
+			if err != nil {
+				return nil, err
+			}
+			key.signKey, key.verifyKey = private, private.(ed25519.PrivateKey).Public()
+		}
+		if kc.PublicKeyFile != "" {
+			public, err := readEd25519Key(kc.PublicKeyFile, false)
+			if err != nil {
+				return nil, err
+			}
+			key.verifyKey = public
+		}
+	default:
+		return nil, fmt.Errorf("unknown algorithm %q, use HS256, RS256 or EdDSA", kc.Algorithm)
+	}
+	if key.verifyKey == nil {
+		return nil, fmt.Errorf("%s needs privateKeyFile or publicKeyFile", key.method.Alg())
+	}
+	return key, nil
+}
+
+// readEd25519Key reads a PEM PKCS #8 private key, or PKIX public key.
+func readEd25519Key(path string, private bool) (interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", path)
+	}
+	var key interface{}
+	if private {
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	} else {
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	switch key.(type) {
+	case ed25519.PrivateKey, ed25519.PublicKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("%s: not an Ed25519 key", path)
+}
+
+// issue returns a token for username with roles, signed with the signing
+// key, and its expiry.
+func (r *keyRing) issue(username string, roles Roles) (string, time.Time, error) {
+	now := time.Now()
+	expiresAt := now.Add(r.lifetime)
+	token := jwt.NewWithClaims(r.signing.method, jwt.MapClaims{
+		"iat":   now.Unix(),
+		"exp":   expiresAt.Unix(),
+		"sub":   username,
+		"roles": roles,
+	})
+	token.Header["kid"] = r.signing.kid
+	signed, err := token.SignedString(r.signing.signKey)
+	return signed, expiresAt, err
+}
+
+// keyFor finds the key that verifies token, by its kid, and checks the
+// token uses the key's algorithm.
+func (r *keyRing) keyFor(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		kid = defaultKid
+	}
+	key := r.keys[kid]
+	if key == nil {
+		return nil, fmt.Errorf("%w %q", ErrUnknownKid, kid)
+	}
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, fmt.Errorf("key %q is for %s, not %v", kid, key.method.Alg(), token.Header["alg"])
+	}
+	return key.verifyKey, nil
+}
+
+// signingMethodEdDSA signs tokens with Ed25519 keys, which jwt-go doesn't
+// support itself.
+var signingMethodEdDSA = &signingMethodEd25519{}
+
+type signingMethodEd25519 struct{}
+
+func init() {
+	jwt.RegisterSigningMethod(signingMethodEdDSA.Alg(), func() jwt.SigningMethod {
+		return signingMethodEdDSA
+	})
+}
+
+func (m *signingMethodEd25519) Alg() string {
+	return "EdDSA"
+}
+
+func (m *signingMethodEd25519) Sign(signingString string, key interface{}) (string, error) {
+	private, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return "", jwt.ErrInvalidKeyType
+	}
+	return jwt.EncodeSegment(ed25519.Sign(private, []byte(signingString))), nil
+}
+
+func (m *signingMethodEd25519) Verify(signingString, signature string, key interface{}) error {
+	public, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return jwt.ErrInvalidKeyType
+	}
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(public, []byte(signingString), sig) {
+		return jwt.ErrSignatureInvalid
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	pb "github.com/rickcollette/primodb/primodb/primodproto"
+	"github.com/rickcollette/primodb/serverconfig"
+	"google.golang.org/grpc/codes"
+)
+
+// useKeys makes tokenKeys the key ring of cfg for the rest of the test.
+func useKeys(t *testing.T, cfg serverconfig.AuthConfig) *keyRing {
+	t.Helper()
+	ring, err := newKeyRing(cfg)
+	mustOK(t, err)
+	old := tokenKeys.Swap(ring)
+	t.Cleanup(func() { tokenKeys.Store(old) })
+	return ring
+}
+
+// issueWith issues a token for alice with the signing key of cfg.
+func issueWith(t *testing.T, cfg serverconfig.AuthConfig) string {
+	t.Helper()
+	ring, err := newKeyRing(cfg)
+	mustOK(t, err)
+	token, _, err := ring.issue("alice", Roles{"": RoleReadWrite})
+	mustOK(t, err)
+	return token
+}
+
+// checkRejected fails t unless verifyToken rejects token with an error
+// mentioning reason.
+func checkRejected(t *testing.T, token, reason string) {
+	t.Helper()
+	_, err := verifyToken(token)
+	if err == nil {
+		t.Fatalf("token accepted, want it rejected for %s", reason)
+	}
+	if !strings.Contains(err.Error(), reason) {
+		t.Fatalf("token rejected with %v, want %s", err, reason)
+	}
+}
+
+// writeEd25519Key writes a new Ed25519 key pair to <name>.key and
+// <name>.pub in dir.
+func writeEd25519Key(t *testing.T, dir, name string) (privateFile, publicFile string) {
+	t.Helper()
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	mustOK(t, err)
+	privateDER, err := x509.MarshalPKCS8PrivateKey(private)
+	mustOK(t, err)
+	publicDER, err := x509.MarshalPKIXPublicKey(public)
+	mustOK(t, err)
+	privateFile, publicFile = filepath.Join(dir, name+".key"), filepath.Join(dir, name+".pub")
+	writePEM(t, privateFile, "PRIVATE KEY", privateDER)
+	writePEM(t, publicFile, "PUBLIC KEY", publicDER)
+	return privateFile, publicFile
+}
+
+func TestEdDSAKey(t *testing.T) {
+	privateFile, publicFile := writeEd25519Key(t, t.TempDir(), "ed")
+	signer := serverconfig.AuthConfig{Keys: []serverconfig.TokenKeyConfig{
+		{Kid: "ed", Algorithm: "EdDSA", PrivateKeyFile: privateFile},
+	}}
+	token := issueWith(t, signer)
+	parsed, _, err := new(jwt.Parser).ParseUnverified(token, jwt.MapClaims{})
+	mustOK(t, err)
+	if parsed.Header["alg"] != "EdDSA" || parsed.Header["kid"] != "ed" {
+		t.Fatalf("token header is %v, want EdDSA key ed", parsed.Header)
+	}
+
+	// The public key alone verifies tokens, but can't sign them
+	verifier := serverconfig.AuthConfig{Keys: []serverconfig.TokenKeyConfig{
+		{Kid: "ed", Algorithm: "EdDSA", PublicKeyFile: publicFile},
+	}}
+	if _, err := newKeyRing(verifier); err == nil {
+		t.Fatal("a key ring with only a public key can sign")
+	}
+	verifier.Keys = append(verifier.Keys, serverconfig.TokenKeyConfig{Kid: "hs", Secret: testSecret})
+	useKeys(t, verifier)
+	caller, err := verifyToken(token)
+	mustOK(t, err)
+	if caller.Username != "alice" || caller.Roles.On("") != RoleReadWrite {
+		t.Fatalf("token verified as %+v, want alice with readwrite", caller)
+	}
+
+	// Another Ed25519 key doesn't verify it
+	_, otherPublic := writeEd25519Key(t, t.TempDir(), "other")
+	useKeys(t, serverconfig.AuthConfig{Keys: []serverconfig.TokenKeyConfig{
+		{Kid: "hs", Secret: testSecret},
+		{Kid: "ed", Algorithm: "EdDSA", PublicKeyFile: otherPublic},
+	}})
+	checkRejected(t, token, "signature")
+
+	// Nor does an HS256 key under its kid
+	useKeys(t, serverconfig.AuthConfig{Keys: []serverconfig.TokenKeyConfig{{Kid: "ed", Secret: testSecret}}})
+	checkRejected(t, token, "not EdDSA")
+}
+
+func TestKeyRotation(t *testing.T) {
+	oldKey := serverconfig.TokenKeyConfig{Kid: "old", Secret: "old secret"}
+	newKey := serverconfig.TokenKeyConfig{Kid: "new", Secret: "new secret"}
+	oldToken := issueWith(t, serverconfig.AuthConfig{Keys: []serverconfig.TokenKeyConfig{oldKey}})
+
+	// While both keys are configured, new tokens use the signing key and
+	// the old ones still verify
+	ring := useKeys(t, serverconfig.AuthConfig{Keys: []serverconfig.TokenKeyConfig{oldKey, newKey}, SigningKey: "new"})
+	if ring.signing.kid != "new" {
+		t.Fatalf("signing with %q, want new", ring.signing.kid)
+	}
+	_, err := verifyToken(oldToken)
+	mustOK(t, err)
+	newToken, _, err := ring.issue("alice", nil)
+	mustOK(t, err)
+	_, err = verifyToken(newToken)
+	mustOK(t, err)
+
+	// Once the old key is removed its tokens are rejected
+	useKeys(t, serverconfig.AuthConfig{Keys: []serverconfig.TokenKeyConfig{newKey}})
+	checkRejected(t, oldToken, ErrUnknownKid.Error())
+	_, err = verifyToken(newToken)
+	mustOK(t, err)
+
+	// A token without a kid is checked with the default key, which only
+	// secretKey configures
+	noKid := signToken(t, aliceClaims(time.Now().Add(time.Hour)), "", "new secret")
+	checkRejected(t, noKid, ErrUnknownKid.Error()+` "default"`)
+	useKeys(t, serverconfig.AuthConfig{SecretKey: "new secret"})
+	_, err = verifyToken(noKid)
+	mustOK(t, err)
+	checkRejected(t, signToken(t, aliceClaims(time.Now().Add(time.Hour)), "gone", "new secret"), ErrUnknownKid.Error())
+}
+
+func TestTokenClaims(t *testing.T) {
+	useKeys(t, serverconfig.AuthConfig{SecretKey: testSecret})
+	_, err := verifyToken(signToken(t, aliceClaims(time.Now().Add(time.Hour)), defaultKid, testSecret))
+	mustOK(t, err)
+
+	noExpiry := aliceClaims(time.Now())
+	delete(noExpiry, "exp")
+	checkRejected(t, signToken(t, noExpiry, defaultKid, testSecret), "no expiry")
+	checkRejected(t, signToken(t, aliceClaims(time.Now().Add(-time.Minute)), defaultKid, testSecret), "expired")
+	badRole := aliceClaims(time.Now().Add(time.Hour))
+	badRole["roles"] = map[string]interface{}{"": "owner"}
+	checkRejected(t, signToken(t, badRole, defaultKid, testSecret), "unknown role")
+}
+
+func TestRefreshToken(t *testing.T) {
+	oldKey := serverconfig.TokenKeyConfig{Kid: "old", Secret: "old secret"}
+	cfg := &serverconfig.ServerConfig{}
+	cfg.Auth.Keys = []serverconfig.TokenKeyConfig{oldKey}
+	s, conn := serveAuth(t, cfg)
+	users := pb.NewPrimoDBServiceClient(conn)
+	token := login(t, conn, "alice", "secret")
+
+	// Rotate the signing key and grant a role after alice logged in
+	newKey := serverconfig.TokenKeyConfig{Kid: "new", Secret: "new secret"}
+	useKeys(t, serverconfig.AuthConfig{Keys: []serverconfig.TokenKeyConfig{newKey, oldKey}})
+	mustOK(t, s.GrantRole("alice", "orders", RoleReadOnly))
+
+	resp, err := users.RefreshToken(withToken(token), &pb.RefreshTokenRequest{})
+	mustOK(t, err)
+	if !resp.Authenticated || resp.ExpiresAt <= time.Now().Unix() {
+		t.Fatalf("refresh got %+v, want a token that hasn't expired", resp)
+	}
+	parsed, _, err := new(jwt.Parser).ParseUnverified(resp.Token, jwt.MapClaims{})
+	mustOK(t, err)
+	if parsed.Header["kid"] != "new" {
+		t.Fatalf("refreshed token signed with %v, want new", parsed.Header["kid"])
+	}
+	caller, err := verifyToken(resp.Token)
+	mustOK(t, err)
+	if caller.Roles.On("orders") != RoleReadOnly {
+		t.Fatalf("refreshed token has roles %v, want the role granted since login", caller.Roles)
+	}
+
+	_, err = users.RefreshToken(context.Background(), &pb.RefreshTokenRequest{})
+	checkCode(t, err, codes.Unauthenticated)
+	expired := signToken(t, aliceClaims(time.Now().Add(-time.Minute)), "new", "new secret")
+	_, err = users.RefreshToken(withToken(expired), &pb.RefreshTokenRequest{})
+	checkCode(t, err, codes.Unauthenticated)
+
+	// Deleted users can't refresh the tokens they still hold
+	mustOK(t, s.DeleteUser("alice"))
+	_, err = users.RefreshToken(withToken(resp.Token), &pb.RefreshTokenRequest{})
+	checkCode(t, err, codes.Unauthenticated)
+}
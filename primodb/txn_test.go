@@ -0,0 +1,89 @@
+package server
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	pb "github.com/rickcollette/primodb/primodb/primodproto"
+)
+
+// checkNotApplied fails unless resp reports a rejected transaction that left
+// nothing behind: s must still hold want, with nothing logged after seq.
+func checkNotApplied(t *testing.T, resp *pb.TxnResponse, s *Server, want map[string][]string, seq int64) {
+	t.Helper()
+	if resp.Succeeded {
+		t.Fatalf("transaction applied, want it rejected")
+	}
+	checkReplayed(t, want, s)
+	if last := s.walObj.LastSeq(); last != seq {
+		t.Fatalf("rejected transaction logged records up to seq %d, want none after %d", last, seq)
+	}
+}
+
+func TestTxn(t *testing.T) {
+	s, conn := serveAuth(t, nil)
+	db := pb.NewPrimoDBClient(conn)
+	ctx := withToken(login(t, conn, "alice", "secret"))
+	_, err := s.Create("", "a", "1")
+	mustOK(t, err)
+	a, err := s.ReadRow("", "a")
+	mustOK(t, err)
+	before := dumpDatabases(s)
+	seq := s.walObj.LastSeq()
+
+	// A condition that fails, even after others that hold, keeps every op
+	// from applying
+	ops := []*pb.TxnOp{
+		{Key: "b", Value: "2"},
+		{Type: pb.TxnOp_DELETE, Key: "a"},
+	}
+	for _, conds := range [][]*pb.TxnCondition{
+		{{Key: "a", IfNotExists: true}},
+		{{Key: "a", IfVersion: a.Version + 1}},
+		{{Key: "a", IfVersion: a.Version}, {Key: "missing", IfVersion: 1}},
+		{{Key: "b", IfNotExists: true}, {Key: "a", IfNotExists: true}},
+	} {
+		resp, err := db.Txn(ctx, &pb.TxnRequest{Conditions: conds, Ops: ops})
+		mustOK(t, err)
+		if !strings.Contains(resp.RespMsg, "condition") {
+			t.Fatalf("rejected transaction reports %q, want the failed condition", resp.RespMsg)
+		}
+		checkNotApplied(t, resp, s, before, seq)
+	}
+
+	resp, err := db.Txn(ctx, &pb.TxnRequest{
+		Conditions: []*pb.TxnCondition{{Key: "a", IfVersion: a.Version}, {Key: "b", IfNotExists: true}},
+		Ops: []*pb.TxnOp{
+			{Key: "b", Value: "2"},
+			{Key: "c", Value: "3", TtlSeconds: 3600},
+			{Type: pb.TxnOp_DELETE, Key: "a"},
+			{Key: "b", Value: "4"},
+		},
+	})
+	mustOK(t, err)
+	if !resp.Succeeded || len(resp.Versions) != 4 || resp.Versions[2] != 0 || resp.Versions[3] <= resp.Versions[0] {
+		t.Fatalf("transaction got %+v, want it applied with a version per put", resp)
+	}
+	if v, err := s.Read("", "b"); err != nil || v != "4" {
+		t.Fatalf("b reads %q, %v after the transaction, want its last put", v, err)
+	}
+	if last := s.walObj.LastSeq(); last != seq+1 {
+		t.Fatalf("transaction logged records up to seq %d, want one record at %d", last, seq+1)
+	}
+	want := dumpDatabases(s)
+
+	// Recovery replays all of it, or with a target before its record none
+	// of it
+	cfg := s.walConfig
+	s = restart(t, s, cfg)
+	checkReplayed(t, want, s)
+	s = restartUntil(t, s, cfg, RecoveryTarget{Seq: seq})
+	checkReplayed(t, before, s)
+
+	// An op that can't be logged keeps the whole transaction from applying
+	mustOK(t, s.walObj.Close())
+	resp, err = (&server{db: s}).Txn(context.Background(), &pb.TxnRequest{Ops: ops})
+	mustOK(t, err)
+	checkNotApplied(t, resp, s, before, seq)
+}
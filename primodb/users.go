@@ -0,0 +1,229 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/rickcollette/primodb/memtable"
+	pb "github.com/rickcollette/primodb/primodb/primodproto"
+	"github.com/rickcollette/primodb/serverconfig"
+	"golang.org/x/crypto/bcrypt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// usersDatabase holds the accounts clients authenticate as, one key per
+	// user holding the bcrypt hash of the password.
+	usersDatabase = "users"
+	userKeyPrefix = "user:"
+)
+
+var (
+	// ErrUserExists is returned when creating a user that already exists.
+	ErrUserExists = errors.New("user already exists")
+	// ErrUserNotFound is returned for operations on a user that doesn't exist.
+	ErrUserNotFound = errors.New("user not found")
+	// ErrInvalidUser is returned for an empty username or password, or a
+	// username with whitespace or a colon in it.
+	ErrInvalidUser = errors.New("invalid username or password")
+	// ErrWrongPassword is returned when the old password given to
+	// ChangePassword, or the password given to BootstrapAdmin for an
+	// existing user, doesn't match.
+	ErrWrongPassword = errors.New("wrong password")
+)
+
+func validUser(username, password string) error {
+	if username == "" || password == "" || strings.ContainsAny(username, " \t\r\n:") {
+		return ErrInvalidUser
+	}
+	return nil
+}
+
+func hashPassword(password string) (string, error) {
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hashed), err
+}
+
+// CreateUser adds a user. Users are stored like any other key, so they go
+// through the WAL and survive a restart.
+func (s *Server) CreateUser(username, password string) error {
+	if err := validUser(username, password); err != nil {
+		return err
+	}
+	hashed, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	_, err = s.CreateIf(usersDatabase, userKeyPrefix+username, hashed, 0, memtable.Condition{IfNotExists: true})
+	if err == memtable.ErrKeyExists {
+		return ErrUserExists
+	}
+	return err
+}
+
+// DeleteUser removes a user and the roles granted to it. Tokens already
+// issued to the user stay valid until they expire.
+func (s *Server) DeleteUser(username string) error {
+	userKey := userKeyPrefix + username
+	row, err := s.ReadRow(usersDatabase, userKey)
+	if err == memtable.ErrKeyNotFound {
+		return ErrUserNotFound
+	} else if err != nil {
+		return err
+	}
+	ops := []TxnOp{{Delete: true, Key: userKey}}
+	for database := range s.RolesOf(username) {
+		ops = append(ops, TxnOp{Delete: true, Key: roleKey(username, database)})
+	}
+	conds := []TxnCondition{{Key: userKey, Condition: memtable.Condition{IfVersion: row.Version}}}
+	_, err = s.Txn(usersDatabase, conds, ops)
+	return userTxnError(err)
+}
+
+// SetPassword replaces the password of an existing user.
+func (s *Server) SetPassword(username, password string) error {
+	if err := validUser(username, password); err != nil {
+		return err
+	}
+	row, err := s.ReadRow(usersDatabase, userKeyPrefix+username)
+	if err == memtable.ErrKeyNotFound {
+		return ErrUserNotFound
+	} else if err != nil {
+		return err
+	}
+	hashed, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	// Fails if the user was deleted or changed in the meantime
+	_, err = s.UpdateIf(usersDatabase, userKeyPrefix+username, hashed, 0, memtable.Condition{IfVersion: row.Version})
+	if err == memtable.ErrKeyNotFound {
+		return ErrUserNotFound
+	}
+	return err
+}
+
+// CheckPassword reports whether password is the password of username.
+func (s *Server) CheckPassword(username, password string) (bool, error) {
+	hashed, err := s.Read(usersDatabase, userKeyPrefix+username)
+	if err == memtable.ErrKeyNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hashed), []byte(password)) == nil, nil
+}
+
+// ListUsers returns the usernames in key order.
+func (s *Server) ListUsers() []string {
+	rows := s.Scan(usersDatabase, userKeyPrefix, memtable.PrefixEnd(userKeyPrefix), 0)
+	names := make([]string, 0, len(rows))
+	for _, row := range rows {
+		names = append(names, strings.TrimPrefix(row.Key, userKeyPrefix))
+	}
+	return names
+}
+
+// bootstrapFromConfig makes the admin user set in cfg, if any, an admin when
+// there is none yet, see BootstrapAdmin.
+func (s *Server) bootstrapFromConfig(cfg serverconfig.AuthConfig) error {
+	if cfg.AdminUser == "" {
+		return nil
+	}
+	password, err := configSecret(cfg.AdminPassword, cfg.AdminPasswordFile, "adminPassword")
+	if err != nil {
+		return err
+	}
+	if password == "" {
+		return fmt.Errorf("auth.adminUser needs adminPassword or adminPasswordFile")
+	}
+	_, err = s.BootstrapAdmin(cfg.AdminUser, password)
+	return err
+}
+
+// InitAdmin implements `primod init`: it makes username the first admin in
+// the data directory of walConfig, creating the user if needed, while the
+// server isn't running. It fails with ErrAdminExists if there is an admin
+// already, and with ErrWrongPassword if the user exists with another
+// password.
+func InitAdmin(walConfig serverconfig.WalConfig, username, password string) error {
+	s := NewServer(walConfig)
+	created, err := s.BootstrapAdmin(username, password)
+	if err == nil && !created {
+		err = ErrAdminExists
+	}
+	if shutdownErr := s.Shutdown(context.Background()); err == nil {
+		err = shutdownErr
+	}
+	return err
+}
+
+// userStatus maps the errors of user operations to gRPC status errors.
+func userStatus(err error) error {
+	switch err {
+	case nil:
+		return nil
+	case ErrUserExists:
+		return status.Error(codes.AlreadyExists, err.Error())
+	case ErrUserNotFound, ErrNoGrant:
+		return status.Error(codes.NotFound, err.Error())
+	case ErrInvalidUser, ErrBadRole:
+		return status.Error(codes.InvalidArgument, err.Error())
+	case ErrWrongPassword:
+		return status.Error(codes.PermissionDenied, err.Error())
+	case memtable.ErrVersionMismatch:
+		return status.Error(codes.Aborted, "user changed concurrently, try again")
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+func (s *server) CreateUser(ctx context.Context, req *pb.CreateUserRequest) (*pb.UserResponse, error) {
+	log.Printf("CREATE USER: %s", req.Username)
+	if err := s.db.CreateUser(req.Username, req.Password); err != nil {
+		return nil, userStatus(err)
+	}
+	return &pb.UserResponse{Message: "Created user " + req.Username}, nil
+}
+
+func (s *server) DeleteUser(ctx context.Context, req *pb.DeleteUserRequest) (*pb.UserResponse, error) {
+	log.Printf("DELETE USER: %s", req.Username)
+	if err := s.db.DeleteUser(req.Username); err != nil {
+		return nil, userStatus(err)
+	}
+	return &pb.UserResponse{Message: "Deleted user " + req.Username}, nil
+}
+
+// ChangePassword lets users change their own password, given the current
+// one, and admins of all databases change anyone's without it.
+func (s *server) ChangePassword(ctx context.Context, req *pb.ChangePasswordRequest) (*pb.UserResponse, error) {
+	log.Printf("CHANGE PASSWORD: %s", req.Username)
+	caller := CallerFromContext(ctx)
+	if caller == nil || !caller.Roles.IsAdmin() {
+		if caller == nil || caller.Username != req.Username {
+			return nil, status.Error(codes.PermissionDenied, "only admins can change other users' passwords")
+		}
+		ok, err := s.db.CheckPassword(req.Username, req.OldPassword)
+		if err != nil {
+			return nil, userStatus(err)
+		}
+		if !ok {
+			return nil, userStatus(ErrWrongPassword)
+		}
+	}
+	if err := s.db.SetPassword(req.Username, req.NewPassword); err != nil {
+		return nil, userStatus(err)
+	}
+	return &pb.UserResponse{Message: "Changed password of " + req.Username}, nil
+}
+
+func (s *server) ListUsers(ctx context.Context, req *pb.ListUsersRequest) (*pb.ListUsersResponse, error) {
+	resp := &pb.ListUsersResponse{Usernames: s.db.ListUsers()}
+	for _, name := range resp.Usernames {
+		resp.Users = append(resp.Users, &pb.UserInfo{Username: name, Roles: rolesToProto(s.db.RolesOf(name))})
+	}
+	return resp, nil
+}
@@ -0,0 +1,174 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	pb "github.com/rickcollette/primodb/primodb/primodproto"
+	"github.com/rickcollette/primodb/serverconfig"
+	"google.golang.org/grpc/codes"
+)
+
+func TestUserRPCs(t *testing.T) {
+	s, conn := serveAuth(t, nil)
+	created, err := s.BootstrapAdmin("root", "rootpw")
+	mustOK(t, err)
+	if !created {
+		t.Fatal("BootstrapAdmin found an admin on a new server")
+	}
+	users := pb.NewPrimoDBServiceClient(conn)
+	admin := withToken(login(t, conn, "root", "rootpw"))
+	alice := withToken(login(t, conn, "alice", "secret"))
+
+	t.Run("create", func(t *testing.T) {
+		_, err := users.CreateUser(admin, &pb.CreateUserRequest{Username: "bob", Password: "bobpw"})
+		mustOK(t, err)
+		login(t, conn, "bob", "bobpw")
+
+		_, err = users.CreateUser(admin, &pb.CreateUserRequest{Username: "bob", Password: "other"})
+		checkCode(t, err, codes.AlreadyExists)
+		_, err = users.CreateUser(admin, &pb.CreateUserRequest{Username: "b:ob", Password: "bobpw"})
+		checkCode(t, err, codes.InvalidArgument)
+		_, err = users.CreateUser(admin, &pb.CreateUserRequest{Username: "carol"})
+		checkCode(t, err, codes.InvalidArgument)
+		_, err = users.CreateUser(alice, &pb.CreateUserRequest{Username: "carol", Password: "carolpw"})
+		checkCode(t, err, codes.PermissionDenied)
+	})
+
+	t.Run("list", func(t *testing.T) {
+		resp, err := users.ListUsers(admin, &pb.ListUsersRequest{})
+		mustOK(t, err)
+		if fmt.Sprint(resp.Usernames) != "[alice bob root]" {
+			t.Fatalf("ListUsers got %v, want [alice bob root]", resp.Usernames)
+		}
+		for i, user := range resp.Users {
+			if user.Username != resp.Usernames[i] {
+				t.Fatalf("user %d is %s, want %s", i, user.Username, resp.Usernames[i])
+			}
+		}
+		if roles := rolesFromProto(resp.Users[0].Roles); fmt.Sprint(roles) != `map[:readwrite]` {
+			t.Fatalf("alice has roles %v, want readwrite on the default database", roles)
+		}
+
+		_, err = users.ListUsers(alice, &pb.ListUsersRequest{})
+		checkCode(t, err, codes.PermissionDenied)
+	})
+
+	t.Run("change password", func(t *testing.T) {
+		_, err := users.ChangePassword(alice, &pb.ChangePasswordRequest{Username: "alice", OldPassword: "wrong", NewPassword: "new"})
+		checkCode(t, err, codes.PermissionDenied)
+		_, err = users.ChangePassword(alice, &pb.ChangePasswordRequest{Username: "bob", OldPassword: "bobpw", NewPassword: "new"})
+		checkCode(t, err, codes.PermissionDenied)
+		_, err = users.ChangePassword(alice, &pb.ChangePasswordRequest{Username: "alice", OldPassword: "secret", NewPassword: "new"})
+		mustOK(t, err)
+		login(t, conn, "alice", "new")
+
+		// Admins need no old password
+		_, err = users.ChangePassword(admin, &pb.ChangePasswordRequest{Username: "alice", NewPassword: "secret"})
+		mustOK(t, err)
+		login(t, conn, "alice", "secret")
+		_, err = users.ChangePassword(admin, &pb.ChangePasswordRequest{Username: "nobody", NewPassword: "pw"})
+		checkCode(t, err, codes.NotFound)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		mustOK(t, s.GrantRole("bob", "orders", RoleReadOnly))
+		_, err := users.DeleteUser(alice, &pb.DeleteUserRequest{Username: "bob"})
+		checkCode(t, err, codes.PermissionDenied)
+		_, err = users.DeleteUser(admin, &pb.DeleteUserRequest{Username: "bob"})
+		mustOK(t, err)
+		_, err = users.Authenticate(context.Background(), &pb.AuthRequest{Username: "bob", Password: "bobpw"})
+		checkCode(t, err, codes.Unauthenticated)
+		if roles := s.RolesOf("bob"); len(roles) != 0 {
+			t.Fatalf("deleted user still has roles %v", roles)
+		}
+		_, err = users.DeleteUser(admin, &pb.DeleteUserRequest{Username: "bob"})
+		checkCode(t, err, codes.NotFound)
+	})
+}
+
+// rolesFromProto turns grants back into Roles.
+func rolesFromProto(grants []*pb.RoleGrant) Roles {
+	roles := Roles{}
+	for _, grant := range grants {
+		roles[grant.Database] = Role(grant.Role)
+	}
+	return roles
+}
+
+func TestBootstrapAdmin(t *testing.T) {
+	t.Run("new user", func(t *testing.T) {
+		s := NewServer(serverconfig.WalConfig{Datadir: t.TempDir()})
+		t.Cleanup(func() { s.Shutdown(context.Background()) })
+		created, err := s.BootstrapAdmin("root", "rootpw")
+		mustOK(t, err)
+		if !created || !s.RolesOf("root").IsAdmin() {
+			t.Fatal("BootstrapAdmin didn't make a new user an admin")
+		}
+		if ok, _ := s.CheckPassword("root", "rootpw"); !ok {
+			t.Fatal("BootstrapAdmin didn't create the user with its password")
+		}
+
+		// Once there is an admin, nobody else is made one
+		created, err = s.BootstrapAdmin("mallory", "pw")
+		mustOK(t, err)
+		if created || s.RolesOf("mallory").IsAdmin() {
+			t.Fatal("BootstrapAdmin made a second admin")
+		}
+	})
+
+	t.Run("existing user", func(t *testing.T) {
+		s := NewServer(serverconfig.WalConfig{Datadir: t.TempDir()})
+		t.Cleanup(func() { s.Shutdown(context.Background()) })
+		mustOK(t, s.CreateUser("alice", "secret"))
+
+		if _, err := s.BootstrapAdmin("alice", "guess"); err != ErrWrongPassword {
+			t.Fatalf("bootstrap with the wrong password got %v, want ErrWrongPassword", err)
+		}
+		if s.RolesOf("alice").IsAdmin() {
+			t.Fatal("bootstrap with the wrong password made the user an admin")
+		}
+		if ok, _ := s.CheckPassword("alice", "secret"); !ok {
+			t.Fatal("bootstrap with the wrong password changed the user's password")
+		}
+
+		created, err := s.BootstrapAdmin("alice", "secret")
+		mustOK(t, err)
+		if !created || !s.RolesOf("alice").IsAdmin() {
+			t.Fatal("bootstrap with the right password didn't make the user an admin")
+		}
+	})
+
+	t.Run("config", func(t *testing.T) {
+		cfg := serverconfig.WalConfig{Datadir: t.TempDir()}
+		s := NewServer(cfg)
+		t.Cleanup(func() { s.Shutdown(context.Background()) })
+		passwordFile := filepath.Join(t.TempDir(), "password")
+		mustOK(t, os.WriteFile(passwordFile, []byte("rootpw\n"), 0600))
+
+		if err := s.bootstrapFromConfig(serverconfig.AuthConfig{AdminUser: "root"}); err == nil {
+			t.Fatal("adminUser without a password was accepted")
+		}
+		mustOK(t, s.bootstrapFromConfig(serverconfig.AuthConfig{AdminUser: "root", AdminPasswordFile: passwordFile}))
+
+		// The admin survives a restart
+		s = restart(t, s, cfg)
+		if !s.RolesOf("root").IsAdmin() {
+			t.Fatal("admin lost after restart")
+		}
+		if ok, _ := s.CheckPassword("root", "rootpw"); !ok {
+			t.Fatal("admin password lost after restart")
+		}
+	})
+
+	t.Run("init", func(t *testing.T) {
+		cfg := serverconfig.WalConfig{Datadir: t.TempDir()}
+		mustOK(t, InitAdmin(cfg, "root", "rootpw"))
+		if err := InitAdmin(cfg, "root", "rootpw"); err != ErrAdminExists {
+			t.Fatalf("second init got %v, want ErrAdminExists", err)
+		}
+	})
+}
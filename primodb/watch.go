@@ -0,0 +1,229 @@
+package server
+
+import (
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/rickcollette/primodb/memtable"
+)
+
+const (
+	// watchHistorySize is the number of recent events kept so a watcher can
+	// resume from an earlier sequence number.
+	watchHistorySize = 10000
+	// watchBufferSize is how many events a watcher may fall behind by before
+	// it is dropped.
+	watchBufferSize = 256
+)
+
+var (
+	// ErrWatchCompacted is returned when the requested start sequence is
+	// older than the retained event history.
+	ErrWatchCompacted = errors.New("watch: start sequence is no longer available")
+	// ErrWatchLagged is returned when a watcher fell too far behind and was
+	// dropped. It can resume from the last sequence it saw.
+	ErrWatchLagged = errors.New("watch: watcher fell behind")
+	// ErrWatchClosed is returned when the server is shutting down.
+	ErrWatchClosed = errors.New("watch: server is shutting down")
+)
+
+// WatchEvent is a committed change to a key. Events written by one
+// transaction share the same Seq and are always delivered in the same order,
+// so a watcher resuming mid-transaction starts from that Seq and skips the
+// events of it that it already handled.
+type WatchEvent struct {
+	Seq      int64
+	Type     string // CREATE, UPDATE or DELETE
+	Database string
+	Key      string
+	OldValue string
+	NewValue string
+	Version  int64 // version of the new row, 0 for deletes
+}
+
+func putEvent(seq int64, database string, old memtable.KVRow, existed bool, row memtable.KVRow) WatchEvent {
+	ev := WatchEvent{Seq: seq, Type: "CREATE", Database: database, Key: row.Key, NewValue: row.Value, Version: row.Version}
+	if existed {
+		ev.Type = "UPDATE"
+		ev.OldValue = old.Value
+	}
+	return ev
+}
+
+func deleteEvent(seq int64, database string, old memtable.KVRow) WatchEvent {
+	return WatchEvent{Seq: seq, Type: "DELETE", Database: database, Key: old.Key, OldValue: old.Value}
+}
+
+// Watcher receives the events matching a Watch call on C. C is closed when
+// the watch is cancelled or the watcher falls behind; Err tells which.
+type Watcher struct {
+	C        <-chan WatchEvent
+	ch       chan WatchEvent
+	database string
+	key      string
+	prefix   string
+	err      error
+	hub      *watchHub
+}
+
+func (w *Watcher) matches(ev WatchEvent) bool {
+	if ev.Database != w.database {
+		return false
+	}
+	if w.key != "" {
+		return ev.Key == w.key
+	}
+	return strings.HasPrefix(ev.Key, w.prefix)
+}
+
+// Err returns ErrWatchLagged if the watcher was dropped for falling behind,
+// or ErrWatchClosed if the server shut down. Only valid once C is closed.
+func (w *Watcher) Err() error {
+	w.hub.mu.Lock()
+	defer w.hub.mu.Unlock()
+	return w.err
+}
+
+// Cancel stops the watch and closes C.
+func (w *Watcher) Cancel() {
+	w.hub.remove(w, nil)
+}
+
+// watchHub fans committed events out to watchers and keeps a bounded history
+// for resuming.
+type watchHub struct {
+	mu       sync.Mutex
+	history  []WatchEvent // ring buffer of the latest events
+	head     int          // index of the oldest event once history is full
+	minSeq   int64        // lowest sequence whose events are all retained
+	watchers map[*Watcher]struct{}
+	pending  []*stagedEvents // staged, oldest first
+	closed   bool
+}
+
+// stagedEvents are the events of a WAL record that may not be durable yet.
+type stagedEvents struct {
+	events []WatchEvent
+	done   bool // the record was committed, or failed if err is set
+	err    error
+}
+
+func newWatchHub(nextSeq int64) *watchHub {
+	return &watchHub{minSeq: nextSeq, watchers: make(map[*Watcher]struct{})}
+}
+
+// stage holds back the events of a record just appended to the WAL until
+// commit reports it durable. Callers stage while holding the database lock,
+// and staged events are published in the order they were staged, so events
+// of a database are published in sequence order.
+func (h *watchHub) stage(events ...WatchEvent) *stagedEvents {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	st := &stagedEvents{events: events}
+	h.pending = append(h.pending, st)
+	return st
+}
+
+// commit marks st's record committed, or failed with err, and publishes the
+// events no longer held back by earlier ones. Events of failed records are
+// dropped. A nil st is ignored.
+func (h *watchHub) commit(st *stagedEvents, err error) {
+	if st == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	st.done, st.err = true, err
+	for len(h.pending) > 0 && h.pending[0].done {
+		head := h.pending[0]
+		h.pending[0] = nil
+		h.pending = h.pending[1:]
+		if head.err != nil {
+			continue
+		}
+		for _, ev := range head.events {
+			h.publishLocked(ev)
+		}
+	}
+}
+
+// publishLocked records ev and delivers it to matching watchers without
+// blocking. The caller must hold h.mu.
+func (h *watchHub) publishLocked(ev WatchEvent) {
+	if len(h.history) < watchHistorySize {
+		h.history = append(h.history, ev)
+	} else {
+		evicted := h.history[h.head]
+		h.history[h.head] = ev
+		h.head = (h.head + 1) % watchHistorySize
+		if evicted.Seq+1 > h.minSeq {
+			h.minSeq = evicted.Seq + 1
+		}
+	}
+	for w := range h.watchers {
+		if !w.matches(ev) {
+			continue
+		}
+		select {
+		case w.ch <- ev:
+		default:
+			h.removeLocked(w, ErrWatchLagged)
+		}
+	}
+}
+
+// watch registers a watcher. With a startSeq > 0 the retained events with
+// Seq >= startSeq are delivered first.
+func (h *watchHub) watch(database, key, prefix string, startSeq int64) (*Watcher, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil, ErrWatchClosed
+	}
+	w := &Watcher{database: database, key: key, prefix: prefix, hub: h}
+	var backlog []WatchEvent
+	if startSeq > 0 {
+		if startSeq < h.minSeq {
+			return nil, ErrWatchCompacted
+		}
+		for i := range h.history {
+			ev := h.history[(h.head+i)%len(h.history)]
+			if ev.Seq >= startSeq && w.matches(ev) {
+				backlog = append(backlog, ev)
+			}
+		}
+	}
+	w.ch = make(chan WatchEvent, len(backlog)+watchBufferSize)
+	w.C = w.ch
+	for _, ev := range backlog {
+		w.ch <- ev
+	}
+	h.watchers[w] = struct{}{}
+	return w, nil
+}
+
+// close ends every watch with ErrWatchClosed and refuses new ones.
+func (h *watchHub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for w := range h.watchers {
+		h.removeLocked(w, ErrWatchClosed)
+	}
+}
+
+func (h *watchHub) remove(w *Watcher, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.removeLocked(w, err)
+}
+
+func (h *watchHub) removeLocked(w *Watcher, err error) {
+	if _, ok := h.watchers[w]; !ok {
+		return
+	}
+	delete(h.watchers, w)
+	w.err = err
+	close(w.ch)
+}
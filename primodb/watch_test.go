@@ -0,0 +1,85 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/rickcollette/primodb/serverconfig"
+)
+
+// receive returns the events w got, waiting for n of them.
+func receive(t *testing.T, w *Watcher, n int) []string {
+	t.Helper()
+	var got []string
+	for len(got) < n {
+		select {
+		case ev := <-w.C:
+			got = append(got, fmt.Sprintf("%d %s %s", ev.Seq, ev.Type, ev.Key))
+		case <-time.After(time.Second):
+			t.Fatalf("got events %v, want %d", got, n)
+		}
+	}
+	return got
+}
+
+func expectNoEvent(t *testing.T, w *Watcher) {
+	t.Helper()
+	select {
+	case ev := <-w.C:
+		t.Fatalf("unexpected event %+v", ev)
+	default:
+	}
+}
+
+func TestWatchHubPublishesCommittedInOrder(t *testing.T) {
+	h := newWatchHub(1)
+	w, err := h.watch("db", "", "", 0)
+	mustOK(t, err)
+
+	first := h.stage(WatchEvent{Seq: 1, Type: "CREATE", Database: "db", Key: "a"})
+	second := h.stage(WatchEvent{Seq: 2, Type: "CREATE", Database: "db", Key: "b"})
+	third := h.stage(WatchEvent{Seq: 3, Type: "CREATE", Database: "db", Key: "c"})
+
+	// Committed, but held back by the first record
+	h.commit(second, nil)
+	expectNoEvent(t, w)
+
+	// A failed record is never published, and no longer holds anything up
+	h.commit(first, errors.New("fsync failed"))
+	if got := receive(t, w, 1); fmt.Sprint(got) != "[2 CREATE b]" {
+		t.Fatalf("got %v, want only the committed event", got)
+	}
+	expectNoEvent(t, w)
+	h.commit(third, nil)
+	if got := receive(t, w, 1); fmt.Sprint(got) != "[3 CREATE c]" {
+		t.Fatalf("got %v", got)
+	}
+}
+
+func TestWatchResumeTxn(t *testing.T) {
+	cfg := serverconfig.WalConfig{Datadir: t.TempDir(), Sync: "group"}
+	s := NewServer(cfg)
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+	live, err := s.Watch("", "", "", 0)
+	mustOK(t, err)
+
+	_, err = s.Create("", "a", "1")
+	mustOK(t, err)
+	_, err = s.Txn("", nil, []TxnOp{{Key: "b", Value: "2"}, {Key: "c", Value: "3"}, {Delete: true, Key: "a"}})
+	mustOK(t, err)
+	want := "[1 CREATE a 2 CREATE b 2 CREATE c 2 DELETE a]"
+	if got := receive(t, live, 4); fmt.Sprint(got) != want {
+		t.Fatalf("got %v, want %s", got, want)
+	}
+
+	// A watcher that only saw the first event of the transaction resumes
+	// from its Seq and gets all of it again, in the same order
+	resumed, err := s.Watch("", "", "", 2)
+	mustOK(t, err)
+	if got := receive(t, resumed, 3); fmt.Sprint(got) != "[2 CREATE b 2 CREATE c 2 DELETE a]" {
+		t.Fatalf("resumed watch got %v", got)
+	}
+}
@@ -25,12 +25,116 @@ type ServerConfig struct {
 		Port    int           `yaml:"port"`
 		DB      string        `yaml:"dbname"`
 		Timeout time.Duration `yaml:"timeout"`
+		// SweepInterval is how often expired keys are removed, in seconds
+		SweepInterval time.Duration `yaml:"sweepInterval"`
+		// ShutdownTimeout is how long in-flight requests get to finish on
+		// shutdown, in seconds
+		ShutdownTimeout time.Duration `yaml:"shutdownTimeout"`
 	} `yaml:"server"`
-	Wal struct {
-		Datadir  string   `yaml:"datadir"`
-		UseS3    bool     `yaml:"useS3"`
-		S3Config S3Config `yaml:"s3Config"`
-	} `yaml:"wal"`
+	TLS  TLSConfig  `yaml:"tls"`
+	Auth AuthConfig `yaml:"auth"`
+	Wal  WalConfig  `yaml:"wal"`
+}
+
+// TLSConfig holds the transport security settings. The files are read again
+// when primod gets SIGHUP.
+type TLSConfig struct {
+	// CertFile and KeyFile hold the server's PEM certificate and key.
+	// Setting them turns on TLS.
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+	// ClientCAFile holds the CAs client certificates are verified against.
+	// Setting it turns on mutual TLS, where a client certificate's common
+	// name can log in as that user without a password.
+	ClientCAFile string `yaml:"clientCAFile"`
+	// RequireClientCert rejects clients without a valid certificate.
+	RequireClientCert bool `yaml:"requireClientCert"`
+}
+
+// AuthConfig holds the settings for the tokens clients authenticate with
+type AuthConfig struct {
+	// SecretKey is a single HS256 key, with kid "default", used when Keys
+	// is empty. Without either, a random key is generated at startup and
+	// tokens don't survive a restart.
+	SecretKey string `yaml:"secretKey"`
+	// SecretKeyFile is a file holding the secret key instead.
+	SecretKeyFile string `yaml:"secretKeyFile"`
+	// Keys are the keys tokens can be signed with. To rotate keys, add the
+	// new one, make it the SigningKey, and remove the old one once the
+	// tokens it signed have expired.
+	Keys []TokenKeyConfig `yaml:"keys"`
+	// SigningKey is the kid of the key new tokens are signed with, the first
+	// key that can sign if empty.
+	SigningKey string `yaml:"signingKey"`
+	// TokenLifetime is how long tokens are valid, in seconds
+	TokenLifetime time.Duration `yaml:"tokenLifetime"`
+	// AdminUser is made an admin of all databases at startup when no user
+	// is one yet. It is created with AdminPassword, or the password in
+	// AdminPasswordFile, if it doesn't exist; an existing user must have
+	// that password.
+	AdminUser         string `yaml:"adminUser"`
+	AdminPassword     string `yaml:"adminPassword"`
+	AdminPasswordFile string `yaml:"adminPasswordFile"`
+}
+
+// TokenKeyConfig is a key that signs and verifies tokens, or only verifies
+// them for an asymmetric key given by its public key alone
+type TokenKeyConfig struct {
+	Kid string `yaml:"kid"`
+	// Algorithm is HS256 (default), RS256 or EdDSA.
+	Algorithm string `yaml:"algorithm"`
+	// Secret or SecretFile holds an HS256 key.
+	Secret     string `yaml:"secret"`
+	SecretFile string `yaml:"secretFile"`
+	// PrivateKeyFile and PublicKeyFile hold PEM RS256 or EdDSA keys.
+	PrivateKeyFile string `yaml:"privateKeyFile"`
+	PublicKeyFile  string `yaml:"publicKeyFile"`
+}
+
+// WalConfig holds the write-ahead log settings
+type WalConfig struct {
+	Datadir string `yaml:"datadir"`
+	// UseS3 is the legacy switch for archive: s3
+	UseS3    bool     `yaml:"useS3"`
+	S3Config S3Config `yaml:"s3Config"`
+	// Archive selects where finalized segments are copied: none (default),
+	// local or s3.
+	Archive string `yaml:"archive"`
+	// ArchiveDir is the directory used by the local archive.
+	ArchiveDir string `yaml:"archiveDir"`
+	// SegmentMaxBytes rolls the WAL over to a new segment at this size.
+	// 0 uses the wal package default.
+	SegmentMaxBytes int64 `yaml:"segmentMaxBytes"`
+	// SegmentMaxRecords rolls the WAL over after this many records. 0 means
+	// no record limit.
+	SegmentMaxRecords int64 `yaml:"segmentMaxRecords"`
+	// Sync decides when WAL records are fsynced: always (default), group,
+	// interval or none. Under group, a write is applied before its record
+	// is fsynced, so the server stops if the fsync fails.
+	Sync string `yaml:"sync"`
+	// SyncInterval is the max delay before a record is fsynced under the
+	// interval policy, in milliseconds.
+	SyncInterval time.Duration `yaml:"syncInterval"`
+	// Compression is applied to new WAL records and snapshots: none
+	// (default) or flate.
+	Compression string `yaml:"compression"`
+	// EncryptionKey is a hex encoded 16, 24 or 32 byte AES key. When set,
+	// new WAL records and snapshots are encrypted with AES-GCM.
+	EncryptionKey string `yaml:"encryptionKey"`
+	// EncryptionKeyFile is a file holding the hex encoded key instead.
+	EncryptionKeyFile string `yaml:"encryptionKeyFile"`
+	// RecoveryPolicy decides what recovery does with corrupted WAL records:
+	// strict (default), truncate-tail or skip-corrupt.
+	RecoveryPolicy string `yaml:"recoveryPolicy"`
+	// CheckpointInterval is how often a snapshot is written, in seconds.
+	// 0 disables timed checkpoints.
+	CheckpointInterval time.Duration `yaml:"checkpointInterval"`
+	// CheckpointRecords writes a snapshot after this many WAL records.
+	// 0 disables record-count checkpoints.
+	CheckpointRecords int64 `yaml:"checkpointRecords"`
+	// SnapshotOnShutdown writes a snapshot when the server shuts down, so
+	// the next start has nothing to replay.
+	SnapshotOnShutdown bool `yaml:"snapshotOnShutdown"`
 }
 
 const (
@@ -0,0 +1,13 @@
+package snapshot
+
+import "errors"
+
+var (
+	// ErrSnapshotNotFound no snapshot found in the data directory. Recovery
+	// replays the whole WAL.
+	ErrSnapshotNotFound = errors.New("SNAPSHOT: snapshot not found")
+	// ErrInvalidSnapshot is raised when a snapshot's checksum doesn't match
+	// its contents.
+	ErrInvalidSnapshot = errors.New("SNAPSHOT: Invalid snapshot data")
+	ErrBadSnapshotName = errors.New("SNAPSHOT: Bad snapshot name")
+)
@@ -0,0 +1,497 @@
+// Package snapshot writes and loads point-in-time copies of a
+// memtable.DatabaseStore. A snapshot is tagged with the last WAL sequence it
+// covers, so recovery only has to replay the records after it.
+package snapshot
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rickcollette/primodb/memtable"
+	"github.com/rickcollette/primodb/wal"
+)
+
+const (
+	snapExtension    = ".snap"
+	tmpSnapExtension = ".snap.tmp"
+	// DiscardedExtension is appended to snapshots set aside by
+	// point-in-time recovery.
+	DiscardedExtension = wal.DiscardedExtension
+	fMode              = os.FileMode(0644)
+	crcSize            = 4
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// A snapshot file is a gob stream of a header, then for each database a
+// database entry followed by its rows, then a raw crc32 of the whole stream.
+// Since version 2 the database entries and rows are a gob stream of their
+// own, cut into blocks that are compressed and encrypted as the header says,
+// the way the WAL stores records. The header itself holds no data, so it can
+// be read without the key.
+//
+// Writes go on while a snapshot is taken, so besides every record up to Seq
+// it may hold some later ones. Version 1 headers bound those: MaxSeq is the
+// last record any row may come from, and Time is taken once every database
+// was copied. Version 0 snapshots have no such bound.
+type header struct {
+	Seq         int64
+	Time        int64 // unix nanoseconds when the snapshot was taken
+	Databases   int
+	Version     int
+	MaxSeq      int64
+	Compression string
+	Encrypted   bool
+}
+
+const (
+	headerVersion = 2
+	// blockSize is how much of the database and row stream goes in a block
+	blockSize = 64 << 10
+)
+
+// block is a piece of the database and row stream in stored form.
+type block struct {
+	Data []byte
+}
+
+// blockWriter cuts the database and row stream into blocks, encodes them
+// with codec and writes them to enc.
+type blockWriter struct {
+	enc   *gob.Encoder
+	codec *wal.Codec
+	buf   bytes.Buffer
+}
+
+func (b *blockWriter) Write(p []byte) (int, error) {
+	b.buf.Write(p)
+	if b.buf.Len() >= blockSize {
+		if err := b.flush(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// flush writes out what is buffered as a block.
+func (b *blockWriter) flush() error {
+	if b.buf.Len() == 0 {
+		return nil
+	}
+	data, err := b.codec.Encode(b.buf.Bytes())
+	if err != nil {
+		return err
+	}
+	if err := b.enc.Encode(block{Data: data}); err != nil {
+		return err
+	}
+	b.buf.Reset()
+	return nil
+}
+
+// blockReader reads the database and row stream back from the blocks dec
+// returns. It only decodes a block once the one before is used up, so it
+// never reads past the last one.
+type blockReader struct {
+	dec   *gob.Decoder
+	codec *wal.Codec
+	buf   []byte
+}
+
+func (b *blockReader) Read(p []byte) (int, error) {
+	for len(b.buf) == 0 {
+		var blk block
+		if err := b.dec.Decode(&blk); err != nil {
+			return 0, err
+		}
+		data, err := b.codec.Decode(blk.Data)
+		if err != nil {
+			return 0, err
+		}
+		b.buf = data
+	}
+	n := copy(p, b.buf)
+	b.buf = b.buf[n:]
+	return n, nil
+}
+
+// Info describes what a snapshot holds.
+type Info struct {
+	Seq    int64     // every record up to Seq is in the snapshot
+	MaxSeq int64     // no record after MaxSeq is; math.MaxInt64 if unknown
+	Time   time.Time // no record logged after Time is; zero if unknown
+}
+
+type database struct {
+	Name     string
+	Revision int64
+	Rows     int
+}
+
+type row struct {
+	Key       string
+	Value     string
+	Version   int64
+	ExpiresAt int64 // unix nanoseconds, 0 never expires
+}
+
+// File is a snapshot on disk.
+type File struct {
+	Seq  int64
+	Path string
+}
+
+func snapName(seq int64) string {
+	return fmt.Sprintf("%016x.snap", seq)
+}
+
+// ParseName returns the sequence a snapshot file name is tagged with, or
+// ErrBadSnapshotName if str isn't a snapshot file name.
+func ParseName(str string) (int64, error) {
+	var seq int64
+	if !strings.HasSuffix(str, snapExtension) {
+		return 0, ErrBadSnapshotName
+	}
+	if _, err := fmt.Sscanf(str, "%016x.snap", &seq); err != nil {
+		return 0, ErrBadSnapshotName
+	}
+	return seq, nil
+}
+
+// List returns the snapshots in dirPath, oldest first.
+func List(dirPath string) ([]File, error) {
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	var files []File
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		seq, err := ParseName(entry.Name())
+		if err != nil {
+			continue
+		}
+		files = append(files, File{Seq: seq, Path: filepath.Join(dirPath, entry.Name())})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Seq < files[j].Seq })
+	return files, nil
+}
+
+// Write copies every database in store to a new snapshot in dirPath tagged
+// with seq and returns its path. Each database is copied under its own lock;
+// the caller is responsible for every record up to seq being applied to store
+// first. lastSeq is called while each database is locked and returns the
+// sequence of the last record applied so far, which bounds the records the
+// copy may hold. The rows are stored with codec, which should be set up like
+// the WAL's. The snapshot only appears under its final name once it is
+// complete and sync, if not nil, returned nil: sync must return once the
+// records the copy may hold are durable, so a snapshot never holds writes
+// the WAL lost.
+func Write(dirPath string, seq int64, store *memtable.DatabaseStore, lastSeq func() int64, sync func() error, codec *wal.Codec) (string, error) {
+	path := filepath.Join(dirPath, snapName(seq))
+	tmpPath := strings.TrimSuffix(path, snapExtension) + tmpSnapExtension
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, fMode)
+	if err != nil {
+		return "", err
+	}
+	if err := write(f, seq, store, lastSeq, codec); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return "", err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+	if sync != nil {
+		if err := sync(); err != nil {
+			os.Remove(tmpPath)
+			return "", fmt.Errorf("records in the snapshot aren't durable: %w", err)
+		}
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return "", err
+	}
+	return path, syncDir(dirPath)
+}
+
+// dump is a database copied for a snapshot.
+type dump struct {
+	name     string
+	rows     []memtable.KVRow
+	revision int64
+}
+
+func write(f *os.File, seq int64, store *memtable.DatabaseStore, lastSeq func() int64, codec *wal.Codec) error {
+	// The header goes first but is only known once every database is
+	// copied, so the copies are held until then.
+	hdr := header{Seq: seq, Version: headerVersion, MaxSeq: seq,
+		Compression: string(codec.Compression()), Encrypted: codec.Encrypted()}
+	var dumps []dump
+	for _, name := range store.Names() {
+		d := dump{name: name}
+		d.rows, d.revision = store.GetDatabase(name).DumpWith(func() {
+			if last := lastSeq(); last > hdr.MaxSeq {
+				hdr.MaxSeq = last
+			}
+		})
+		dumps = append(dumps, d)
+	}
+	hdr.Time = time.Now().UnixNano()
+	hdr.Databases = len(dumps)
+
+	buf := bufio.NewWriter(f)
+	h := crc32.New(crcTable)
+	enc := gob.NewEncoder(io.MultiWriter(buf, h))
+	if err := enc.Encode(hdr); err != nil {
+		return err
+	}
+	blocks := &blockWriter{enc: enc, codec: codec}
+	rows := gob.NewEncoder(blocks)
+	for _, d := range dumps {
+		if err := rows.Encode(database{Name: d.name, Revision: d.revision, Rows: len(d.rows)}); err != nil {
+			return err
+		}
+		for _, r := range d.rows {
+			var expiresAt int64
+			if t := r.ExpiresAt(); !t.IsZero() {
+				expiresAt = t.UnixNano()
+			}
+			if err := rows.Encode(row{Key: r.Key, Value: r.Value, Version: r.Version, ExpiresAt: expiresAt}); err != nil {
+				return err
+			}
+		}
+	}
+	if err := blocks.flush(); err != nil {
+		return err
+	}
+	if err := binary.Write(buf, binary.BigEndian, h.Sum32()); err != nil {
+		return err
+	}
+	return buf.Flush()
+}
+
+// Verify checks the snapshot at path against its checksum.
+func Verify(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() < crcSize {
+		return ErrInvalidSnapshot
+	}
+	h := crc32.New(crcTable)
+	if _, err := io.CopyN(h, f, info.Size()-crcSize); err != nil {
+		return err
+	}
+	var sum uint32
+	if err := binary.Read(f, binary.BigEndian, &sum); err != nil {
+		return err
+	}
+	if sum != h.Sum32() {
+		return ErrInvalidSnapshot
+	}
+	return nil
+}
+
+// Load verifies the snapshot at path, restores its rows into store and
+// returns the WAL sequence it covers. key decrypts encrypted snapshots.
+func Load(path string, store *memtable.DatabaseStore, key []byte) (int64, error) {
+	if err := Verify(path); err != nil {
+		return 0, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	dec := gob.NewDecoder(bufio.NewReader(f))
+
+	var hdr header
+	if err := dec.Decode(&hdr); err != nil {
+		return 0, err
+	}
+	rows := dec
+	if hdr.Version >= 2 {
+		if !hdr.Encrypted {
+			key = nil
+		} else if key == nil {
+			return 0, wal.ErrNoEncryptionKey
+		}
+		codec, err := wal.NewCodec(wal.Compression(hdr.Compression), key)
+		if err != nil {
+			return 0, err
+		}
+		rows = gob.NewDecoder(&blockReader{dec: dec, codec: codec})
+	}
+	for i := 0; i < hdr.Databases; i++ {
+		var d database
+		if err := rows.Decode(&d); err != nil {
+			return 0, err
+		}
+		db := store.GetDatabase(d.Name)
+		for j := 0; j < d.Rows; j++ {
+			var r row
+			if err := rows.Decode(&r); err != nil {
+				return 0, err
+			}
+			var expiresAt time.Time
+			if r.ExpiresAt != 0 {
+				expiresAt = time.Unix(0, r.ExpiresAt)
+			}
+			db.Restore(r.Key, r.Value, expiresAt, r.Version)
+		}
+		db.SetRevision(d.Revision)
+	}
+	return hdr.Seq, nil
+}
+
+// ReadInfo returns what the snapshot at path holds, from its header.
+func ReadInfo(path string) (Info, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Info{}, err
+	}
+	defer f.Close()
+	var hdr header
+	if err := gob.NewDecoder(bufio.NewReader(f)).Decode(&hdr); err != nil {
+		return Info{}, err
+	}
+	info := Info{Seq: hdr.Seq, MaxSeq: math.MaxInt64}
+	if hdr.Version >= 1 {
+		info.MaxSeq = hdr.MaxSeq
+		info.Time = time.Unix(0, hdr.Time)
+	}
+	return info, nil
+}
+
+// LoadLatest loads the newest valid snapshot in dirPath into store and
+// returns the WAL sequence it covers. Snapshots that fail verification are
+// skipped in favor of older ones. It returns ErrSnapshotNotFound if there is
+// no valid snapshot. key decrypts encrypted snapshots.
+func LoadLatest(dirPath string, store *memtable.DatabaseStore, key []byte) (int64, error) {
+	return LoadLatestMatching(dirPath, store, key, nil)
+}
+
+// LoadLatestMatching is LoadLatest restricted to the snapshots for which
+// match returns true. A nil match accepts every snapshot.
+func LoadLatestMatching(dirPath string, store *memtable.DatabaseStore, key []byte, match func(Info) bool) (int64, error) {
+	files, err := List(dirPath)
+	if err != nil {
+		return 0, err
+	}
+	for i := len(files) - 1; i >= 0; i-- {
+		if err := Verify(files[i].Path); err != nil {
+			log.Printf("SNAPSHOT: skipping %s: %v", filepath.Base(files[i].Path), err)
+			continue
+		}
+		if match != nil {
+			info, err := ReadInfo(files[i].Path)
+			if err != nil {
+				return 0, err
+			}
+			if !match(info) {
+				continue
+			}
+		}
+		return Load(files[i].Path, store, key)
+	}
+	return 0, ErrSnapshotNotFound
+}
+
+// Discarded describes a snapshot set aside by DiscardAfter.
+type Discarded struct {
+	Snapshot  string // snapshot file name
+	Discarded string // name the snapshot was renamed to
+}
+
+// DiscardAfter sets aside the snapshots in dirPath that may hold records
+// after seq with wal.SetAside, so recovery no longer loads them, and returns
+// what it renamed. That includes snapshots whose header can't be read.
+func DiscardAfter(dirPath string, seq int64) ([]Discarded, error) {
+	files, err := List(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	var discarded []Discarded
+	for _, file := range files {
+		if info, err := ReadInfo(file.Path); err == nil && info.MaxSeq <= seq {
+			continue
+		}
+		name, err := wal.SetAside(file.Path)
+		if err != nil {
+			return discarded, err
+		}
+		discarded = append(discarded, Discarded{Snapshot: filepath.Base(file.Path), Discarded: name})
+	}
+	if len(discarded) > 0 {
+		return discarded, syncDir(dirPath)
+	}
+	return discarded, nil
+}
+
+// Prune removes all but the newest keep snapshots in dirPath, along with
+// unfinished ones, and returns the sequence of the oldest snapshot kept. WAL
+// records up to that sequence are no longer needed for recovery.
+func Prune(dirPath string, keep int) (int64, error) {
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return 0, err
+	}
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), tmpSnapExtension) {
+			os.Remove(filepath.Join(dirPath, entry.Name()))
+		}
+	}
+	files, err := List(dirPath)
+	if err != nil {
+		return 0, err
+	}
+	if len(files) == 0 {
+		return 0, ErrSnapshotNotFound
+	}
+	if keep < 1 {
+		keep = 1
+	}
+	for len(files) > keep {
+		if err := os.Remove(files[0].Path); err != nil {
+			return 0, err
+		}
+		files = files[1:]
+	}
+	return files[0].Seq, syncDir(dirPath)
+}
+
+// syncDir fsyncs a directory so renames and new files in it are durable
+func syncDir(dirPath string) error {
+	d, err := os.Open(dirPath)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
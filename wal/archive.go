@@ -0,0 +1,273 @@
+package wal
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// archiveRetryMin and archiveRetryMax bound the backoff between attempts
+	// to archive a segment.
+	archiveRetryMin = time.Second
+	archiveRetryMax = time.Minute
+)
+
+// ArchiveBackend stores finalized WAL segments outside the data directory,
+// keyed by segment file name.
+type ArchiveBackend interface {
+	// Put stores the segment file at srcPath under name, replacing any
+	// existing copy.
+	Put(name, srcPath string) error
+	// Get downloads the segment stored under name to destPath.
+	Get(name, destPath string) error
+	// List returns the names of everything archived in name order. Besides
+	// segments this includes snapshots the server archived.
+	List() ([]string, error)
+	// Delete removes the segment stored under name.
+	Delete(name string) error
+}
+
+// LocalArchive is an ArchiveBackend that keeps segments in a directory,
+// typically on another disk or a network mount.
+type LocalArchive struct {
+	dir string
+}
+
+// NewLocalArchive returns a LocalArchive storing segments in dir, creating
+// it if needed.
+func NewLocalArchive(dir string) (*LocalArchive, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &LocalArchive{dir: dir}, nil
+}
+
+// Put copies the segment into the archive directory. The copy only appears
+// under name once it is complete.
+func (a *LocalArchive) Put(name, srcPath string) error {
+	dest := filepath.Join(a.dir, name)
+	if err := copyFile(srcPath, dest+".tmp"); err != nil {
+		os.Remove(dest + ".tmp")
+		return err
+	}
+	if err := os.Rename(dest+".tmp", dest); err != nil {
+		return err
+	}
+	return syncDir(a.dir)
+}
+
+// Get copies an archived segment to destPath.
+func (a *LocalArchive) Get(name, destPath string) error {
+	return copyFile(filepath.Join(a.dir, name), destPath)
+}
+
+// List returns the archived file names in name order. Copies still being
+// written are left out.
+func (a *LocalArchive) List() ([]string, error) {
+	entries, err := os.ReadDir(a.dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() && !strings.HasSuffix(entry.Name(), ".tmp") {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+// Delete removes an archived segment.
+func (a *LocalArchive) Delete(name string) error {
+	return os.Remove(filepath.Join(a.dir, name))
+}
+
+// copyFile copies src to dest and fsyncs dest
+func copyFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dest, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, fMode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := Fsync(out); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// IsSegmentName reports whether name is a finalized segment file name.
+// Segment names sort in sequence order.
+func IsSegmentName(name string) bool {
+	_, isTmp, err := parseWalName(name)
+	return err == nil && !isTmp
+}
+
+// archiver uploads finalized segments in the background, retrying failed
+// uploads with backoff. Segments stay pending, and are never pruned, until
+// they are archived. Adding a segment never blocks, so a backend that is
+// down for a long time doesn't hold up WAL writes; pending just grows.
+type archiver struct {
+	backend ArchiveBackend
+	mu      sync.Mutex
+	// pending holds the segment paths not archived yet. Those set to false
+	// wait for catchUp to find out whether the backend has them already.
+	pending map[string]bool
+	wake    chan struct{}
+	closing chan struct{}
+	done    chan struct{}
+}
+
+func newArchiver(backend ArchiveBackend) *archiver {
+	a := &archiver{
+		backend: backend,
+		pending: make(map[string]bool),
+		wake:    make(chan struct{}, 1),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go a.run()
+	return a
+}
+
+// add schedules a finalized segment for archiving.
+func (a *archiver) add(path string) {
+	a.mu.Lock()
+	a.pending[path] = true
+	a.mu.Unlock()
+	a.notify()
+}
+
+// notify wakes the worker if it is waiting for segments.
+func (a *archiver) notify() {
+	select {
+	case a.wake <- struct{}{}:
+	default:
+	}
+}
+
+// catchUp marks segments left by earlier runs as pending right away, so they
+// can't be pruned, then archives those the backend doesn't have yet.
+func (a *archiver) catchUp(paths []string) {
+	a.mu.Lock()
+	for _, path := range paths {
+		if !a.pending[path] {
+			a.pending[path] = false
+		}
+	}
+	a.mu.Unlock()
+	go func() {
+		archived := make(map[string]bool)
+		names, err := a.backend.List()
+		if err != nil {
+			log.Printf("WAL: failed to list archive, re-archiving every segment: %v", err)
+		}
+		for _, name := range names {
+			archived[name] = true
+		}
+		a.mu.Lock()
+		for _, path := range paths {
+			if archived[filepath.Base(path)] {
+				delete(a.pending, path)
+			} else {
+				a.pending[path] = true
+			}
+		}
+		a.mu.Unlock()
+		a.notify()
+	}()
+}
+
+// isPending reports whether the segment at path still has to be archived.
+func (a *archiver) isPending(path string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, ok := a.pending[path]
+	return ok
+}
+
+// ready returns the pending segments that can be archived, oldest first.
+func (a *archiver) ready() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var paths []string
+	for path, ok := range a.pending {
+		if ok {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func (a *archiver) run() {
+	defer close(a.done)
+	for {
+		if paths := a.ready(); len(paths) > 0 {
+			a.archive(paths[0], true)
+			select {
+			case <-a.closing:
+			default:
+				continue
+			}
+		} else {
+			select {
+			case <-a.wake:
+				continue
+			case <-a.closing:
+			}
+		}
+		// Give what's left one attempt each; anything that fails is picked
+		// up again on the next start.
+		for _, path := range a.ready() {
+			a.archive(path, false)
+		}
+		return
+	}
+}
+
+func (a *archiver) archive(path string, retry bool) {
+	name := filepath.Base(path)
+	backoff := archiveRetryMin
+	for {
+		err := a.backend.Put(name, path)
+		if err == nil {
+			a.mu.Lock()
+			delete(a.pending, path)
+			a.mu.Unlock()
+			return
+		}
+		log.Printf("WAL: failed to archive %s: %v", name, err)
+		if !retry {
+			return
+		}
+		select {
+		case <-time.After(backoff):
+		case <-a.closing:
+			return
+		}
+		if backoff *= 2; backoff > archiveRetryMax {
+			backoff = archiveRetryMax
+		}
+	}
+}
+
+// close stops the archiver after one last attempt at the queued segments.
+func (a *archiver) close() {
+	close(a.closing)
+	<-a.done
+}
@@ -0,0 +1,261 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testArchive is a LocalArchive that counts uploads and can fail them, or
+// hold up List until released.
+type testArchive struct {
+	*LocalArchive
+	mu       sync.Mutex
+	puts     map[string]int
+	failPuts int
+	listErr  error
+	listGate chan struct{}
+}
+
+func newTestArchive(t *testing.T) *testArchive {
+	t.Helper()
+	local, err := NewLocalArchive(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testArchive{LocalArchive: local, puts: make(map[string]int)}
+}
+
+func (a *testArchive) Put(name, srcPath string) error {
+	a.mu.Lock()
+	a.puts[name]++
+	fail := a.failPuts != 0
+	if a.failPuts > 0 {
+		a.failPuts--
+	}
+	a.mu.Unlock()
+	if fail {
+		return errors.New("archive unavailable")
+	}
+	return a.LocalArchive.Put(name, srcPath)
+}
+
+func (a *testArchive) List() ([]string, error) {
+	if a.listGate != nil {
+		<-a.listGate
+	}
+	if a.listErr != nil {
+		return nil, a.listErr
+	}
+	return a.LocalArchive.List()
+}
+
+func (a *testArchive) putCount(name string) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.puts[name]
+}
+
+// waitFor fails t unless cond holds within a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// writeFiles creates files with the given names in dir and returns their
+// paths.
+func writeFiles(t *testing.T, dir string, names ...string) []string {
+	t.Helper()
+	var paths []string
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+func TestLocalArchive(t *testing.T) {
+	archiveDir := t.TempDir()
+	a, err := NewLocalArchive(filepath.Join(archiveDir, "nested"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := t.TempDir()
+	paths := writeFiles(t, src, "b", "a")
+	for _, path := range paths {
+		if err := a.Put(filepath.Base(path), path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Copies still being written aren't listed
+	writeFiles(t, a.dir, "c.tmp")
+	names, err := a.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(names) != "[a b]" {
+		t.Fatalf("List got %v, want [a b]", names)
+	}
+
+	// Put replaces an existing copy
+	if err := os.WriteFile(paths[0], []byte("new b"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Put("b", paths[0]); err != nil {
+		t.Fatal(err)
+	}
+	dest := filepath.Join(t.TempDir(), "b")
+	if err := a.Get("b", dest); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(dest); string(data) != "new b" {
+		t.Fatalf("Get got %q, want the replaced copy", data)
+	}
+
+	if err := a.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Get("a", dest); err == nil {
+		t.Fatal("Get of a deleted segment succeeded")
+	}
+	if names, _ := a.List(); fmt.Sprint(names) != "[b]" {
+		t.Fatalf("List after Delete got %v, want [b]", names)
+	}
+}
+
+// TestArchiveRetry checks that a failed upload is retried, and that Prune
+// keeps segments until they are archived.
+func TestArchiveRetry(t *testing.T) {
+	dir := t.TempDir()
+	archive := newTestArchive(t)
+	archive.failPuts = 1
+	w, err := New(dir, Options{SegmentMaxRecords: 2, Archive: archive})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	for i := 1; i <= 5; i++ {
+		if _, err := w.Write(testData(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	segments, err := listSegments(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	finalized := segments[:len(segments)-1]
+	if len(finalized) != 2 {
+		t.Fatalf("got %d finalized segments, want 2", len(finalized))
+	}
+
+	// The first upload failed and waits to be retried
+	waitFor(t, "the first upload", func() bool { return archive.putCount(filepath.Base(finalized[0].path)) > 0 })
+	if removed, err := w.Prune(4); err != nil || len(removed) != 0 {
+		t.Fatalf("Prune removed %v, %v before the segments were archived", removed, err)
+	}
+
+	for _, seg := range finalized {
+		waitFor(t, "segment to be archived", func() bool { return !w.archiver.isPending(seg.path) })
+	}
+	if n := archive.putCount(filepath.Base(finalized[0].path)); n != 2 {
+		t.Fatalf("first segment was uploaded %d times, want 2", n)
+	}
+	names, err := archive.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(names) != fmt.Sprint([]string{filepath.Base(finalized[0].path), filepath.Base(finalized[1].path)}) {
+		t.Fatalf("archive holds %v", names)
+	}
+	removed, err := w.Prune(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 2 {
+		t.Fatalf("Prune removed %v once archived, want both finalized segments", removed)
+	}
+}
+
+// TestArchiveCatchUp checks that segments left by an earlier run are kept
+// from pruning until the archive is listed, and only the missing ones are
+// uploaded.
+func TestArchiveCatchUp(t *testing.T) {
+	dir := t.TempDir()
+	paths := writeFiles(t, dir, "a", "b")
+	archive := newTestArchive(t)
+	if err := archive.LocalArchive.Put("a", paths[0]); err != nil {
+		t.Fatal(err)
+	}
+	archive.listGate = make(chan struct{})
+	a := newArchiver(archive)
+	defer a.close()
+	a.catchUp(paths)
+
+	for _, path := range paths {
+		if !a.isPending(path) {
+			t.Fatalf("%s not pending before the archive was listed", path)
+		}
+	}
+	if ready := a.ready(); len(ready) != 0 {
+		t.Fatalf("%v ready before the archive was listed", ready)
+	}
+	close(archive.listGate)
+	for _, path := range paths {
+		waitFor(t, path+" to be archived", func() bool { return !a.isPending(path) })
+	}
+	if archive.putCount("a") != 0 || archive.putCount("b") != 1 {
+		t.Fatalf("uploads %v, want b only", archive.puts)
+	}
+}
+
+// TestArchiveCatchUpListError checks that every segment is uploaded again
+// when the archive can't be listed.
+func TestArchiveCatchUpListError(t *testing.T) {
+	paths := writeFiles(t, t.TempDir(), "a", "b")
+	archive := newTestArchive(t)
+	archive.listErr = errors.New("list failed")
+	a := newArchiver(archive)
+	defer a.close()
+	a.catchUp(paths)
+	for _, path := range paths {
+		waitFor(t, path+" to be archived", func() bool { return !a.isPending(path) })
+	}
+	if archive.putCount("a") != 1 || archive.putCount("b") != 1 {
+		t.Fatalf("uploads %v, want a and b once", archive.puts)
+	}
+}
+
+// TestArchiverClose checks that close doesn't wait out the retry backoff,
+// and that a segment that still fails stays pending.
+func TestArchiverClose(t *testing.T) {
+	paths := writeFiles(t, t.TempDir(), "a")
+	archive := newTestArchive(t)
+	archive.failPuts = -1
+	a := newArchiver(archive)
+	a.add(paths[0])
+	waitFor(t, "the first upload", func() bool { return archive.putCount("a") > 0 })
+
+	start := time.Now()
+	a.close()
+	if elapsed := time.Since(start); elapsed >= archiveRetryMin {
+		t.Fatalf("close took %v, waiting out the retry backoff", elapsed)
+	}
+	if n := archive.putCount("a"); n != 2 {
+		t.Fatalf("segment uploaded %d times, want once more on close", n)
+	}
+	if !a.isPending(paths[0]) {
+		t.Fatal("failed segment no longer pending")
+	}
+}
@@ -0,0 +1,187 @@
+package wal
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"io"
+)
+
+// Compression is the algorithm record data is compressed with.
+type Compression string
+
+const (
+	// CompressNone stores record data as is.
+	CompressNone Compression = "none"
+	// CompressFlate compresses each record with DEFLATE (RFC 1951) at
+	// flate.BestSpeed. DEFLATE is what the standard library offers, so the
+	// WAL needs no compression dependency; records are compressed on the
+	// write path, so speed beats ratio.
+	CompressFlate Compression = "flate"
+)
+
+// ParseCompression validates a compression name. An empty name is
+// CompressNone.
+func ParseCompression(name string) (Compression, error) {
+	switch c := Compression(name); c {
+	case "":
+		return CompressNone, nil
+	case CompressNone, CompressFlate:
+		return c, nil
+	}
+	return "", fmt.Errorf("%w: %q", ErrBadCompression, name)
+}
+
+const (
+	compressNoneID  = 0
+	compressFlateID = 1
+
+	flagEncrypted = 1 << 0
+)
+
+var compressionIDs = map[Compression]byte{
+	CompressNone:  compressNoneID,
+	CompressFlate: compressFlateID,
+}
+
+// codec transforms record data between its stored and plain forms: compressed
+// first, then sealed with AES-GCM if there is a key. Record checksums cover
+// the stored form, so corruption is caught without the key.
+//
+// A codec reuses one flate writer and reader across records, as a new
+// writer allocates about a megabyte, so it isn't safe for concurrent use:
+// the Wal encodes under its lock, and each segment is decoded by one reader.
+type codec struct {
+	compression Compression
+	encrypted   bool
+	aead        cipher.AEAD // nil if not encrypted or the key is missing
+	fw          *flate.Writer
+	fr          io.ReadCloser
+}
+
+// newCodec returns the codec for compression and key. A nil key disables
+// encryption; otherwise it must be 16, 24 or 32 bytes for AES-128, -192 or
+// -256.
+func newCodec(compression Compression, key []byte) (*codec, error) {
+	if compression == "" {
+		compression = CompressNone
+	}
+	if _, ok := compressionIDs[compression]; !ok {
+		return nil, fmt.Errorf("%w: %q", ErrBadCompression, compression)
+	}
+	c := &codec{compression: compression, encrypted: key != nil}
+	if key != nil {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrBadEncryptionKey, err)
+		}
+		if c.aead, err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// encode returns data in its stored form.
+func (c *codec) encode(data []byte) ([]byte, error) {
+	if c.compression == CompressFlate {
+		var buf bytes.Buffer
+		if c.fw == nil {
+			fw, err := flate.NewWriter(&buf, flate.BestSpeed)
+			if err != nil {
+				return nil, err
+			}
+			c.fw = fw
+		} else {
+			c.fw.Reset(&buf)
+		}
+		if _, err := c.fw.Write(data); err != nil {
+			return nil, err
+		}
+		if err := c.fw.Close(); err != nil {
+			return nil, err
+		}
+		data = buf.Bytes()
+	}
+	if c.aead != nil {
+		nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(data)+c.aead.Overhead())
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, err
+		}
+		data = c.aead.Seal(nonce, nonce, data, nil)
+	}
+	return data, nil
+}
+
+// decode returns stored data in its plain form. The data passed its hash
+// check, so failing to open it means the key is wrong.
+func (c *codec) decode(data []byte) ([]byte, error) {
+	if c.encrypted {
+		if c.aead == nil {
+			return nil, ErrNoEncryptionKey
+		}
+		n := c.aead.NonceSize()
+		if len(data) < n {
+			return nil, ErrDecrypt
+		}
+		plain, err := c.aead.Open(nil, data[:n], data[n:], nil)
+		if err != nil {
+			return nil, ErrDecrypt
+		}
+		data = plain
+	}
+	if c.compression == CompressFlate {
+		if c.fr == nil {
+			c.fr = flate.NewReader(bytes.NewReader(data))
+		} else if err := c.fr.(flate.Resetter).Reset(bytes.NewReader(data), nil); err != nil {
+			return nil, err
+		}
+		plain, err := io.ReadAll(c.fr)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidWalData, err)
+		}
+		data = plain
+	}
+	return data, nil
+}
+
+// Codec stores data the way the WAL stores record data, for files kept
+// alongside it, like snapshots, that must be compressed and encrypted the
+// same way. Like the WAL's own codec, it isn't safe for concurrent use.
+type Codec struct {
+	c *codec
+}
+
+// NewCodec returns a Codec for compression and key, as Options takes them.
+// A nil key disables encryption.
+func NewCodec(compression Compression, key []byte) (*Codec, error) {
+	c, err := newCodec(compression, key)
+	if err != nil {
+		return nil, err
+	}
+	return &Codec{c: c}, nil
+}
+
+// Compression returns the compression the Codec applies.
+func (c *Codec) Compression() Compression {
+	return c.c.compression
+}
+
+// Encrypted reports whether the Codec encrypts.
+func (c *Codec) Encrypted() bool {
+	return c.c.encrypted
+}
+
+// Encode returns data in its stored form.
+func (c *Codec) Encode(data []byte) ([]byte, error) {
+	return c.c.encode(data)
+}
+
+// Decode returns stored data in its plain form. It fails with
+// ErrNoEncryptionKey or ErrDecrypt if the Codec has no key or the wrong one.
+func (c *Codec) Decode(data []byte) ([]byte, error) {
+	return c.c.decode(data)
+}
@@ -0,0 +1,129 @@
+package wal
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Convert rewrites the gob segments in dirPath in the current binary format
+// and returns the names of the segments it converted. Bare gob segments that
+// start their sequences over at 1 are renumbered to continue from the segment
+// before, as reading them does, so the converted log is consecutive throughout.
+// Record data is copied
+// as stored, so compressed and encrypted segments are converted without the
+// key. A segment that fails its checks is left as it was and stops the
+// conversion. The WAL must not be open for writing while converting.
+func Convert(dirPath string) ([]string, error) {
+	segments, err := listSegments(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	var converted []string
+	var prev int64 // last sequence of the segments before seg
+	for _, seg := range segments {
+		ok, last, err := convertSegment(seg.path, prev)
+		prev = last
+		if err != nil {
+			return converted, fmt.Errorf("%s: %w", filepath.Base(seg.path), err)
+		}
+		if ok {
+			converted = append(converted, filepath.Base(seg.path))
+		}
+	}
+	if len(converted) > 0 {
+		return converted, syncDir(dirPath)
+	}
+	return converted, nil
+}
+
+// convertSegment rewrites the segment at path in the current format, unless
+// it already is, and reports whether it did. prev is the last sequence of the
+// segments before it, and last the one the segment ends at. The new segment
+// replaces the old one only once it is complete.
+func convertSegment(path string, prev int64) (ok bool, last int64, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, prev, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return false, prev, err
+	}
+	pr := &positionReader{r: bufio.NewReader(f)}
+	records, hdr, err := openRecordReader(pr, info.Size(), nil)
+	if err != nil {
+		return false, prev, err
+	}
+	if hdr.version == segmentVersion {
+		return false, prev, nil
+	}
+
+	// The header needs the first sequence before any record is written
+	first, _, err := records.next()
+	if err != nil && err != io.EOF {
+		return false, prev, fmt.Errorf("offset %d: %w", pr.pos, err)
+	}
+	if first == nil {
+		// An empty segment still gets a header, starting after prev
+		first = &Record{Seq: prev + 1}
+		records = nil
+	}
+	shift := legacyOffset(hdr, first.Seq, prev)
+
+	tmpPath := path + ".convert"
+	out, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, fMode)
+	if err != nil {
+		return false, prev, err
+	}
+	last, err = writeConverted(out, hdr.codec, shift, first, records)
+	if err != nil {
+		out.Close()
+		os.Remove(tmpPath)
+		return false, prev, err
+	}
+	if err := Fsync(out); err != nil {
+		out.Close()
+		os.Remove(tmpPath)
+		return false, prev, err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmpPath)
+		return false, prev, err
+	}
+	return true, last, os.Rename(tmpPath, path)
+}
+
+// writeConverted writes the header and every record, starting with first, to
+// out, adding shift to their sequences, and returns the last sequence written.
+// Records must have valid checksums and consecutive sequences. A nil records
+// means the segment is empty and first only gives the header's sequence.
+func writeConverted(out io.Writer, c *codec, shift int64, first *Record, records recordReader) (int64, error) {
+	buf := bufio.NewWriter(out)
+	baseSeq := first.Seq + shift
+	if _, err := buf.Write(encodeSegmentHeader(c, baseSeq)); err != nil {
+		return 0, err
+	}
+	prev := baseSeq - 1
+	for record := first; records != nil; {
+		seq := record.Seq + shift
+		if seq != prev+1 {
+			return 0, fmt.Errorf("%w: %d after %d", ErrInvalidSeq, seq, prev)
+		}
+		if _, err := buf.Write(encodeRecord(seq, record.Data)); err != nil {
+			return 0, err
+		}
+		prev = seq
+		next, _, err := records.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, err
+		}
+		record = next
+	}
+	return prev, buf.Flush()
+}
@@ -14,4 +14,26 @@ var (
 	// recovery should stop here.
 	ErrInvalidWalData = errors.New("WAL: Invalid data found while recovering. Abort")
 	ErrBadWalName     = errors.New("WAL: Bad wal name")
+	// ErrBadRecoveryPolicy is raised for an unknown recovery policy name
+	ErrBadRecoveryPolicy = errors.New("WAL: Bad recovery policy")
+	// ErrBadSyncPolicy is raised for an unknown sync policy name
+	ErrBadSyncPolicy = errors.New("WAL: Bad sync policy")
+	// ErrWalClosed is raised when writing to a closed WAL
+	ErrWalClosed = errors.New("WAL: WAL is closed")
+	// ErrBadCompression is raised for an unknown compression name or id
+	ErrBadCompression = errors.New("WAL: Bad compression")
+	// ErrBadSegmentVersion is raised for a segment header written by a newer
+	// version
+	ErrBadSegmentVersion = errors.New("WAL: Unsupported segment version")
+	// ErrBadEncryptionKey is raised for a key that isn't a valid AES key
+	ErrBadEncryptionKey = errors.New("WAL: Bad encryption key")
+	// ErrNoEncryptionKey is raised when reading an encrypted segment without
+	// a key
+	ErrNoEncryptionKey = errors.New("WAL: Segment is encrypted and no key was given")
+	// ErrDirLocked is raised when another process holds the data directory
+	// lock
+	ErrDirLocked = errors.New("WAL: Data directory is locked by another process")
+	// ErrDecrypt is raised when a record that passed its hash check fails to
+	// decrypt, which means the key is wrong. Recovery can't continue.
+	ErrDecrypt = errors.New("WAL: Failed to decrypt record, wrong key?")
 )
@@ -0,0 +1,203 @@
+package wal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// Segment format
+//
+// A segment is a header followed by records, all integers big endian:
+//
+//	header (20 bytes)
+//	  magic        4  "PWAL"
+//	  version      1  segmentVersion
+//	  compression  1  0 none, 1 flate (raw DEFLATE, RFC 1951)
+//	  flags        1  bit 0: records are encrypted with AES-GCM
+//	  reserved     1  0
+//	  base seq     8  sequence of the segment's first record
+//	  crc          4  crc32c of the 16 bytes above
+//
+//	record (16 byte header + payload)
+//	  crc          4  crc32c of the rest of the record, length to payload
+//	  length       4  payload length in bytes
+//	  seq          8  record sequence number
+//	  payload      length bytes of data, compressed and then encrypted as
+//	                  the segment header says
+//
+// A record's extent is known from its header alone, so a torn tail is found
+// by its length running past the end of the segment, and a record failing its
+// crc can be skipped.
+//
+// Older segments are gob streams of Record, either bare (version 0) or after
+// a 7 byte header of magic, version 1, compression and flags. They are still
+// read, and Convert rewrites them in the current format. A gob stream can't
+// start with the magic: its first message defines a type, which puts 0xff in
+// the second byte.
+var segmentMagic = []byte("PWAL")
+
+const (
+	segmentVersion     = 2
+	gobSegmentVersion  = 1
+	segmentHeaderSize  = 20
+	gobHeaderSize      = 7
+	recordHeaderSize   = 16
+	segmentHeaderCRCAt = 16
+)
+
+// segmentHeader is what a segment's header says about it.
+type segmentHeader struct {
+	version byte
+	codec   *codec
+	baseSeq int64 // 0 before version 2
+}
+
+// encodeSegmentHeader returns the header for a segment whose first record
+// will be baseSeq.
+func encodeSegmentHeader(c *codec, baseSeq int64) []byte {
+	h := make([]byte, segmentHeaderSize)
+	copy(h, segmentMagic)
+	h[4] = segmentVersion
+	h[5] = compressionIDs[c.compression]
+	if c.encrypted {
+		h[6] |= flagEncrypted
+	}
+	binary.BigEndian.PutUint64(h[8:16], uint64(baseSeq))
+	binary.BigEndian.PutUint32(h[segmentHeaderCRCAt:], CalculateHash(h[:segmentHeaderCRCAt]))
+	return h
+}
+
+// readSegmentHeader consumes the header at the start of a segment, if there
+// is one. The codec it returns uses key for encrypted segments; without a
+// key, their records can be checked but not decoded.
+func readSegmentHeader(pr *positionReader, key []byte) (*segmentHeader, error) {
+	magic, err := pr.r.Peek(len(segmentMagic) + 1)
+	if err != nil || !bytes.Equal(magic[:len(segmentMagic)], segmentMagic) {
+		// A bare gob segment. One too short to hold a record is left for
+		// the record reader to report.
+		return &segmentHeader{codec: &codec{compression: CompressNone}}, nil
+	}
+	size := segmentHeaderSize
+	switch magic[len(segmentMagic)] {
+	case segmentVersion:
+	case gobSegmentVersion:
+		size = gobHeaderSize
+	default:
+		return nil, fmt.Errorf("%w: %d", ErrBadSegmentVersion, magic[len(segmentMagic)])
+	}
+	h := make([]byte, size)
+	if _, err := io.ReadFull(pr, h); err != nil {
+		return nil, fmt.Errorf("%w: truncated segment header", ErrInvalidWalData)
+	}
+	hdr := &segmentHeader{version: h[4]}
+	if hdr.version == segmentVersion {
+		if binary.BigEndian.Uint32(h[segmentHeaderCRCAt:]) != CalculateHash(h[:segmentHeaderCRCAt]) {
+			return nil, fmt.Errorf("%w: bad segment header checksum", ErrInvalidWalData)
+		}
+		hdr.baseSeq = int64(binary.BigEndian.Uint64(h[8:16]))
+	}
+
+	c := &codec{}
+	for name, id := range compressionIDs {
+		if id == h[5] {
+			c.compression = name
+		}
+	}
+	if c.compression == "" {
+		return nil, fmt.Errorf("%w: id %d", ErrBadCompression, h[5])
+	}
+	if h[6]&flagEncrypted != 0 && key != nil {
+		if c, err = newCodec(c.compression, key); err != nil {
+			return nil, err
+		}
+	} else {
+		c.encrypted = h[6]&flagEncrypted != 0
+	}
+	hdr.codec = c
+	return hdr, nil
+}
+
+// encodeRecord returns a record in the current format.
+func encodeRecord(seq int64, data []byte) []byte {
+	b := make([]byte, recordHeaderSize+len(data))
+	binary.BigEndian.PutUint32(b[4:8], uint32(len(data)))
+	binary.BigEndian.PutUint64(b[8:16], uint64(seq))
+	copy(b[recordHeaderSize:], data)
+	binary.BigEndian.PutUint32(b[0:4], CalculateHash(b[4:]))
+	return b
+}
+
+// recordReader reads the records of a segment in order.
+type recordReader interface {
+	// next returns the next record, with its data in stored form, or io.EOF
+	// at the end of the segment. With an error, framed reports whether the
+	// bad record's extent is known, so reading can go on past it.
+	next() (record *Record, framed bool, err error)
+}
+
+// openRecordReader reads the segment header from pr and returns a reader for
+// the records after it. size is the size of the segment.
+func openRecordReader(pr *positionReader, size int64, key []byte) (recordReader, *segmentHeader, error) {
+	hdr, err := readSegmentHeader(pr, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if hdr.version == segmentVersion {
+		return &frameReader{r: pr, size: size}, hdr, nil
+	}
+	return &gobReader{decoder: gob.NewDecoder(pr)}, hdr, nil
+}
+
+// frameReader reads records in the current format.
+type frameReader struct {
+	r    *positionReader
+	size int64
+	hdr  [recordHeaderSize]byte
+}
+
+func (f *frameReader) next() (*Record, bool, error) {
+	if _, err := io.ReadFull(f.r, f.hdr[:]); err == io.EOF {
+		return nil, false, io.EOF
+	} else if err != nil {
+		return nil, false, fmt.Errorf("%w: truncated record header", ErrInvalidWalData)
+	}
+	sum := binary.BigEndian.Uint32(f.hdr[0:4])
+	length := int64(binary.BigEndian.Uint32(f.hdr[4:8]))
+	seq := int64(binary.BigEndian.Uint64(f.hdr[8:16]))
+	if length > f.size-f.r.pos {
+		return nil, false, fmt.Errorf("%w: record of %d bytes runs past the end of the segment", ErrInvalidWalData, length)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(f.r, data); err != nil {
+		return nil, false, fmt.Errorf("%w: %v", ErrInvalidWalData, err)
+	}
+	h := crc32.New(crcTable)
+	h.Write(f.hdr[4:])
+	h.Write(data)
+	record := &Record{Seq: seq, Hash: sum, Data: data}
+	if h.Sum32() != sum {
+		return record, true, ErrInvalidWalData
+	}
+	return record, true, nil
+}
+
+// gobReader reads records in the gob format of older segments.
+type gobReader struct {
+	decoder *gob.Decoder
+}
+
+func (g *gobReader) next() (*Record, bool, error) {
+	record := &Record{}
+	if err := g.decoder.Decode(record); err != nil {
+		// The gob stream can't be resynchronized after a decode error
+		return nil, false, err
+	}
+	if !record.validHash() {
+		return record, true, ErrInvalidWalData
+	}
+	return record, true, nil
+}
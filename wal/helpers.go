@@ -1,18 +1,20 @@
 package wal
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
 	"hash/crc32"
+	"io"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 	"syscall"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
-	"github.com/rickcollette/primodb/serverconfig"
 )
 
 const (
@@ -39,12 +41,87 @@ func Exists(path string) bool {
 	}
 	return true
 }
-func parseWalName(str string) (seq int64, err error) {
-	if !strings.HasSuffix(str, ".wal") {
-		return 0, ErrBadWalName
+func parseWalName(str string) (seq int64, isTmp bool, err error) {
+	switch {
+	case strings.HasSuffix(str, tmpWalExtension):
+		_, err = fmt.Sscanf(str, "%016x.wal.tmp", &seq)
+		return seq, true, err
+	case strings.HasSuffix(str, walExtension):
+		_, err = fmt.Sscanf(str, "%016x.wal", &seq)
+		return seq, false, err
 	}
-	_, err = fmt.Sscanf(str, "%016x.wal", &seq)
-	return seq, err
+	return 0, false, ErrBadWalName
+}
+
+// segment is a WAL file on disk: finalized (.wal), or still being written or
+// left behind by a crash (.wal.tmp)
+type segment struct {
+	baseSeq int64
+	path    string
+	isTmp   bool
+}
+
+// listSegments returns the WAL segments in dirPath ordered by base sequence
+func listSegments(dirPath string) ([]segment, error) {
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	var segments []segment
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		seq, isTmp, err := parseWalName(entry.Name())
+		if err == ErrBadWalName {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		segments = append(segments, segment{baseSeq: seq, path: filepath.Join(dirPath, entry.Name()), isTmp: isTmp})
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		if segments[i].baseSeq != segments[j].baseSeq {
+			return segments[i].baseSeq < segments[j].baseSeq
+		}
+		return !segments[i].isTmp
+	})
+	return segments, nil
+}
+
+// firstSeq returns the sequence number of the first record in the segment at
+// path; ok is false if the segment has no complete record, or is a bare gob
+// segment, whose sequences only mean something read after the ones before it
+// (see legacyOffset).
+func firstSeq(path string) (seq int64, ok bool, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, false, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, false, err
+	}
+	pr := &positionReader{r: bufio.NewReader(f)}
+	records, hdr, err := openRecordReader(pr, info.Size(), nil)
+	if errors.Is(err, ErrInvalidWalData) {
+		// A damaged header, left by a crash while starting the segment
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+	if hdr.version == 0 {
+		return 0, false, nil
+	}
+	record, _, err := records.next()
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF || errors.Is(err, ErrInvalidWalData) {
+			return 0, false, nil
+		}
+		return 0, false, err
+	}
+	return record.Seq, true, nil
 }
 
 // Fsync full file sync to flush data on disk from temporary buffer
@@ -52,12 +129,29 @@ func Fsync(f *os.File) (err error) {
 	err = f.Sync()
 	return err
 }
+
+// syncDir fsyncs a directory so renames and new files in it are durable
+func syncDir(dirPath string) error {
+	d, err := os.Open(dirPath)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// fileLock takes an exclusive flock on path, creating the file if needed. It
+// doesn't wait: if another process holds the lock, it returns
+// syscall.EWOULDBLOCK along with the open file, so the caller can read it.
 func fileLock(path string) (*os.File, error) {
-	f, err := os.OpenFile(path, fileOpenFlag, fileOpenMode)
+	f, err := os.OpenFile(path, fileOpenFlag|os.O_CREATE, fileOpenMode)
 	if err != nil {
 		return nil, err
 	}
-	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		if err == syscall.EWOULDBLOCK {
+			return f, err
+		}
 		f.Close()
 		return nil, err
 	}
@@ -65,50 +159,41 @@ func fileLock(path string) (*os.File, error) {
 	return f, nil
 }
 
-// validSeq checks if seq is a monotonically increasing sequence
-func (w *Wal) validSeq(seq int64) bool {
-	return seq == w.nextseq()
-}
-func (r *Record) validHash() bool {
-	return r.Hash == CalculateHash(r.Data)
-}
-
-// Return the latest file based on name
-func latestFile(dirPath string, ext string) (os.FileInfo, error) {
-	entries, err := os.ReadDir(dirPath)
+// truncateFile cuts the file at path down to size bytes and syncs it
+func truncateFile(path string, size int64) error {
+	f, err := os.OpenFile(path, fileOpenFlag, fileOpenMode)
 	if err != nil {
-		return nil, err
+		return err
 	}
-
-	var latestWal os.FileInfo
-	for i := len(entries) - 1; i >= 0; i-- {
-		entry := entries[i]
-		if entry.IsDir() {
-			continue
-		}
-
-		if strings.HasSuffix(entry.Name(), ext) {
-			info, err := entry.Info()
-			if err != nil {
-				return nil, err
-			}
-			latestWal = info
-			break
-		}
+	defer f.Close()
+	if err := f.Truncate(size); err != nil {
+		return err
 	}
+	return Fsync(f)
+}
 
-	return latestWal, nil
+// validSeq checks if seq is a monotonically increasing sequence. Sequences
+// continue across segments, so the first record read sets the starting point.
+func (w *Wal) validSeq(seq int64) bool {
+	if w.seq != 0 && seq != w.seq+1 {
+		return false
+	}
+	w.seq = seq
+	return true
 }
 
-// InitializeS3Session initializes an S3 session
-func InitializeS3Session(config serverconfig.S3Config) (*s3manager.Uploader, *s3manager.Downloader) {
-	sess := session.Must(session.NewSession(&aws.Config{
-		Region:      aws.String(config.Region),
-		Credentials: credentials.NewStaticCredentials(config.AccessKey, config.SecretKey, ""),
-	}))
-	uploader := s3manager.NewUploader(sess)
-	downloader := s3manager.NewDownloader(sess)
-	return uploader, downloader
+// legacyOffset returns what to add to the sequences of a segment whose first
+// record has sequence first, when the segments before it ended at prev.
+// Before sequences carried over between runs, every run started over at 1, so
+// a bare gob segment that does is read as continuing from prev.
+func legacyOffset(hdr *segmentHeader, first, prev int64) int64 {
+	if hdr.version == 0 && prev > 0 && first == 1 {
+		return prev
+	}
+	return 0
+}
+func (r *Record) validHash() bool {
+	return r.Hash == CalculateHash(r.Data)
 }
 
 // UploadToS3 uploads a file to S3
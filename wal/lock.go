@@ -0,0 +1,76 @@
+package wal
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// LockFileName is the file in a data directory that DirLock locks.
+const LockFileName = "LOCK"
+
+// DirLock is an exclusive lock on a data directory, so only one process at a
+// time writes its WAL. The lock is an flock, released by the kernel if the
+// process dies, and the LOCK file holds the PID of the process holding it.
+type DirLock struct {
+	file *os.File
+}
+
+// LockDir takes the lock on dirPath, which must exist. If another process
+// holds it, LockDir fails at once with ErrDirLocked, naming that process.
+func LockDir(dirPath string) (*DirLock, error) {
+	path := filepath.Join(dirPath, LockFileName)
+	f, err := fileLock(path)
+	if err == syscall.EWOULDBLOCK {
+		defer f.Close()
+		if pid := readPID(f); pid > 0 {
+			return nil, fmt.Errorf("%w: %s is held by pid %d", ErrDirLocked, path, pid)
+		}
+		return nil, fmt.Errorf("%w: %s", ErrDirLocked, path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := writePID(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &DirLock{file: f}, nil
+}
+
+// Unlock releases the lock. The LOCK file is left behind; its PID is only
+// meaningful while the file is locked.
+func (l *DirLock) Unlock() error {
+	if l == nil || l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+func writePID(f *os.File) error {
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0); err != nil {
+		return err
+	}
+	return Fsync(f)
+}
+
+func readPID(f *os.File) int {
+	data, err := io.ReadAll(io.LimitReader(f, 32))
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0
+	}
+	return pid
+}
@@ -0,0 +1,64 @@
+package wal
+
+import (
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// S3Archive is an ArchiveBackend that keeps segments in an S3 bucket.
+type S3Archive struct {
+	bucket     string
+	client     *s3.S3
+	uploader   *s3manager.Uploader
+	downloader *s3manager.Downloader
+}
+
+// NewS3Archive returns an S3Archive storing segments in bucket.
+func NewS3Archive(sess *session.Session, bucket string) *S3Archive {
+	return &S3Archive{
+		bucket:     bucket,
+		client:     s3.New(sess),
+		uploader:   s3manager.NewUploader(sess),
+		downloader: s3manager.NewDownloader(sess),
+	}
+}
+
+// Put uploads the segment to the bucket.
+func (a *S3Archive) Put(name, srcPath string) error {
+	return UploadToS3(a.uploader, a.bucket, name, srcPath)
+}
+
+// Get downloads an archived segment to destPath.
+func (a *S3Archive) Get(name, destPath string) error {
+	return DownloadFromS3(a.downloader, a.bucket, name, destPath)
+}
+
+// List returns the names of the objects in the bucket in name order.
+func (a *S3Archive) List() ([]string, error) {
+	var names []string
+	err := a.client.ListObjectsV2Pages(&s3.ListObjectsV2Input{Bucket: aws.String(a.bucket)},
+		func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			for _, obj := range page.Contents {
+				names = append(names, aws.StringValue(obj.Key))
+			}
+			return true
+		})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Delete removes an archived segment from the bucket.
+func (a *S3Archive) Delete(name string) error {
+	_, err := a.client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(a.bucket),
+		Key:    aws.String(name),
+	})
+	return err
+}
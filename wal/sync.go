@@ -0,0 +1,198 @@
+package wal
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// SyncPolicy decides when written records are fsynced to disk.
+type SyncPolicy string
+
+const (
+	// SyncAlways fsyncs every record before Write returns.
+	SyncAlways SyncPolicy = "always"
+	// SyncGroup fsyncs concurrent writes together. Write still returns only
+	// once its record is durable; Append lets callers wait for that after
+	// releasing their own locks, so their writes can share an fsync. A
+	// failed group commit fails every later write, see groupCommit.
+	SyncGroup SyncPolicy = "group"
+	// SyncInterval fsyncs in the background at least every
+	// Options.SyncInterval. Write returns before its record is durable.
+	SyncInterval SyncPolicy = "interval"
+	// SyncNone leaves flushing to the operating system. Segments are still
+	// fsynced when they are finalized.
+	SyncNone SyncPolicy = "none"
+
+	// DefaultSyncInterval is the max delay used by SyncInterval when Options
+	// doesn't set one.
+	DefaultSyncInterval = 10 * time.Millisecond
+)
+
+// ParseSyncPolicy validates a sync policy name. An empty name is SyncAlways.
+func ParseSyncPolicy(name string) (SyncPolicy, error) {
+	switch policy := SyncPolicy(name); policy {
+	case "":
+		return SyncAlways, nil
+	case SyncAlways, SyncGroup, SyncInterval, SyncNone:
+		return policy, nil
+	}
+	return "", fmt.Errorf("%w: %q", ErrBadSyncPolicy, name)
+}
+
+// groupBatch is the records appended since the last group commit. done is
+// closed once they are fsynced, or failed to be with err.
+type groupBatch struct {
+	err  error
+	done chan struct{}
+}
+
+// Pending is returned by Append for a record that may not be durable yet.
+type Pending struct {
+	batch *groupBatch
+}
+
+// Wait returns once the record is as durable as the sync policy makes it,
+// or with the error that kept it from being written.
+func (p Pending) Wait() error {
+	if p.batch == nil {
+		return nil
+	}
+	<-p.batch.done
+	return p.batch.err
+}
+
+// Sync returns once every record appended before it is durable, or with the
+// error that kept them from being written. Under SyncGroup it waits for the
+// pending group commit, under SyncInterval and SyncNone it fsyncs the
+// segment.
+func (w *Wal) Sync() error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return ErrWalClosed
+	}
+	if w.opts.Sync == SyncGroup {
+		// A batch the flusher took already is durable unless it failed
+		if w.failed != nil {
+			w.mu.Unlock()
+			return w.failed
+		}
+		pending := Pending{batch: w.batch}
+		w.mu.Unlock()
+		return pending.Wait()
+	}
+	defer w.mu.Unlock()
+	if !w.dirty {
+		return nil
+	}
+	if err := Fsync(w.file); err != nil {
+		return err
+	}
+	w.dirty = false
+	return nil
+}
+
+// startSync starts the background goroutine the sync policy needs, if any.
+func (w *Wal) startSync() {
+	switch w.opts.Sync {
+	case SyncGroup:
+		w.flush = make(chan struct{}, 1)
+		go w.groupCommit()
+	case SyncInterval:
+		go w.intervalSync()
+	default:
+		close(w.syncDone)
+	}
+}
+
+// appendGroup buffers data for the group commit flusher, waking it if this
+// starts a new batch. The caller must hold w.mu.
+func (w *Wal) appendGroup(data []byte) (int64, Pending, error) {
+	select {
+	case <-w.closing:
+		// The flusher may have taken its last batch already
+		return 0, Pending{}, ErrWalClosed
+	default:
+	}
+	if w.failed != nil {
+		return 0, Pending{}, w.failed
+	}
+	seq, err := w.append(data)
+	if err != nil {
+		return 0, Pending{}, err
+	}
+	if w.batch == nil {
+		w.batch = &groupBatch{done: make(chan struct{})}
+		select {
+		case w.flush <- struct{}{}:
+		default:
+		}
+	}
+	return seq, Pending{batch: w.batch}, nil
+}
+
+// groupCommit writes the records appended since the last batch with a single
+// write and fsync, then wakes their callers. Records appended while a batch
+// is being synced form the next batch. A failed batch is dropped from the
+// segment, and the Wal refuses later writes with its error: its callers may
+// have applied the records already, so the log can't safely carry on as if
+// they never happened.
+func (w *Wal) groupCommit() {
+	defer close(w.syncDone)
+	for {
+		stop := false
+		select {
+		case <-w.flush:
+		case <-w.closing:
+			stop = true
+		}
+
+		w.mu.Lock()
+		batch := w.batch
+		w.batch = nil
+		var err error
+		if batch != nil {
+			if err = w.commit(true); err != nil {
+				w.failed = err
+				log.Printf("WAL: group commit to %s failed, refusing further writes: %v", w.walPath(true), err)
+			}
+		}
+		w.mu.Unlock()
+		if batch != nil {
+			batch.err = err
+			close(batch.done)
+		}
+		if stop {
+			return
+		}
+	}
+}
+
+// intervalSync fsyncs the current segment every sync interval if anything
+// was written since the last fsync.
+func (w *Wal) intervalSync() {
+	defer close(w.syncDone)
+	interval := w.opts.SyncInterval
+	if interval <= 0 {
+		interval = DefaultSyncInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-w.closing:
+			return
+		}
+		w.mu.Lock()
+		if w.dirty {
+			if err := Fsync(w.file); err != nil {
+				log.Printf("WAL: failed to sync %s: %v", w.walPath(true), err)
+			} else {
+				w.dirty = false
+			}
+		}
+		w.mu.Unlock()
+	}
+}
@@ -0,0 +1,193 @@
+package wal
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// DiscardedExtension is appended to segments set aside by TruncateAfter.
+const DiscardedExtension = ".discarded"
+
+// Cut describes a segment affected by TruncateAfter.
+type Cut struct {
+	Segment   string // segment file name
+	Discarded string // name of the copy holding the segment's old contents
+	Truncated bool   // Segment still exists, holding the records up to the cut
+}
+
+// SetAside renames the file at path to a name ending in DiscardedExtension
+// and returns that name. A segment cut more than once, or a segment number
+// reused after it was discarded, is set aside again next to its older copies
+// rather than over them: the first copy is named path+DiscardedExtension, the
+// next ones get a counter before the extension.
+func SetAside(path string) (string, error) {
+	discarded := path + DiscardedExtension
+	for n := 1; ; n++ {
+		if _, err := os.Lstat(discarded); os.IsNotExist(err) {
+			break
+		} else if err != nil {
+			return "", err
+		}
+		discarded = path + "." + strconv.Itoa(n) + DiscardedExtension
+	}
+	if err := os.Rename(path, discarded); err != nil {
+		return "", err
+	}
+	return filepath.Base(discarded), nil
+}
+
+// discardedName returns the name of the file a name SetAside returned was
+// set aside from.
+func discardedName(name string) (string, bool) {
+	name, ok := strings.CutSuffix(name, DiscardedExtension)
+	if !ok {
+		return "", false
+	}
+	if i := strings.LastIndexByte(name, '.'); i >= 0 {
+		if _, err := strconv.Atoi(name[i+1:]); err == nil {
+			name = name[:i]
+		}
+	}
+	return name, true
+}
+
+// TruncateAfter cuts the WAL in dirPath back to the records with Seq <= seq,
+// for point-in-time recovery. Nothing is deleted: every segment holding
+// later records is set aside with SetAside, and the one the cut falls in is
+// rewritten with only its earlier records. The segments must be valid up to
+// the cut.
+func TruncateAfter(dirPath string, seq int64) ([]Cut, error) {
+	segments, err := listSegments(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	var cuts []Cut
+	var prev int64 // last sequence of the segments before seg
+	for _, seg := range segments {
+		name := filepath.Base(seg.path)
+		offset, last, found, err := cutOffset(seg.path, seq, prev)
+		prev = last
+		if err != nil {
+			return cuts, fmt.Errorf("%s: %w", name, err)
+		}
+		if !found {
+			continue
+		}
+		cut := Cut{Segment: name}
+		if offset > 0 {
+			if err := copyHead(seg.path, seg.path+".cut", offset); err != nil {
+				os.Remove(seg.path + ".cut")
+				return cuts, err
+			}
+		}
+		if cut.Discarded, err = SetAside(seg.path); err != nil {
+			return cuts, err
+		}
+		if offset > 0 {
+			if err := os.Rename(seg.path+".cut", seg.path); err != nil {
+				return cuts, err
+			}
+			cut.Truncated = true
+		}
+		cuts = append(cuts, cut)
+	}
+	if len(cuts) > 0 {
+		return cuts, syncDir(dirPath)
+	}
+	return cuts, nil
+}
+
+// cutOffset returns where the first record with a sequence after seq starts
+// in the segment at path, or 0 if it is the segment's first record; found is
+// false if there is none. prev is the last sequence of the segments before
+// it, and last is the one the segment ends at, or prev if it has no records.
+func cutOffset(path string, seq, prev int64) (offset, last int64, found bool, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, prev, false, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, prev, false, err
+	}
+	pr := &positionReader{r: bufio.NewReader(f)}
+	records, hdr, err := openRecordReader(pr, info.Size(), nil)
+	if err != nil {
+		return 0, prev, false, err
+	}
+	first := pr.pos
+	last = prev
+	var shift int64
+	for {
+		start := pr.pos
+		record, _, err := records.next()
+		if err == io.EOF {
+			return 0, last, false, nil
+		} else if err != nil {
+			return 0, last, false, fmt.Errorf("offset %d: %w", start, err)
+		}
+		if start == first {
+			shift = legacyOffset(hdr, record.Seq, prev)
+		}
+		last = record.Seq + shift
+		if last > seq {
+			if start == first {
+				return 0, last, true, nil
+			}
+			return start, last, true, nil
+		}
+	}
+}
+
+// copyHead copies the first n bytes of src to dest and fsyncs dest
+func copyHead(src, dest string, n int64) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dest, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, fMode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.CopyN(out, in, n); err != nil {
+		out.Close()
+		return err
+	}
+	if err := Fsync(out); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// maxDiscardedBase returns the highest base sequence among the segments in
+// dirPath that TruncateAfter set aside.
+func maxDiscardedBase(dirPath string) (int64, bool, error) {
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return 0, false, err
+	}
+	var max int64
+	var found bool
+	for _, entry := range entries {
+		name, ok := discardedName(entry.Name())
+		if !ok {
+			continue
+		}
+		seq, _, err := parseWalName(name)
+		if err != nil {
+			continue
+		}
+		if !found || seq > max {
+			max, found = seq, true
+		}
+	}
+	return max, found, nil
+}
@@ -1,7 +1,10 @@
 package wal
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -9,20 +12,119 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
+)
+
+const (
+	walExtension    = ".wal"
+	tmpWalExtension = ".wal.tmp"
+	fMode           = os.FileMode(0644)
 
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
-	"github.com/rickcollette/primodb/serverconfig"
+	// DefaultSegmentMaxBytes is the segment size limit used when Options
+	// doesn't set one.
+	DefaultSegmentMaxBytes = 64 << 20
 )
 
+// Options tunes a Wal opened for writing.
+type Options struct {
+	// SegmentMaxBytes rolls over to a new segment once the current one
+	// reaches this size. 0 uses DefaultSegmentMaxBytes.
+	SegmentMaxBytes int64
+	// SegmentMaxRecords rolls over to a new segment after this many
+	// records. 0 means no record limit.
+	SegmentMaxRecords int64
+	// LastSeq is the sequence of the last record already in the log, as
+	// returned by LastSeq after reading it. New records continue from it.
+	LastSeq int64
+	// Sync decides when records are fsynced. Empty means SyncAlways.
+	Sync SyncPolicy
+	// SyncInterval is the max delay before a record is fsynced under
+	// SyncInterval. 0 uses DefaultSyncInterval.
+	SyncInterval time.Duration
+	// Archive, when set, receives a copy of every finalized segment.
+	Archive ArchiveBackend
+	// Compression is applied to each record's data. Empty means
+	// CompressNone.
+	Compression Compression
+	// EncryptionKey, when set, seals each record's data with AES-GCM. It
+	// must be 16, 24 or 32 bytes.
+	EncryptionKey []byte
+}
+
+// RecoveryPolicy decides what reading the WAL does with corrupted records.
+type RecoveryPolicy string
+
 const (
-	walExtension         = ".wal"
-	tmpWalExtension      = ".wal.tmp"
-	fMode                = os.FileMode(0644)
-	walChannelBufferSize = 100
-	logSync              = true
+	// Strict fails the read at the first corrupted record.
+	Strict RecoveryPolicy = "strict"
+	// TruncateTail cuts the last segment back to its last valid record, which
+	// is what a write torn by a crash looks like. Corruption anywhere else,
+	// and missing sequences anywhere, fail the read.
+	TruncateTail RecoveryPolicy = "truncate-tail"
+	// SkipCorrupt drops corrupted records and keeps reading. A record that
+	// can't be decoded loses the rest of its segment.
+	SkipCorrupt RecoveryPolicy = "skip-corrupt"
 )
 
+// ParseRecoveryPolicy validates a policy name. An empty name is Strict.
+func ParseRecoveryPolicy(name string) (RecoveryPolicy, error) {
+	switch policy := RecoveryPolicy(name); policy {
+	case "":
+		return Strict, nil
+	case Strict, TruncateTail, SkipCorrupt:
+		return policy, nil
+	}
+	return "", fmt.Errorf("%w: %q", ErrBadRecoveryPolicy, name)
+}
+
+// Damage describes corrupted WAL data that was dropped while reading.
+type Damage struct {
+	Segment string // segment file name
+	Offset  int64  // where the dropped bytes start
+	Bytes   int64  // how many bytes were dropped
+	Err     error  // what was wrong with them
+}
+
+func (d Damage) String() string {
+	if d.Bytes == 0 {
+		return fmt.Sprintf("%s: at offset %d: %v", d.Segment, d.Offset, d.Err)
+	}
+	return fmt.Sprintf("%s: dropped %d bytes at offset %d: %v", d.Segment, d.Bytes, d.Offset, d.Err)
+}
+
+// positionReader tracks how far into a segment the decoder has read, so
+// recovery knows where each record ends.
+type positionReader struct {
+	r   *bufio.Reader
+	pos int64
+}
+
+func (p *positionReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.pos += int64(n)
+	return n, err
+}
+
+func (p *positionReader) ReadByte() (byte, error) {
+	c, err := p.r.ReadByte()
+	if err == nil {
+		p.pos++
+	}
+	return c, err
+}
+
+// countingWriter tracks how many bytes were written to the current segment.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
 // Record stores individual db command record. Each record
 // contains complete data about a command.
 type Record struct {
@@ -33,17 +135,29 @@ type Record struct {
 
 // Wal datatype
 type Wal struct {
-	baseSeq      int64
-	seq          int64 // The wal file start sequence
-	dirPath      string
-	mu           sync.Mutex
-	file         *os.File
-	encoder      *gob.Encoder
-	decoder      *gob.Decoder
-	s3Uploader   *s3manager.Uploader
-	s3Downloader *s3manager.Downloader
-	useS3        bool
-	s3Bucket     string
+	baseSeq   int64
+	seq       int64 // The wal file start sequence
+	dirPath   string
+	mu        sync.Mutex
+	file      *os.File
+	archiver  *archiver
+	codec     *codec // how new records are stored
+	key       []byte // decrypts encrypted segments when reading
+	opts      Options
+	segments  []segment       // segments to read, oldest first
+	written   *countingWriter // bytes in the current segment
+	records   int64           // records in the current segment
+	policy    RecoveryPolicy
+	buf       bytes.Buffer  // encoded records not yet written to file
+	unwritten int64         // records in buf
+	dirty     bool          // written to file but not fsynced
+	batch     *groupBatch   // records in buf waiting for group commit
+	flush     chan struct{} // wakes the group commit flusher
+	failed    error         // why a group commit failed, refusing writes
+	closing   chan struct{} // closed by Close to stop the sync goroutine
+	syncDone  chan struct{} // closed once the sync goroutine exited
+	closeOnce sync.Once
+	closed    bool
 }
 
 func walName(seq int64) string {
@@ -84,78 +198,266 @@ func (w *Wal) nextseq() int64 {
 func (w *Wal) newWalFile() error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
-	latestWal, err := latestFile(w.dirPath, walExtension)
+	segments, err := listSegments(w.dirPath)
 	if err != nil {
-		// TODO: check what error is this and make is specific
 		return err
 	}
-	if latestWal != nil {
-		walName := latestWal.Name()
-		seq, err := parseWalName(filepath.Base(walName))
-		if err != nil {
+	for _, seg := range segments {
+		// A .tmp left by a previous run is complete as far as it goes;
+		// finalize it instead of appending to it.
+		if seg.isTmp {
+			if err := os.Rename(seg.path, strings.TrimSuffix(seg.path, ".tmp")); err != nil {
+				return err
+			}
+		}
+	}
+	if len(segments) > 0 {
+		// Each run starts a new segment after the newest existing one.
+		w.baseSeq = segments[len(segments)-1].baseSeq + 1
+		if err := syncDir(w.dirPath); err != nil {
 			return err
 		}
-		w.baseSeq = seq
-		// Each run creates a new wal but if a .wal file already exists, use the next seq no for creating a new file.
-		w.baseSeq++
 	}
+	// Discarded segment numbers aren't reused either, so an archived copy of
+	// one is never overwritten.
+	if base, ok, err := maxDiscardedBase(w.dirPath); err != nil {
+		return err
+	} else if ok && base >= w.baseSeq {
+		w.baseSeq = base + 1
+	}
+	w.seq = w.opts.LastSeq
+	return w.startSegment()
+}
+
+// startSegment opens the .tmp file for w.baseSeq and resets the per-segment
+// counters. The caller must hold w.mu.
+func (w *Wal) startSegment() error {
 	if err := w.touchWal(w.walPath(true)); err != nil {
 		return err
 	}
-	gob.Register(Record{})
-	w.encoder = gob.NewEncoder(w.file)
-	w.decoder = gob.NewDecoder(w.file)
-	return err
+	info, err := w.file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		// The header isn't counted as written, so a segment holding only
+		// the header is still removed as empty on Close
+		if _, err := w.file.Write(encodeSegmentHeader(w.codec, w.seq+1)); err != nil {
+			return err
+		}
+	}
+	w.written = &countingWriter{w: &w.buf, n: info.Size()}
+	w.records = 0
+	return nil
+}
+
+// finalizeSegment syncs the current segment and renames it from .wal.tmp to
+// .wal. The caller must hold w.mu.
+func (w *Wal) finalizeSegment() error {
+	if err := Fsync(w.file); err != nil {
+		return err
+	}
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	if err := w.Rename(); err != nil {
+		return err
+	}
+	if err := syncDir(w.dirPath); err != nil {
+		return err
+	}
+	if w.archiver != nil {
+		w.archiver.add(w.walPath(false))
+	}
+	return nil
+}
+
+// rotate finalizes the current segment and starts the next one. The caller
+// must hold w.mu.
+func (w *Wal) rotate() error {
+	if err := w.finalizeSegment(); err != nil {
+		return err
+	}
+	w.baseSeq++
+	return w.startSegment()
+}
+
+// segmentFull reports whether the current segment reached a rotation limit.
+func (w *Wal) segmentFull() bool {
+	maxBytes := w.opts.SegmentMaxBytes
+	if maxBytes <= 0 {
+		maxBytes = DefaultSegmentMaxBytes
+	}
+	if w.written.n >= maxBytes {
+		return true
+	}
+	return w.opts.SegmentMaxRecords > 0 && w.records >= w.opts.SegmentMaxRecords
 }
 func (w *Wal) openWalFile() error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
-	latestWal, err := latestFile(w.dirPath, walExtension)
+	segments, err := listSegments(w.dirPath)
 	if err != nil {
-		// TODO: check what error is this and make is specific
 		return err
 	}
-	if latestWal == nil {
+	if len(segments) == 0 {
 		return ErrWalNotFound
 	}
-	walName := latestWal.Name()
-	seq, err := parseWalName(filepath.Base(walName))
+	w.segments = segments
+	w.baseSeq = segments[len(segments)-1].baseSeq
+	gob.Register(Record{})
+	return nil
+}
+
+// readSegments decodes every record of every segment, oldest first, and
+// calls fn for each, stopping at the first error fn returns. Sequence numbers
+// must continue across segment boundaries, except that a bare gob segment
+// written before they did may start over at 1. Corrupted data is handled
+// according to w.policy and whatever was dropped is returned.
+func (w *Wal) readSegments(fn func(*Record) error) ([]Damage, error) {
+	var damage []Damage
+	for i, seg := range w.segments {
+		if err := w.openFile(seg.path); err != nil {
+			return damage, err
+		}
+		d, err := w.readSegment(seg, i == len(w.segments)-1, fn)
+		w.file.Close()
+		damage = append(damage, d...)
+		if err != nil {
+			return damage, fmt.Errorf("%s: %w", filepath.Base(seg.path), err)
+		}
+	}
+	return damage, nil
+}
+
+func (w *Wal) readSegment(seg segment, last bool, fn func(*Record) error) ([]Damage, error) {
+	info, err := w.file.Stat()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	w.baseSeq = seq
-	if err := w.openFile(w.walPath(false)); err != nil {
-		return err
+	size := info.Size()
+	pr := &positionReader{r: bufio.NewReader(w.file)}
+	records, hdr, err := openRecordReader(pr, size, w.key)
+	if errors.Is(err, ErrInvalidWalData) {
+		return w.badHeader(seg, last, size, err)
+	} else if err != nil {
+		return nil, err
 	}
-	gob.Register(Record{})
-	w.encoder = gob.NewEncoder(w.file)
-	w.decoder = gob.NewDecoder(w.file)
-	return err
-}
 
-// Public methods
-// Verify runs through the wal file and returns error if wal is corrupted
-func (w *Wal) Verify() error {
-	var err error
+	var damage []Damage
+	good := pr.pos // end of the last valid record
+	offset, numbered := int64(0), false
 	for {
-		record := &Record{}
-		err = w.decoder.Decode(record)
-		if err != nil {
-			if err == io.EOF {
-				err = nil
+		start := pr.pos
+		record, framed, err := records.next()
+		// Reached the END
+		if err == io.EOF {
+			return damage, nil
+		}
+		if record != nil {
+			if !numbered {
+				offset, numbered = legacyOffset(hdr, record.Seq, w.seq), true
 			}
-			break
+			record.Seq += offset
 		}
-		// Validations on individual records
-		if !w.validSeq(record.Seq) {
+		if err == nil && !w.validSeq(record.Seq) {
 			err = ErrInvalidSeq
-		} else if !record.validHash() {
-			err = ErrInvalidWalData
 		}
-		if err != nil {
-			break
+		if err == nil {
+			good = pr.pos
+			if err := decodeRecord(hdr.codec, record, start); err != nil {
+				return damage, err
+			}
+			if err := fn(record); err != nil {
+				return damage, err
+			}
+			continue
+		}
+		if framed && err == ErrInvalidSeq && w.policy == SkipCorrupt && record.Seq > w.seq {
+			// Earlier records were skipped; accept the gap and go on.
+			damage = append(damage, Damage{Segment: filepath.Base(seg.path), Offset: start,
+				Err: fmt.Errorf("records %d to %d missing", w.seq+1, record.Seq-1)})
+			w.seq = record.Seq
+			good = pr.pos
+			if err := decodeRecord(hdr.codec, record, start); err != nil {
+				return damage, err
+			}
+			if err := fn(record); err != nil {
+				return damage, err
+			}
+			continue
+		}
+
+		switch w.policy {
+		case TruncateTail:
+			if err == ErrInvalidSeq {
+				// The record is intact, so this isn't a torn write:
+				// records are missing and cutting them off would lose
+				// the rest of the segment.
+				return damage, fmt.Errorf("offset %d: %w", start, err)
+			}
+			if !last {
+				return damage, fmt.Errorf("offset %d: %w (not in the last segment, refusing to truncate)", start, err)
+			}
+			if err := truncateFile(seg.path, good); err != nil {
+				return damage, err
+			}
+			return append(damage, Damage{Segment: filepath.Base(seg.path), Offset: good, Bytes: size - good, Err: err}), nil
+		case SkipCorrupt:
+			if !framed {
+				// Without the record's extent there's no telling where
+				// the next one starts, so the rest of the segment is lost.
+				return append(damage, Damage{Segment: filepath.Base(seg.path), Offset: start, Bytes: size - start, Err: err}), nil
+			}
+			damage = append(damage, Damage{Segment: filepath.Base(seg.path), Offset: start, Bytes: pr.pos - start, Err: err})
+		default:
+			return damage, fmt.Errorf("offset %d: %w", start, err)
+		}
+	}
+}
+
+// badHeader handles a segment whose header is torn or fails its checksum, so
+// none of its records can be read. A crash while starting the last segment
+// leaves it like that: TruncateTail empties it. SkipCorrupt drops the segment.
+func (w *Wal) badHeader(seg segment, last bool, size int64, err error) ([]Damage, error) {
+	damage := []Damage{{Segment: filepath.Base(seg.path), Bytes: size, Err: err}}
+	switch w.policy {
+	case TruncateTail:
+		if !last {
+			return nil, fmt.Errorf("offset 0: %w (not in the last segment, refusing to truncate)", err)
 		}
+		if err := truncateFile(seg.path, 0); err != nil {
+			return nil, err
+		}
+		return damage, nil
+	case SkipCorrupt:
+		return damage, nil
 	}
+	return nil, fmt.Errorf("offset 0: %w", err)
+}
+
+// decodeRecord turns a valid record's data into its plain form. The checksum
+// already matched, so a failure isn't corruption the recovery policy could
+// drop: the key is missing or wrong.
+func decodeRecord(c *codec, record *Record, offset int64) error {
+	data, err := c.decode(record.Data)
+	if err != nil {
+		return fmt.Errorf("offset %d: %w", offset, err)
+	}
+	record.Data = data
+	return nil
+}
+
+// Public methods
+// Verify runs through every wal segment and returns error if wal is corrupted
+// regardless of the recovery policy. It doesn't modify any segment.
+func (w *Wal) Verify() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	policy := w.policy
+	w.policy = Strict
+	defer func() { w.policy = policy }()
+	_, err := w.readSegments(func(*Record) error { return nil })
 	return err
 }
 
@@ -168,85 +470,246 @@ func (w *Wal) Rename() (err error) {
 	return err
 }
 
-// Close runs the cleanup tasks
-func (w *Wal) Close() {
-	w.Rename()
-	w.file.Close()
+// Close flushes, fsyncs and finalizes the segment being written, gives the
+// archiver a last attempt at the segments it hasn't archived, and releases
+// the files. It returns the error that kept the segment from being
+// finalized, in which case it is left for recovery to read on the next open.
+// Closing a closed Wal returns nil.
+func (w *Wal) Close() error {
+	if w.closing != nil {
+		// Let the sync goroutine finish the writes it already took
+		w.closeOnce.Do(func() { close(w.closing) })
+		<-w.syncDone
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	if w.written == nil {
+		// Opened for reading only
+		if w.file != nil {
+			return w.file.Close()
+		}
+		return nil
+	}
+	var err error
+	if w.written.n == 0 {
+		// Nothing was written since the last rotation
+		w.file.Close()
+		os.Remove(w.walPath(true))
+	} else if err = w.finalizeSegment(); err != nil {
+		err = fmt.Errorf("failed to finalize %s: %w", filepath.Base(w.walPath(true)), err)
+	}
+	if w.archiver != nil {
+		w.archiver.close()
+	}
+	return err
+}
+
+// Write appends the Record to WAL and returns its sequence number. Whether
+// the record is durable when Write returns depends on the sync policy.
+func (w *Wal) Write(data []byte) (int64, error) {
+	seq, pending, err := w.Append(data)
+	if err != nil {
+		return 0, err
+	}
+	return seq, pending.Wait()
 }
 
-// Write appends the Record to WAL
-func (w *Wal) Write(data []byte) error {
+// Append is Write without waiting for group commit: under SyncGroup the
+// record is only buffered when Append returns, and is durable once Wait on
+// the returned Pending does. Callers that log under a lock of their own can
+// so wait after releasing it, letting concurrent writes share an fsync. With
+// the other policies the record is written before Append returns.
+func (w *Wal) Append(data []byte) (int64, Pending, error) {
 	w.mu.Lock()
 	defer w.mu.Unlock()
-	record := &Record{Seq: w.nextseq(), Hash: CalculateHash(data), Data: data}
-	err := w.encoder.Encode(record)
-	if logSync {
-		Fsync(w.file)
-	}
-	if w.useS3 {
-		// Logic to upload the file to S3
-		filePath := w.walPath(false)
-		err := UploadToS3(w.s3Uploader, w.s3Bucket, filepath.Base(filePath), filePath)
-		if err != nil {
+	if w.closed {
+		return 0, Pending{}, ErrWalClosed
+	}
+	if w.opts.Sync == SyncGroup {
+		return w.appendGroup(data)
+	}
+	seq, err := w.append(data)
+	if err != nil {
+		return 0, Pending{}, err
+	}
+	if err := w.commit(w.opts.Sync == SyncAlways); err != nil {
+		return 0, Pending{}, err
+	}
+	return seq, Pending{}, nil
+}
+
+// append encodes a record into the write buffer. The caller must hold w.mu
+// and call commit afterwards.
+func (w *Wal) append(data []byte) (int64, error) {
+	data, err := w.codec.encode(data)
+	if err != nil {
+		return 0, err
+	}
+	seq := w.nextseq()
+	w.written.Write(encodeRecord(seq, data))
+	w.records++
+	w.unwritten++
+	return seq, nil
+}
+
+// commit writes the buffered records to the segment in one write, fsyncs it
+// if sync is set and rolls over to a new segment if the current one is full.
+// If the records can't be written they are dropped, see discard. The caller
+// must hold w.mu.
+func (w *Wal) commit(sync bool) error {
+	size, err := w.file.Seek(0, io.SeekEnd)
+	if err != nil {
+		w.discard(-1)
+		return err
+	}
+	if _, err := w.file.Write(w.buf.Bytes()); err != nil {
+		w.discard(size)
+		return err
+	}
+	if sync {
+		if err := Fsync(w.file); err != nil {
+			w.discard(size)
 			return err
 		}
 	}
-	return err
+	w.buf.Reset()
+	w.unwritten = 0
+	w.dirty = !sync
+	if w.segmentFull() {
+		w.dirty = false // finalizeSegment fsyncs
+		return w.rotate()
+	}
+	return nil
+}
+
+// discard drops the buffered records after a failed commit. It cuts the
+// segment back to size, unless that is negative, in case some of them
+// reached it, and takes back their sequence numbers so the next record
+// follows the last committed one without a gap. The caller must hold w.mu.
+func (w *Wal) discard(size int64) {
+	if size >= 0 {
+		if err := w.file.Truncate(size); err != nil {
+			log.Printf("WAL: failed to truncate %s after a failed write: %v", w.walPath(true), err)
+		}
+	}
+	w.seq -= w.unwritten
+	w.records -= w.unwritten
+	w.written.n -= int64(w.buf.Len())
+	w.buf.Reset()
+	w.unwritten = 0
 }
 
-// Read the wal data from beginning till the end
-func (w *Wal) Read() chan *Record {
+// Prune removes the finalized segments whose records all have a sequence
+// number <= seq, typically because a snapshot covers them, and returns their
+// paths. The segment being written is never removed.
+func (w *Wal) Prune(seq int64) ([]string, error) {
 	w.mu.Lock()
 	defer w.mu.Unlock()
-	rChan := make(chan *Record, walChannelBufferSize)
-	var err error
-	w.file.Seek(0, 0)
-	go func() {
-		for {
-			record := &Record{}
-			err = w.decoder.Decode(record)
-			// Reached the END
-			if err == io.EOF {
-				err = nil
-				break
-			} else if err != nil {
-				log.Fatal(err)
-			}
-			// Validations on individual records
-			if !w.validSeq(record.Seq) {
-				log.Fatal(ErrInvalidSeq)
-			}
-			if !record.validHash() {
-				log.Fatal(ErrInvalidWalData)
+	segments, err := listSegments(w.dirPath)
+	if err != nil {
+		return nil, err
+	}
+	// A segment is covered once a later segment starts at or before seq+1.
+	covered := 0
+	for i, seg := range segments {
+		if seg.baseSeq == w.baseSeq {
+			// The current segment was started by this Wal, so its first
+			// sequence is known even before anything is written to it.
+			if w.seq-w.records+1 <= seq+1 {
+				covered = i
 			}
-			rChan <- record
+			break
+		}
+		first, ok, err := firstSeq(seg.path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", filepath.Base(seg.path), err)
 		}
-		close(rChan)
-	}()
-	return rChan
+		if ok && first <= seq+1 {
+			covered = i
+		}
+	}
+	var removed []string
+	for _, seg := range segments[:covered] {
+		if seg.isTmp || (w.archiver != nil && w.archiver.isPending(seg.path)) {
+			continue
+		}
+		if err := os.Remove(seg.path); err != nil {
+			return removed, err
+		}
+		removed = append(removed, seg.path)
+	}
+	if len(removed) > 0 {
+		return removed, syncDir(w.dirPath)
+	}
+	return removed, nil
+}
+
+// LastSeq returns the sequence number of the last record written
+func (w *Wal) LastSeq() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.seq
+}
+
+// Read calls fn for every record of every segment from beginning till the
+// end, and stops at the first error fn returns. Corrupted data fails the read
+// or is dropped, depending on the recovery policy the Wal was opened with;
+// the returned Damage lists what was dropped.
+func (w *Wal) Read(fn func(*Record) error) ([]Damage, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.readSegments(fn)
 }
-func New(dirPath string, usesS3 bool, s3Config serverconfig.S3Config, s3Session *session.Session) (*Wal, error) {
-	wal := Wal{dirPath: dirPath, useS3: usesS3}
+
+// New opens a new segment in dirPath for writing and returns a Wal object
+func New(dirPath string, opts Options) (*Wal, error) {
+	if opts.Sync == "" {
+		opts.Sync = SyncAlways
+	}
+	codec, err := newCodec(opts.Compression, opts.EncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	wal := Wal{dirPath: dirPath, opts: opts, codec: codec}
 
 	// Initialize the WAL file
-	err := wal.newWalFile()
+	err = wal.newWalFile()
 	if err != nil {
 		return nil, err
 	}
+	wal.closing = make(chan struct{})
+	wal.syncDone = make(chan struct{})
+	wal.startSync()
 
-	// Setup for S3 if usesS3 is true
-	if usesS3 {
-		wal.s3Bucket = s3Config.Bucket
-		wal.s3Uploader = s3manager.NewUploader(s3Session)
-		wal.s3Downloader = s3manager.NewDownloader(s3Session)
+	if opts.Archive != nil {
+		// Segments finalized by earlier runs may not have made it to the
+		// archive yet
+		segments, err := listSegments(dirPath)
+		if err != nil {
+			return nil, err
+		}
+		var finalized []string
+		for _, seg := range segments {
+			if !seg.isTmp {
+				finalized = append(finalized, seg.path)
+			}
+		}
+		wal.archiver = newArchiver(opts.Archive)
+		wal.archiver.catchUp(finalized)
 	}
 
 	return &wal, nil
 }
 
-// Open opens the existing latest wal file for reading and returns a Wal object
-func Open(dirPath string) (*Wal, error) {
-	wal := Wal{dirPath: dirPath}
+// Open opens every existing wal segment for reading and returns a Wal object.
+// policy decides how Read handles corrupted records. key decrypts encrypted
+// segments; plain and compressed segments are read without it.
+func Open(dirPath string, policy RecoveryPolicy, key []byte) (*Wal, error) {
+	wal := Wal{dirPath: dirPath, policy: policy, key: key}
 	err := wal.openWalFile()
 	return &wal, err
 }
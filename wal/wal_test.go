@@ -0,0 +1,525 @@
+package wal
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testData(seq int) []byte {
+	return []byte(fmt.Sprintf("record %d", seq))
+}
+
+// writeRecords writes n records to a new WAL in dir and closes it.
+func writeRecords(t *testing.T, dir string, n int, opts Options) {
+	t.Helper()
+	w, err := New(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= n; i++ {
+		seq, err := w.Write(testData(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seq != int64(i) {
+			t.Fatalf("record %d got sequence %d", i, seq)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readRecords reads the WAL in dir and returns the sequence numbers read.
+func readRecords(t *testing.T, dir string, policy RecoveryPolicy, key []byte) ([]int64, []Damage) {
+	t.Helper()
+	w, err := Open(dir, policy, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	var seqs []int64
+	damage, err := w.Read(func(r *Record) error {
+		if want := testData(int(r.Seq)); !bytes.Equal(r.Data, want) {
+			return fmt.Errorf("record %d: got %q, want %q", r.Seq, r.Data, want)
+		}
+		seqs = append(seqs, r.Seq)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return seqs, damage
+}
+
+func lastSegment(t *testing.T, dir string) string {
+	t.Helper()
+	segments, err := listSegments(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) == 0 {
+		t.Fatal("no segments")
+	}
+	return segments[len(segments)-1].path
+}
+
+func checkSeqs(t *testing.T, got []int64, want ...int64) {
+	t.Helper()
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("read records %v, want %v", got, want)
+	}
+}
+
+func TestWriteRead(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	for _, tc := range []struct {
+		name string
+		opts Options
+		key  []byte
+	}{
+		{"plain", Options{}, nil},
+		{"flate", Options{Compression: CompressFlate}, nil},
+		{"encrypted", Options{Compression: CompressFlate, EncryptionKey: key}, key},
+		{"group", Options{Sync: SyncGroup}, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			tc.opts.SegmentMaxRecords = 4
+			writeRecords(t, dir, 10, tc.opts)
+			seqs, damage := readRecords(t, dir, Strict, tc.key)
+			checkSeqs(t, seqs, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10)
+			if len(damage) != 0 {
+				t.Fatalf("unexpected damage %v", damage)
+			}
+		})
+	}
+}
+
+// TestCloseError checks that Close reports a segment it failed to finalize.
+func TestCloseError(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "wal")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	w, err := New(dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(testData(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err == nil {
+		t.Fatal("Close of a segment whose directory is gone succeeded")
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("second Close got %v, want nil", err)
+	}
+}
+
+func TestTruncateTornTail(t *testing.T) {
+	dir := t.TempDir()
+	writeRecords(t, dir, 3, Options{})
+	path := lastSegment(t, dir)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A crash in the middle of writing record 4
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	torn := encodeRecord(4, testData(4))
+	if _, err := f.Write(torn[:len(torn)-3]); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	seqs, damage := readRecords(t, dir, TruncateTail, nil)
+	checkSeqs(t, seqs, 1, 2, 3)
+	if len(damage) != 1 || damage[0].Offset != info.Size() || damage[0].Bytes != int64(len(torn)-3) {
+		t.Fatalf("damage %v, want %d bytes dropped at %d", damage, len(torn)-3, info.Size())
+	}
+	if after, err := os.Stat(path); err != nil || after.Size() != info.Size() {
+		t.Fatalf("segment not truncated back to %d bytes: %v %v", info.Size(), after.Size(), err)
+	}
+
+	// The tail is gone, so even a strict read succeeds now
+	seqs, _ = readRecords(t, dir, Strict, nil)
+	checkSeqs(t, seqs, 1, 2, 3)
+}
+
+func TestTruncateTailRefusesGap(t *testing.T) {
+	dir := t.TempDir()
+	writeRecords(t, dir, 3, Options{})
+	path := lastSegment(t, dir)
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Record 4 is missing, but record 5 is intact
+	if _, err := f.Write(encodeRecord(5, testData(5))); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	before, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := Open(dir, TruncateTail, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = w.Read(func(*Record) error { return nil })
+	w.Close()
+	if !errors.Is(err, ErrInvalidSeq) {
+		t.Fatalf("read of a sequence gap: got %v, want %v", err, ErrInvalidSeq)
+	}
+	if after, err := os.Stat(path); err != nil || after.Size() != before.Size() {
+		t.Fatalf("segment truncated to %d bytes, want %d: %v", after.Size(), before.Size(), err)
+	}
+}
+
+func TestTruncateTornHeader(t *testing.T) {
+	dir := t.TempDir()
+	writeRecords(t, dir, 3, Options{})
+
+	// A crash while writing the header of the next segment
+	c, err := newCodec(CompressNone, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, tmpWalName(2))
+	if err := os.WriteFile(path, encodeSegmentHeader(c, 4)[:10], fMode); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := Open(dir, Strict, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Read(func(*Record) error { return nil }); !errors.Is(err, ErrInvalidWalData) {
+		t.Fatalf("strict read of a torn header: got %v, want %v", err, ErrInvalidWalData)
+	}
+	w.Close()
+
+	seqs, damage := readRecords(t, dir, TruncateTail, nil)
+	checkSeqs(t, seqs, 1, 2, 3)
+	if len(damage) != 1 || damage[0].Segment != tmpWalName(2) || damage[0].Bytes != 10 {
+		t.Fatalf("damage %v, want the 10 byte header of %s dropped", damage, tmpWalName(2))
+	}
+
+	// Writing carries on in a new segment
+	w, err = New(dir, Options{LastSeq: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(testData(4)); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	seqs, _ = readRecords(t, dir, Strict, nil)
+	checkSeqs(t, seqs, 1, 2, 3, 4)
+}
+
+func TestSkipCorruptRecord(t *testing.T) {
+	dir := t.TempDir()
+	writeRecords(t, dir, 3, Options{})
+	path := lastSegment(t, dir)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Flip a payload byte of record 2, which fails its crc
+	second := segmentHeaderSize + recordHeaderSize + len(testData(1))
+	data[second+recordHeaderSize] ^= 0xff
+	if err := os.WriteFile(path, data, fMode); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := Open(dir, Strict, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Read(func(*Record) error { return nil }); err == nil {
+		t.Fatal("strict read of a corrupted record succeeded")
+	}
+	w.Close()
+
+	seqs, damage := readRecords(t, dir, SkipCorrupt, nil)
+	checkSeqs(t, seqs, 1, 3)
+	if len(damage) == 0 || damage[0].Offset != int64(second) {
+		t.Fatalf("damage %v, want record at offset %d dropped", damage, second)
+	}
+}
+
+// writeGobSegment writes a version 0 segment, a bare gob stream of n records
+// numbered from 1, as every run did before sequences carried over. Their data
+// is testData from first on.
+func writeGobSegment(t *testing.T, dir string, base int64, first, n int) {
+	t.Helper()
+	f, err := os.Create(filepath.Join(dir, walName(base)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	enc := gob.NewEncoder(f)
+	for i := 0; i < n; i++ {
+		data := testData(first + i)
+		if err := enc.Encode(Record{Seq: int64(i + 1), Hash: CalculateHash(data), Data: data}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReadLegacySegments(t *testing.T) {
+	dir := t.TempDir()
+	writeGobSegment(t, dir, 1, 1, 2)
+	writeGobSegment(t, dir, 2, 3, 2)
+
+	for _, policy := range []RecoveryPolicy{Strict, TruncateTail, SkipCorrupt} {
+		seqs, damage := readRecords(t, dir, policy, nil)
+		checkSeqs(t, seqs, 1, 2, 3, 4)
+		if len(damage) != 0 {
+			t.Fatalf("%s: unexpected damage %v", policy, damage)
+		}
+	}
+
+	// New records carry on from the renumbered ones
+	w, err := New(dir, Options{LastSeq: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seq, err := w.Write(testData(5)); err != nil || seq != 5 {
+		t.Fatalf("Write got sequence %d, %v", seq, err)
+	}
+	w.Close()
+	seqs, _ := readRecords(t, dir, Strict, nil)
+	checkSeqs(t, seqs, 1, 2, 3, 4, 5)
+}
+
+func TestConvertGobSegment(t *testing.T) {
+	dir := t.TempDir()
+	writeGobSegment(t, dir, 1, 1, 3)
+
+	converted, err := Convert(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(converted) != 1 || converted[0] != walName(1) {
+		t.Fatalf("converted %v, want %s", converted, walName(1))
+	}
+	header, err := os.ReadFile(filepath.Join(dir, walName(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(header, segmentMagic) || header[4] != segmentVersion {
+		t.Fatalf("converted segment starts with %q", header[:5])
+	}
+
+	seqs, _ := readRecords(t, dir, Strict, nil)
+	checkSeqs(t, seqs, 1, 2, 3)
+
+	// Segments already in the current format are left alone
+	if converted, err := Convert(dir); err != nil || len(converted) != 0 {
+		t.Fatalf("second Convert converted %v, %v", converted, err)
+	}
+}
+
+func TestConvertLegacySegments(t *testing.T) {
+	dir := t.TempDir()
+	writeGobSegment(t, dir, 1, 1, 2)
+	writeGobSegment(t, dir, 2, 3, 0)
+	writeGobSegment(t, dir, 3, 3, 3)
+
+	converted, err := Convert(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(converted) != 3 {
+		t.Fatalf("converted %v, want all 3 segments", converted)
+	}
+	// The records are renumbered on disk, not just when read
+	infos, err := Inspect(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range [][2]int64{{1, 2}, {0, 0}, {3, 5}} {
+		info := infos[i]
+		if info.Err != nil || info.Version != segmentVersion || info.FirstSeq != want[0] || info.LastSeq != want[1] {
+			t.Fatalf("%s: version %d, records %d to %d, %v; want %d to %d", info.Name, info.Version, info.FirstSeq, info.LastSeq, info.Err, want[0], want[1])
+		}
+	}
+
+	seqs, _ := readRecords(t, dir, Strict, nil)
+	checkSeqs(t, seqs, 1, 2, 3, 4, 5)
+}
+
+func TestGroupCommit(t *testing.T) {
+	dir := t.TempDir()
+	w, err := New(dir, Options{Sync: SyncGroup})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const writers, each = 8, 50
+	errs := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		go func() {
+			for j := 0; j < each; j++ {
+				seq, pending, err := w.Append([]byte("pending"))
+				if err == nil {
+					err = pending.Wait()
+				}
+				if err != nil || seq < 1 || seq > writers*each {
+					errs <- fmt.Errorf("append got sequence %d, %v", seq, err)
+					return
+				}
+			}
+			errs <- nil
+		}()
+	}
+	for i := 0; i < writers; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Sync waits for the batch of the records appended before it
+	_, pending, err := w.Append([]byte("pending"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-pending.batch.done:
+	default:
+		t.Fatal("Sync returned before the pending batch was committed")
+	}
+
+	// A batch that can't be written fails its callers and every later
+	// write, and is not left in the segment
+	w.mu.Lock()
+	w.file.Close()
+	w.mu.Unlock()
+	_, pending, err = w.Append([]byte("lost"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Sync(); err == nil {
+		t.Fatal("Sync succeeded for a batch that failed to commit")
+	}
+	if err := pending.Wait(); err == nil {
+		t.Fatal("Wait succeeded for a batch that failed to commit")
+	}
+	if _, _, err := w.Append([]byte("after")); err == nil {
+		t.Fatal("Append succeeded after a failed group commit")
+	}
+	if w.LastSeq() != writers*each+1 {
+		t.Fatalf("LastSeq %d after the failed batch, want %d", w.LastSeq(), writers*each+1)
+	}
+	w.Close()
+
+	r, err := Open(dir, Strict, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	var n int64
+	if _, err := r.Read(func(rec *Record) error {
+		n++
+		if rec.Seq != n || string(rec.Data) != "pending" {
+			return fmt.Errorf("record %d: seq %d, %q", n, rec.Seq, rec.Data)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if n != writers*each+1 {
+		t.Fatalf("read %d records, want %d", n, writers*each+1)
+	}
+}
+
+// TestTruncateAfterTwice cuts the same segment twice: the second cut keeps
+// the copy the first one set aside.
+func TestTruncateAfterTwice(t *testing.T) {
+	dir := t.TempDir()
+	writeRecords(t, dir, 10, Options{SegmentMaxRecords: 4})
+	first, err := TruncateAfter(dir, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first) != 2 || !first[0].Truncated || first[1].Truncated {
+		t.Fatalf("first truncation made cuts %+v, want the second segment cut and the third set aside", first)
+	}
+	second, err := TruncateAfter(dir, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(second) != 1 || second[0].Segment != first[0].Segment || !second[0].Truncated {
+		t.Fatalf("second truncation made cuts %+v, want the second segment cut again", second)
+	}
+	if second[0].Discarded == first[0].Discarded {
+		t.Fatalf("both truncations set the segment aside as %s", first[0].Discarded)
+	}
+	for _, cut := range append(first, second...) {
+		if _, err := os.Stat(filepath.Join(dir, cut.Discarded)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	seqs, _ := readRecords(t, dir, Strict, nil)
+	checkSeqs(t, seqs, 1, 2, 3, 4, 5)
+
+	// New segments are numbered after every discarded one
+	base, ok, err := maxDiscardedBase(dir)
+	if err != nil || !ok || base != 2 {
+		t.Fatalf("maxDiscardedBase got %d, %v, %v, want 2", base, ok, err)
+	}
+	if name, ok := discardedName(second[0].Discarded); !ok || name != second[0].Segment {
+		t.Fatalf("%s was set aside from %q, want %s", second[0].Discarded, name, second[0].Segment)
+	}
+}
+
+// TestLockDir takes the lock twice: flock locks belong to the open file, so
+// the second LockDir fails even within one process.
+func TestLockDir(t *testing.T) {
+	dir := t.TempDir()
+	lock, err := LockDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = LockDir(dir)
+	if !errors.Is(err, ErrDirLocked) {
+		t.Fatalf("second LockDir got %v, want ErrDirLocked", err)
+	}
+	if pid := fmt.Sprintf("pid %d", os.Getpid()); !strings.Contains(err.Error(), pid) {
+		t.Fatalf("second LockDir got %q, want it to name %s", err, pid)
+	}
+
+	if err := lock.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := lock.Unlock(); err != nil {
+		t.Fatalf("second Unlock got %v", err)
+	}
+	lock, err = LockDir(dir)
+	if err != nil {
+		t.Fatalf("LockDir after Unlock got %v", err)
+	}
+	if err := lock.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+}